@@ -0,0 +1,148 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+)
+
+// Operations of the records written by AuditStore.
+const (
+	AuditSave   = "save"
+	AuditDelete = "delete"
+)
+
+// NewAuditStore returns a new AuditStore in front of store, appending the
+// audit records to w.
+func NewAuditStore(store Store, w io.Writer) *AuditStore {
+	return &AuditStore{
+		Serializer: securecookie.GobEncoder{},
+		store:      store,
+		w:          w,
+	}
+}
+
+// AuditRecord is a record written by AuditStore.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name"`
+	// ID is the storage key of the session ID, if any, see StorageKey, so
+	// that the records don't disclose the IDs.
+	ID string `json:"id,omitempty"`
+	// Op is AuditSave or AuditDelete.
+	Op string `json:"op"`
+	// Snapshot holds the session values serialized with the Serializer of
+	// the store.
+	Snapshot []byte `json:"snapshot"`
+}
+
+// AuditStore is a Store wrapper keeping a record of the changes to the
+// sessions: after each successful Save through the underlying store, it
+// appends an AuditRecord of the saved or deleted session to its writer, as
+// one JSON object per line. Sessions are deleted by saving them with
+// Options.MaxAge <= 0.
+//
+// The writer is append-only as far as the store is concerned: the records
+// are only as immutable as the writer makes them, e.g. a file opened with
+// os.O_APPEND and shipped to write-once storage. Writes are serialized.
+//
+// The records hold the session values, so protect them as the sessions
+// themselves.
+type AuditStore struct {
+	// Serializer serializes the snapshots of the session values. It
+	// defaults to securecookie.GobEncoder.
+	Serializer securecookie.Serializer
+	// FailOnError, if set, makes Save return the error of writing the
+	// record. The session has been saved by the underlying store then:
+	// the error only tells that the change was not recorded. Otherwise
+	// the error is passed to OnError, if set, and Save succeeds.
+	FailOnError bool
+	// OnError, if set, is called with the errors of writing the records.
+	OnError func(err error)
+	store   Store
+	mu      sync.Mutex
+	w       io.Writer
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *AuditStore) Get(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	return GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the
+// registry, loaded from the underlying store. Loads are not recorded.
+//
+// See CookieStore.New().
+func (s *AuditStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	session, err := s.store.New(ctx, name)
+	if session != nil {
+		session.store = s
+	}
+	return session, err
+}
+
+// Save saves the session in the underlying store and records it.
+func (s *AuditStore) Save(ctx *fasthttp.RequestCtx, session *Session) error {
+	if err := s.store.Save(ctx, session); err != nil {
+		return err
+	}
+	op := AuditSave
+	if session.Options != nil && session.Options.MaxAge <= 0 {
+		op = AuditDelete
+	}
+	err := s.record(session, op)
+	if err == nil {
+		return nil
+	}
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+	if s.FailOnError {
+		return err
+	}
+	return nil
+}
+
+// Close closes the underlying store if it implements Closer. The writer is
+// left open.
+func (s *AuditStore) Close() error {
+	if c, ok := s.store.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// record writes an AuditRecord of the operation op on session.
+func (s *AuditStore) record(session *Session, op string) error {
+	snapshot, err := s.Serializer.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	record := &AuditRecord{
+		Time:     time.Now(),
+		Name:     session.Name(),
+		Op:       op,
+		Snapshot: snapshot,
+	}
+	if session.ID != "" {
+		record.ID = StorageKey(session.ID)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
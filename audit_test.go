@@ -0,0 +1,105 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+)
+
+// failingWriter fails all the writes.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestAuditStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	store := NewAuditStore(NewFilesystemStore(dir, []byte("secret-key")), &buf)
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	if session.Store() != store {
+		t.Fatal("Expected the session to be bound to the audit store")
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	req := requestWithCookie(ctx, "session-key")
+	session, _ = store.New(req, "session-key")
+	session.Values["name"] = "someone else"
+	if err = session.Save(req); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	session.Options.MaxAge = -1
+	if err = session.Save(req); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+
+	var records []AuditRecord
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var record AuditRecord
+		if err = dec.Decode(&record); err != nil {
+			t.Fatalf("Error decoding record: %v", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records; Got %d", len(records))
+	}
+	for i, want := range []struct{ op, name string }{
+		{AuditSave, "gopher"},
+		{AuditSave, "someone else"},
+		{AuditDelete, "someone else"},
+	} {
+		record := records[i]
+		if record.Op != want.op || record.Name != "session-key" || record.ID != StorageKey(session.ID) || record.Time.IsZero() {
+			t.Fatalf("record %d: unexpected record %+v", i, record)
+		}
+		values := make(map[interface{}]interface{})
+		if err = (securecookie.GobEncoder{}).Deserialize(record.Snapshot, &values); err != nil {
+			t.Fatalf("record %d: error decoding snapshot: %v", i, err)
+		}
+		if values["name"] != want.name {
+			t.Fatalf("record %d: expected name %q; Got %v", i, want.name, values)
+		}
+	}
+}
+
+func TestAuditStoreFailOnError(t *testing.T) {
+	store := NewAuditStore(NewCookieStore([]byte("secret-key")), failingWriter{})
+	var reported error
+	store.OnError = func(err error) {
+		reported = err
+	}
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Expected the audit error to be ignored; Got %v", err)
+	}
+	if reported == nil {
+		t.Fatal("Expected the audit error to be reported")
+	}
+
+	store.FailOnError = true
+	if err := session.Save(ctx); err == nil {
+		t.Fatal("Expected the audit error to fail the Save")
+	}
+}
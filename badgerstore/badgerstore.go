@@ -0,0 +1,432 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package badgerstore provides a BadgerDB session store for the sessions
+// package.
+package badgerstore
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/go-gem/sessions"
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+)
+
+// Prefixes of the session keys and of the user index keys in the database.
+const (
+	keyPrefix  = "session_"
+	userPrefix = "user_"
+)
+
+// NewBadgerStore returns a new BadgerStore.
+//
+// See sessions.NewCookieStore() for a description of the other parameters.
+func NewBadgerStore(db *badger.DB, keyPairs ...[]byte) *BadgerStore {
+	codecs, err := sessions.NewCodecs(keyPairs...)
+	if err != nil {
+		panic(err)
+	}
+	bs := &BadgerStore{
+		Codecs: codecs,
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		db: db,
+	}
+
+	bs.MaxAge(bs.Options.MaxAge)
+	return bs
+}
+
+// BadgerStore stores sessions in a BadgerDB database.
+//
+// The cookie only holds the signed session ID. Each session is stored under
+// the "session_" prefix followed by the storage key of its ID (see
+// sessions.StorageKey), as the session values encoded with the codecs. The
+// entries are written with a TTL of Options.MaxAge, so Badger expires them
+// by itself and no GC method is needed.
+//
+// Sessions tagged with sessions.Session.SetUser are also indexed under the
+// "user_" prefix followed by the storage keys of the user ID and of the
+// session ID, with the same TTL, for DeleteByUser and CountByUser.
+//
+// Badger doesn't reclaim the space of expired and overwritten entries in its
+// value log on its own: the application must call db.RunValueLogGC
+// periodically, for example:
+//
+//	ticker := time.NewTicker(5 * time.Minute)
+//	defer ticker.Stop()
+//	for range ticker.C {
+//		for db.RunValueLogGC(0.5) == nil {
+//		}
+//	}
+type BadgerStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options // default configuration
+	db      *badger.DB
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See sessions.CookieStore.Get().
+func (s *BadgerStore) Get(ctx *fasthttp.RequestCtx, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// It returns sessions.ErrSessionNotFound if the session referenced by the
+// cookie does not exist or has expired, and sessions.ErrSignatureInvalid if
+// the cookie signature could not be verified.
+//
+// See sessions.CookieStore.New().
+func (s *BadgerStore) New(ctx *fasthttp.RequestCtx, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	var err error
+	if c := ctx.Request.Header.Cookie(name); len(c) > 0 {
+		err = sessions.DecodeMulti(name, string(c), &session.ID, s.Codecs...)
+		if err == nil {
+			err = s.load(session)
+			if err == nil {
+				session.IsNew = false
+			}
+		}
+	}
+	return session, err
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is <= 0 then the session is deleted
+// from the database.
+func (s *BadgerStore) Save(ctx *fasthttp.RequestCtx, session *sessions.Session) error {
+	if session.Options == nil {
+		// Defaults of the store at the time of Save, see
+		// sessions.Session.Options.
+		opts := *s.Options
+		session.Options = &opts
+	}
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			err := s.db.Update(func(txn *badger.Txn) error {
+				if userID := session.User(); userID != "" {
+					if err := txn.Delete(userKey(userID, session.ID)); err != nil {
+						return err
+					}
+				}
+				return txn.Delete([]byte(keyPrefix + sessions.StorageKey(session.ID)))
+			})
+			if err != nil {
+				return &sessions.StorageError{Op: "delete", Err: err}
+			}
+		}
+		sessions.SetCookie(ctx, session.Name(), "", session.Options)
+		return nil
+	}
+
+	if session.ID == "" {
+		key := securecookie.GenerateRandomKey(32)
+		if key == nil {
+			return errors.New("badgerstore: failed to generate session id")
+		}
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(key), "=")
+	}
+	if err := s.save(session); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
+		s.Codecs...)
+	if err != nil {
+		return err
+	}
+	sessions.SetCookie(ctx, session.Name(), encoded, session.Options)
+	return nil
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *BadgerStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each securecookie instance.
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// DeleteByUser removes all the sessions tagged with the given user ID, see
+// sessions.Session.SetUser, and returns the number of sessions removed.
+func (s *BadgerStore) DeleteByUser(userID string) (int, error) {
+	n := 0
+	err := s.db.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = userKey(userID, "")
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		var indexes [][]byte
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			indexes = append(indexes, iter.Item().KeyCopy(nil))
+		}
+		for _, index := range indexes {
+			key := []byte(keyPrefix + indexedKey(index))
+			if _, err := txn.Get(key); err == nil {
+				n++
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+			if err := txn.Delete(index); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	return n, nil
+}
+
+// DeleteWhere removes the unexpired sessions saved with the given session
+// name for which pred returns true, e.g. all the sessions of a user for a
+// data subject erasure request, and returns the number of sessions removed.
+//
+// pred is given the session with its values; its ID is empty, as the store
+// only keeps a hash of it. It reads and decodes every session: it is meant
+// for admin tasks, not for the request hot path. Use DeleteByUser for
+// sessions tagged with sessions.Session.SetUser, which only reads an index.
+//
+// The sessions are read in a single read-only transaction, then deleted
+// with a write batch, which commits as many transactions as needed: a
+// session saved again after it was read is deleted all the same.
+//
+// See sessions.FilesystemStore.DeleteWhere().
+func (s *BadgerStore) DeleteWhere(name string, pred func(*sessions.Session) bool) (int, error) {
+	n := 0
+	var deleted [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(keyPrefix)
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			encoded, err := iter.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			session := sessions.NewSession(s, name)
+			session.IsNew = false
+			if securecookie.DecodeMulti(name, string(encoded), &session.Values, s.Codecs...) != nil {
+				continue
+			}
+			if !pred(session) {
+				continue
+			}
+			key := iter.Item().KeyCopy(nil)
+			deleted = append(deleted, key)
+			if userID := session.User(); userID != "" {
+				deleted = append(deleted, append(userKey(userID, ""), key[len(keyPrefix):]...))
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range deleted {
+		if err = wb.Delete(key); err != nil {
+			return 0, &sessions.StorageError{Op: "delete", Err: err}
+		}
+	}
+	if err = wb.Flush(); err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	return n, nil
+}
+
+// CountByUser returns the number of unexpired sessions tagged with the given
+// user ID, see sessions.Session.SetUser, e.g. to limit the number of
+// concurrent sessions of a user at login.
+func (s *BadgerStore) CountByUser(userID string) (int, error) {
+	n := 0
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = userKey(userID, "")
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			_, err := txn.Get([]byte(keyPrefix + indexedKey(iter.Item().Key())))
+			if err == nil {
+				n++
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "load", Err: err}
+	}
+	return n, nil
+}
+
+// List returns the storage keys of the unexpired sessions starting with
+// prefix.
+//
+// See sessions.Lister.
+func (s *BadgerStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(keyPrefix + prefix)
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			keys = append(keys, strings.TrimPrefix(string(iter.Item().Key()), keyPrefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &sessions.StorageError{Op: "list", Err: err}
+	}
+	return keys, nil
+}
+
+// Ping checks that the database is open. The database is local, so it is
+// always reachable otherwise.
+//
+// See sessions.Pinger.
+func (s *BadgerStore) Ping(ctx context.Context) error {
+	if s.db.IsClosed() {
+		return &sessions.StorageError{Op: "ping", Err: badger.ErrDBClosed}
+	}
+	return nil
+}
+
+// Validate writes, reads and deletes a probe key in the database.
+//
+// See sessions.Validator.
+func (s *BadgerStore) Validate() error {
+	key := []byte("probe_" + sessions.StorageKey("probe"))
+	err := s.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(key, []byte("probe")); err != nil {
+			return err
+		}
+		if _, err := txn.Get(key); err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+	if err != nil {
+		return &sessions.StorageError{Op: "validate", Err: err}
+	}
+	return nil
+}
+
+// Close closes the database given to NewBadgerStore, so don't call it if the
+// database is shared with other users.
+//
+// See sessions.Closer.
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
+
+// save writes the encoded session.Values to the database, with a TTL of
+// session.Options.MaxAge. If the stored session was tagged with another user,
+// its entry in the index of that user is removed.
+func (s *BadgerStore) save(session *sessions.Session) error {
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
+		s.Codecs...)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	entry := badger.NewEntry([]byte(keyPrefix+sessions.StorageKey(session.ID)), []byte(encoded)).
+		WithTTL(ttl)
+	userID, previous := session.User(), s.storedUser(session)
+	if err = s.db.Update(func(txn *badger.Txn) error {
+		if userID != "" {
+			if err := txn.SetEntry(badger.NewEntry(userKey(userID, session.ID), nil).WithTTL(ttl)); err != nil {
+				return err
+			}
+		}
+		if previous != "" && previous != userID {
+			if err := txn.Delete(userKey(previous, session.ID)); err != nil {
+				return err
+			}
+		}
+		return txn.SetEntry(entry)
+	}); err != nil {
+		return &sessions.StorageError{Op: "save", Err: err}
+	}
+	return nil
+}
+
+// storedUser returns the user tagged on the stored copy of session, or an
+// empty string if it is not tagged or could not be loaded.
+func (s *BadgerStore) storedUser(session *sessions.Session) string {
+	stored := sessions.NewSession(s, session.Name())
+	stored.ID = session.ID
+	if s.load(stored) != nil {
+		return ""
+	}
+	return stored.User()
+}
+
+// userKey returns the user index key of the session with the given ID, or
+// the prefix of the index keys of the user if sessionID is empty.
+func userKey(userID, sessionID string) []byte {
+	key := userPrefix + sessions.StorageKey(userID) + "_"
+	if sessionID != "" {
+		key += sessions.StorageKey(sessionID)
+	}
+	return []byte(key)
+}
+
+// indexedKey returns the storage key of the session of a user index key.
+func indexedKey(index []byte) string {
+	return string(index[strings.LastIndexByte(string(index), '_')+1:])
+}
+
+// load reads a session from the database and decodes it into session.Values.
+func (s *BadgerStore) load(session *sessions.Session) error {
+	var encoded []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(keyPrefix + sessions.StorageKey(session.ID)))
+		if err != nil {
+			return err
+		}
+		encoded, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return sessions.ErrSessionNotFound
+		}
+		return &sessions.StorageError{Op: "load", Err: err}
+	}
+	return sessions.DecodeMulti(session.Name(), string(encoded),
+		&session.Values, s.Codecs...)
+}
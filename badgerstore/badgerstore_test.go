@@ -0,0 +1,333 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package badgerstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/go-gem/sessions"
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+)
+
+func newTestStore(t *testing.T) *BadgerStore {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return NewBadgerStore(db, []byte("some key"))
+}
+
+// request returns a request context carrying the cookies sent in res.
+func request(res *fasthttp.RequestCtx, name string) *fasthttp.RequestCtx {
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey(name)
+	ctx := &fasthttp.RequestCtx{}
+	if res.Response.Header.Cookie(cookie) {
+		ctx.Request.Header.SetCookieBytesKV(cookie.Key(), cookie.Value())
+	}
+	return ctx
+}
+
+func TestBadgerStore(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	ctx = request(ctx, "hello")
+	if session, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["name"] != "gopher" {
+		t.Fatalf("bad session: got %v, want name %q", session.Values, "gopher")
+	}
+
+	session.Options.MaxAge = -1
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, err = store.New(ctx, "hello"); !errors.Is(err, sessions.ErrSessionNotFound) {
+		t.Fatalf("bad error: got %v, want %v", err, sessions.ErrSessionNotFound)
+	}
+}
+
+func TestBadgerStoreTampered(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// A session ID signed with another key.
+	forged, err := securecookie.EncodeMulti("hello", session.ID, securecookie.New([]byte("other key"), nil))
+	if err != nil {
+		t.Fatal("failed to encode cookie", err)
+	}
+	req := &fasthttp.RequestCtx{}
+	req.Request.Header.SetCookie("hello", forged)
+	if tampered, err := store.New(req, "hello"); !errors.Is(err, sessions.ErrSignatureInvalid) {
+		t.Fatalf("bad error: got %v, want %v", err, sessions.ErrSignatureInvalid)
+	} else if !tampered.IsNew {
+		t.Fatal("bad session: got a loaded session, want a new one")
+	}
+
+	// Stored values signed with another key.
+	encoded, err := securecookie.EncodeMulti("hello", map[interface{}]interface{}{"name": "gopher"},
+		securecookie.New([]byte("other key"), nil))
+	if err != nil {
+		t.Fatal("failed to encode values", err)
+	}
+	err = store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(keyPrefix+sessions.StorageKey(session.ID)), []byte(encoded))
+	})
+	if err != nil {
+		t.Fatal("failed to write session", err)
+	}
+	if _, err = store.New(request(ctx, "hello"), "hello"); !errors.Is(err, sessions.ErrSignatureInvalid) {
+		t.Fatalf("bad error: got %v, want %v", err, sessions.ErrSignatureInvalid)
+	}
+}
+
+func TestBadgerStoreDeleteByUser(t *testing.T) {
+	store := newTestStore(t)
+	var other *fasthttp.RequestCtx
+	for _, userID := range []string{"gopher", "gopher", "someone else"} {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.SetUser(userID)
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		other = request(ctx, "hello")
+	}
+
+	if n, err := store.CountByUser("gopher"); err != nil || n != 2 {
+		t.Fatalf("bad count: got (%d, %v), want (2, nil)", n, err)
+	}
+	n, err := store.DeleteByUser("gopher")
+	if err != nil {
+		t.Fatal("failed to delete sessions", err)
+	}
+	if n != 2 {
+		t.Fatalf("bad deleted count: got %d, want %d", n, 2)
+	}
+	if n, err = store.DeleteByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad second deletion: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.CountByUser("someone else"); err != nil || n != 1 {
+		t.Fatalf("bad count: got (%d, %v), want (1, nil)", n, err)
+	}
+	if _, err = store.New(other, "hello"); err != nil {
+		t.Fatal("failed to load the session of another user", err)
+	}
+}
+
+func TestBadgerStoreSetUserChange(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.SetUser("gopher")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// The session moves to another user: it leaves the index of the first.
+	ctx = request(ctx, "hello")
+	if session, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	session.SetUser("someone else")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if n, err := store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count of the previous user: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err := store.CountByUser("someone else"); err != nil || n != 1 {
+		t.Fatalf("bad count: got (%d, %v), want (1, nil)", n, err)
+	}
+	if n, err := store.DeleteByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad delete of the previous user: got (%d, %v), want (0, nil)", n, err)
+	}
+	if _, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load the session of the new user", err)
+	}
+}
+
+func TestBadgerStoreDeleteWhere(t *testing.T) {
+	store := newTestStore(t)
+	users := []string{"gopher", "gopher", "someone else"}
+	requests := make([]*fasthttp.RequestCtx, len(users))
+	for i, userID := range users {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["userID"] = userID
+		if i == 0 {
+			session.SetUser(userID)
+		}
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		requests[i] = request(ctx, "hello")
+	}
+
+	n, err := store.DeleteWhere("hello", func(session *sessions.Session) bool {
+		return session.Values["userID"] == "gopher"
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("bad deleted count: got (%d, %v), want (2, nil)", n, err)
+	}
+	for i, ctx := range requests {
+		_, err = store.New(ctx, "hello")
+		if users[i] == "gopher" && !errors.Is(err, sessions.ErrSessionNotFound) {
+			t.Errorf("bad error loading deleted session: got %v, want %v", err, sessions.ErrSessionNotFound)
+		} else if users[i] != "gopher" && err != nil {
+			t.Errorf("failed to load session: %v", err)
+		}
+	}
+	if n, err = store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count after delete: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.DeleteWhere("other", func(*sessions.Session) bool { return true }); err != nil || n != 0 {
+		t.Fatalf("bad delete of another name: got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestBadgerStoreDeleteWhereLarge(t *testing.T) {
+	// A small memtable makes the transactions too big after a few thousand
+	// writes.
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil).
+		WithMemTableSize(1 << 20).WithValueThreshold(1 << 10))
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	store := NewBadgerStore(db, []byte("some key"))
+	const count = 5000
+	for i := 0; i < count; i++ {
+		session := sessions.NewSession(store, "hello")
+		session.ID = fmt.Sprintf("session-%d", i)
+		session.Options = &sessions.Options{MaxAge: 3600}
+		session.SetUser("gopher")
+		if err = store.save(session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+	}
+
+	n, err := store.DeleteWhere("hello", func(*sessions.Session) bool { return true })
+	if err != nil || n != count {
+		t.Fatalf("bad deleted count: got (%d, %v), want (%d, nil)", n, err, count)
+	}
+	if n, err = store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count after delete: got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestBadgerStoreTTL(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Options.MaxAge = 3600
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	var expires uint64
+	err = store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(keyPrefix + sessions.StorageKey(session.ID)))
+		if err == nil {
+			expires = item.ExpiresAt()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal("failed to read session", err)
+	}
+	want := time.Now().Add(time.Hour).Unix()
+	if d := int64(expires) - want; d < -5 || d > 5 {
+		t.Fatalf("bad expiration time: got %d, want about %d", expires, want)
+	}
+}
+
+func TestBadgerStoreList(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	key := sessions.StorageKey(session.ID)
+	keys, err := store.List(key[:4])
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("bad listed sessions: got %v, want [%s]", keys, key)
+	}
+	if keys, err = store.List("x"); err != nil || len(keys) != 0 {
+		t.Fatalf("bad listed sessions for prefix: got (%v, %v)", keys, err)
+	}
+}
+
+func TestBadgerStoreValidate(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Validate(); err != nil {
+		t.Fatal("failed to validate store", err)
+	}
+	err := store.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("probe_" + sessions.StorageKey("probe")))
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		t.Fatalf("expected the probe to be removed, got %v", err)
+	}
+}
+
+func TestBadgerStorePing(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Ping(context.Background()); err != nil {
+		t.Fatal("failed to ping store", err)
+	}
+	store.Close()
+	if err := store.Ping(context.Background()); !errors.Is(err, sessions.ErrStorageUnavailable) {
+		t.Fatalf("bad error for a closed store: got %v, want %v", err, sessions.ErrStorageUnavailable)
+	}
+}
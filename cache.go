@@ -0,0 +1,214 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// NewCachingStore returns a new CachingStore in front of store, keeping at
+// most size sessions for at most ttl.
+func NewCachingStore(store Store, size int, ttl time.Duration) *CachingStore {
+	return &CachingStore{
+		store:   store,
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// CachingStore is a Store wrapper that keeps a bounded LRU cache of recently
+// loaded sessions, to avoid hitting a slow store on bursts of requests from
+// the same client. Misses are delegated to the underlying store.
+//
+// Sessions are cached by the signed value of their cookie, which changes on
+// every Save: saving a session through the CachingStore evicts the previous
+// value and caches the saved session under the new one.
+//
+// The cache is local to the process, so a session modified or deleted by
+// another process, or directly in the underlying store, may still be served
+// from the cache until its TTL expires. Keep the TTL short, and don't use it
+// when such staleness is not acceptable.
+type CachingStore struct {
+	store   Store
+	size    int
+	ttl     time.Duration
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+// cacheEntry stores a session cached by CachingStore.
+type cacheEntry struct {
+	key     string
+	session *Session
+	expires time.Time
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *CachingStore) Get(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	return GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry,
+// from the cache if possible or else from the underlying store.
+//
+// The binding of the session to the client, see CookieStore.BindTo, is
+// checked on cache hits too when the underlying store is a CookieStore or a
+// FilesystemStore: sessions sent by another client are loaded from the
+// underlying store, which rejects them. Don't cache other stores binding
+// their sessions.
+//
+// See CookieStore.New().
+func (s *CachingStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	c := ctx.Request.Header.Cookie(namePrefix(s.store) + name)
+	if len(c) > 0 {
+		session := s.load(cacheKey(name, string(c)))
+		bind, prefix := storeBinding(s.store)
+		if session != nil && checkBinding(ctx, session, bind, prefix) == nil {
+			session.store = s
+			return session, nil
+		}
+	}
+	session, err := s.store.New(ctx, name)
+	if err == nil && !session.IsNew && len(c) > 0 {
+		s.add(cacheKey(name, string(c)), session)
+	}
+	if session != nil {
+		session.store = s
+	}
+	return session, err
+}
+
+// Save saves the session in the underlying store and updates the cache.
+func (s *CachingStore) Save(ctx *fasthttp.RequestCtx, session *Session) error {
+	cookieName := namePrefix(s.store) + session.Name()
+	if c := ctx.Request.Header.Cookie(cookieName); len(c) > 0 {
+		s.remove(cacheKey(session.Name(), string(c)))
+	}
+	if err := s.store.Save(ctx, session); err != nil {
+		return err
+	}
+	if session.Options != nil && session.Options.MaxAge <= 0 {
+		return nil
+	}
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey(cookieName)
+	if ctx.Response.Header.Cookie(cookie) && len(cookie.Value()) > 0 {
+		s.add(cacheKey(session.Name(), string(cookie.Value())), session)
+	}
+	return nil
+}
+
+// Len returns the number of sessions in the cache, including expired ones
+// not evicted yet.
+func (s *CachingStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// Purge removes all the sessions from the cache.
+func (s *CachingStore) Purge() {
+	s.mu.Lock()
+	s.lru.Init()
+	s.entries = make(map[string]*list.Element)
+	s.mu.Unlock()
+}
+
+// Close purges the cache and closes the underlying store if it implements
+// Closer.
+func (s *CachingStore) Close() error {
+	s.Purge()
+	if c, ok := s.store.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// load returns a copy of the cached session for key, or nil.
+func (s *CachingStore) load(key string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		s.lru.Remove(e)
+		delete(s.entries, key)
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	return copySession(entry.session)
+}
+
+// add caches a copy of session for key, evicting the least recently used
+// session if the cache is full.
+func (s *CachingStore) add(key string, session *Session) {
+	if s.size <= 0 {
+		return
+	}
+	entry := &cacheEntry{
+		key:     key,
+		session: copySession(session),
+		expires: time.Now().Add(s.ttl),
+	}
+	// Cached sessions exist in the underlying store.
+	entry.session.IsNew = false
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		e.Value = entry
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.size {
+		e := s.lru.Back()
+		s.lru.Remove(e)
+		delete(s.entries, e.Value.(*cacheEntry).key)
+	}
+}
+
+// remove evicts the cached session for key, if any.
+func (s *CachingStore) remove(key string) {
+	s.mu.Lock()
+	if e, ok := s.entries[key]; ok {
+		s.lru.Remove(e)
+		delete(s.entries, key)
+	}
+	s.mu.Unlock()
+}
+
+// cacheKey returns the cache key of a session cookie.
+func cacheKey(name, value string) string {
+	return name + "=" + value
+}
+
+// copySession returns a copy of session, so cached sessions are not shared
+// between requests. Values are copied shallowly.
+func copySession(session *Session) *Session {
+	c := *session
+	c.typed = nil
+	c.Values = make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		c.Values[k] = v
+	}
+	if session.Options != nil {
+		opts := *session.Options
+		c.Options = &opts
+	}
+	return &c
+}
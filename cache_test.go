@@ -0,0 +1,209 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// countingStore counts the sessions loaded by a store.
+type countingStore struct {
+	Store
+	mu    sync.Mutex
+	loads int
+}
+
+func (s *countingStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	s.mu.Lock()
+	s.loads++
+	s.mu.Unlock()
+	return s.Store.New(ctx, name)
+}
+
+// newCachedSession saves a new session through store and returns a request
+// carrying its cookie.
+func newCachedSession(t *testing.T, store Store, value string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.Values["name"] = value
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	return requestWithCookie(ctx, "session-key")
+}
+
+func TestCachingStore(t *testing.T) {
+	counting := &countingStore{Store: NewCookieStore([]byte("secret-key"))}
+	store := NewCachingStore(counting, 10, time.Minute)
+
+	ctx := newCachedSession(t, store, "gopher")
+	loads := counting.loads
+	for i := 0; i < 3; i++ {
+		session, err := store.New(ctx, "session-key")
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		if session.IsNew || session.Values["name"] != "gopher" {
+			t.Fatalf("Expected name gopher; Got %v", session.Values)
+		}
+		if session.Store() != store {
+			t.Fatal("Expected the session to be bound to the caching store")
+		}
+		// Changes are not visible until saved.
+		session.Values["name"] = "changed"
+	}
+	if counting.loads != loads {
+		t.Fatalf("Expected sessions from the cache; Got %d loads", counting.loads-loads)
+	}
+
+	// Saving evicts the previous cookie and caches the new one.
+	session, _ := store.New(ctx, "session-key")
+	session.Values["name"] = "saved"
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if store.Len() != 1 {
+		t.Fatalf("Expected 1 cached session; Got %d", store.Len())
+	}
+	session, _ = store.New(requestWithCookie(ctx, "session-key"), "session-key")
+	if session.Values["name"] != "saved" {
+		t.Errorf("Expected name saved; Got %v", session.Values["name"])
+	}
+	if counting.loads != loads {
+		t.Fatalf("Expected sessions from the cache; Got %d loads", counting.loads-loads)
+	}
+
+	// A miss is delegated and cached.
+	store.Purge()
+	store.New(ctx, "session-key")
+	store.New(ctx, "session-key")
+	if counting.loads != loads+1 {
+		t.Fatalf("Expected 1 load; Got %d", counting.loads-loads)
+	}
+}
+
+func TestCachingStoreBinding(t *testing.T) {
+	cookies := NewCookieStore([]byte("secret-key"))
+	cookies.BindTo = BindUserAgent
+	store := NewCachingStore(cookies, 10, time.Minute)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetUserAgent("browser")
+	session, _ := store.New(ctx, "session-key")
+	session.Values["name"] = "gopher"
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if store.Len() != 1 {
+		t.Fatalf("Expected 1 cached session; Got %d", store.Len())
+	}
+
+	req := requestWithCookie(ctx, "session-key")
+	req.Request.Header.SetUserAgent("browser")
+	if session, err := store.New(req, "session-key"); err != nil || session.Values["name"] != "gopher" {
+		t.Fatalf("Expected name gopher; Got %v, %v", session.Values, err)
+	}
+
+	// A stolen cookie replayed by another client is not served from the
+	// cache.
+	req = requestWithCookie(ctx, "session-key")
+	req.Request.Header.SetUserAgent("curl")
+	session, err := store.New(req, "session-key")
+	if err != ErrBindingMismatch {
+		t.Fatalf("Expected %v; Got %v", ErrBindingMismatch, err)
+	}
+	if len(session.Values) != 0 {
+		t.Fatalf("Expected an empty session; Got %v", session.Values)
+	}
+}
+
+func TestCachingStoreEviction(t *testing.T) {
+	counting := &countingStore{Store: NewCookieStore([]byte("secret-key"))}
+	store := NewCachingStore(counting, 2, time.Minute)
+
+	first := newCachedSession(t, store, "first")
+	newCachedSession(t, store, "second")
+	newCachedSession(t, store, "third")
+	if store.Len() != 2 {
+		t.Fatalf("Expected 2 cached sessions; Got %d", store.Len())
+	}
+
+	loads := counting.loads
+	session, err := store.New(first, "session-key")
+	if err != nil || session.Values["name"] != "first" {
+		t.Fatalf("Expected name first; Got %v, %v", session.Values, err)
+	}
+	if counting.loads != loads+1 {
+		t.Fatal("Expected the least recently used session to be evicted")
+	}
+
+	// Expired sessions are loaded again.
+	store = NewCachingStore(counting, 2, -time.Second)
+	ctx := newCachedSession(t, store, "expired")
+	loads = counting.loads
+	store.New(ctx, "session-key")
+	if counting.loads != loads+1 {
+		t.Fatal("Expected the expired session to be loaded again")
+	}
+}
+
+func TestCachingStoreConcurrency(t *testing.T) {
+	store := NewCachingStore(NewCookieStore([]byte("secret-key")), 4, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := newCachedSession(t, store, "gopher")
+			for j := 0; j < 16; j++ {
+				session, err := store.New(ctx, "session-key")
+				if err != nil {
+					t.Errorf("Error getting session: %v", err)
+					return
+				}
+				session.Values["name"] = j
+			}
+		}()
+	}
+	wg.Wait()
+	if store.Len() > 4 {
+		t.Fatalf("Expected at most 4 cached sessions; Got %d", store.Len())
+	}
+}
+
+// closingStore records whether it was closed.
+type closingStore struct {
+	Store
+	closed bool
+}
+
+func (s *closingStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestCachingStoreClose(t *testing.T) {
+	inner := &closingStore{Store: NewCookieStore([]byte("secret-key"))}
+	store := NewCachingStore(inner, 10, time.Minute)
+	newCachedSession(t, store, "gopher")
+
+	var closer Closer = store
+	if err := closer.Close(); err != nil {
+		t.Fatalf("Error closing store: %v", err)
+	}
+	if !inner.closed {
+		t.Fatal("Expected the underlying store to be closed")
+	}
+	if store.Len() != 0 {
+		t.Fatalf("Expected an empty cache; Got %d sessions", store.Len())
+	}
+}
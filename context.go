@@ -5,6 +5,8 @@
 package sessions
 
 import (
+	"fmt"
+	"log"
 	"sync"
 	"time"
 
@@ -67,9 +69,76 @@ func clear(ctx *fasthttp.RequestCtx) {
 
 // ClearHandler wraps a fasthttp.RequestHandler and clears request values at the end
 // of a request lifetime.
+//
+// Values are cleared even if the handler panics, so the registry of the
+// request is not reused with its sessions by another request. The panic is
+// propagated once the values are cleared.
 func ClearHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		defer Clear(ctx)
 		h(ctx)
 	}
 }
+
+// AutoSaveHandler wraps a fasthttp.RequestHandler and saves all the sessions
+// used during the request after it returns, so handlers can modify sessions
+// without saving them. Errors are logged. Sessions are not saved if the
+// handler panics. Use SkipAutoSave in handlers saving sessions themselves.
+//
+// fasthttp sends the response once the handler returns, so the cookies are
+// still sent when saved afterwards, except for hijacked connections (see
+// fasthttp.RequestCtx.Hijack) where the response is not sent by fasthttp.
+// Wrap it with ClearHandler so that the sessions are saved before being
+// cleared:
+//
+//	sessions.ClearHandler(sessions.AutoSaveHandler(handler))
+func AutoSaveHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		h(ctx)
+		registry, ok := GetOk(ctx)
+		if !ok || registry.skipAutoSave {
+			return
+		}
+		if err := registry.Save(); err != nil {
+			log.Printf("sessions: error saving sessions: %v", err)
+		}
+	}
+}
+
+// SkipAutoSave disables AutoSaveHandler for the current request.
+func SkipAutoSave(ctx *fasthttp.RequestCtx) {
+	GetRegistry(ctx).skipAutoSave = true
+}
+
+// userValueKey is the type of the keys of the sessions loaded by LoadHandler
+// in the user values of the request.
+type userValueKey string
+
+// LoadHandler wraps a fasthttp.RequestHandler and loads the sessions with the
+// given names from store before calling it, so handlers can get them with
+// SessionFromCtx without access to the store. The sessions are registered as
+// with Store.Get, and saved by Save or AutoSaveHandler.
+//
+// The sessions are kept in the user values of the request, see
+// fasthttp.RequestCtx.UserValue.
+func LoadHandler(h fasthttp.RequestHandler, store Store, names ...string) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		for _, name := range names {
+			session, err := store.Get(ctx, name)
+			ctx.SetUserValue(userValueKey(name), sessionInfo{s: session, e: err})
+		}
+		h(ctx)
+	}
+}
+
+// SessionFromCtx returns the session for the given name loaded by
+// LoadHandler, with the error returned when it was loaded.
+//
+// It returns an error if LoadHandler didn't load a session for the name.
+func SessionFromCtx(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	info, ok := ctx.UserValue(userValueKey(name)).(sessionInfo)
+	if !ok {
+		return nil, fmt.Errorf("sessions: session %q not loaded by LoadHandler", name)
+	}
+	return info.s, info.e
+}
@@ -71,6 +71,110 @@ func TestContext(t *testing.T) {
 	}
 }
 
+func TestClearHandlerPanic(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	var registry *Registry
+	h := ClearHandler(func(ctx *fasthttp.RequestCtx) {
+		registry = GetRegistry(ctx)
+		registry.Get(NewCookieStore([]byte("secret-key")), "session-key")
+		panic("handler panic")
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != "handler panic" {
+				t.Fatalf("Expected the panic to be propagated; Got %v", r)
+			}
+		}()
+		h(ctx)
+	}()
+	if _, ok := GetOk(ctx); ok {
+		t.Fatal("Expected the request values to be cleared")
+	}
+	if registry.ctx != nil || registry.sessions != nil {
+		t.Fatal("Expected the registry to be cleaned up")
+	}
+
+	// Handlers not using sessions.
+	ClearHandler(func(ctx *fasthttp.RequestCtx) {})(ctx)
+}
+
+func TestRegistryCallbacks(t *testing.T) {
+	defer func() {
+		OnRegistryOpen, OnRegistryClose = nil, nil
+	}()
+	open := make(map[*fasthttp.RequestCtx]bool)
+	OnRegistryOpen = func(ctx *fasthttp.RequestCtx) {
+		open[ctx] = true
+	}
+	OnRegistryClose = func(ctx *fasthttp.RequestCtx) {
+		if !open[ctx] {
+			t.Errorf("Unexpected close of %p", ctx)
+		}
+		delete(open, ctx)
+	}
+
+	store := NewCookieStore([]byte("secret-key"))
+	h := ClearHandler(func(ctx *fasthttp.RequestCtx) {
+		store.Get(ctx, "session-one")
+		store.Get(ctx, "session-two")
+		if len(open) != 1 {
+			t.Errorf("Expected a single open registry; Got %d", len(open))
+		}
+	})
+	h(&fasthttp.RequestCtx{})
+	if len(open) != 0 {
+		t.Fatalf("Expected every registry to be closed; Got %d open", len(open))
+	}
+}
+
+func TestAutoSaveHandler(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	h := ClearHandler(AutoSaveHandler(func(ctx *fasthttp.RequestCtx) {
+		session, _ := store.Get(ctx, "session-key")
+		session.Values["name"] = "gopher"
+		if ctx.QueryArgs().Has("skip") {
+			SkipAutoSave(ctx)
+		}
+	}))
+
+	ctx := &fasthttp.RequestCtx{}
+	h(ctx)
+	if c := ctx.Response.Header.PeekCookie("session-key"); len(c) == 0 {
+		t.Fatal("Expected the session to be saved")
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/?skip")
+	h(ctx)
+	if c := ctx.Response.Header.PeekCookie("session-key"); len(c) > 0 {
+		t.Fatal("Expected the session not to be saved")
+	}
+
+	// Handlers not using sessions.
+	ClearHandler(AutoSaveHandler(func(ctx *fasthttp.RequestCtx) {}))(ctx)
+}
+
+func TestLoadHandler(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	h := ClearHandler(AutoSaveHandler(LoadHandler(func(ctx *fasthttp.RequestCtx) {
+		session, err := SessionFromCtx(ctx, "session-key")
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		session.Values["name"] = "gopher"
+		if _, err = SessionFromCtx(ctx, "other"); err == nil {
+			t.Error("Expected an error for a session not loaded")
+		}
+	}, store, "session-key")))
+
+	ctx := &fasthttp.RequestCtx{}
+	h(ctx)
+	if c := ctx.Response.Header.PeekCookie("session-key"); len(c) == 0 {
+		t.Fatal("Expected the session to be saved")
+	}
+}
+
 func parallelReader(ctx *fasthttp.RequestCtx, iterations int, wait, done chan struct{}) {
 	<-wait
 	for i := 0; i < iterations; i++ {
@@ -0,0 +1,136 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+)
+
+// NewDerivedCookieStore returns a new CookieStore encoding the sessions of
+// each name with their own keys, derived from keyPairs, see DerivedCodec.
+//
+// See NewCookieStore() for a description of the key pairs. It panics if the
+// key pairs are rejected by NewDerivedCodecs.
+func NewDerivedCookieStore(keyPairs ...[]byte) *CookieStore {
+	cs := &CookieStore{
+		Codecs: NewDerivedCodecs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+
+	cs.MaxAge(cs.Options.MaxAge)
+	return cs
+}
+
+// NewDerivedCodecs returns a DerivedCodec for each pair of master keys, in
+// the same order as securecookie.CodecsFromPairs. It panics if there are no
+// key pairs, if a key pair is malformed, see CheckKeyPairs, or if a master
+// authentication key is shorter than MinKeyLength.
+func NewDerivedCodecs(keyPairs ...[]byte) []securecookie.Codec {
+	if len(keyPairs) == 0 {
+		panic("sessions: no key pairs")
+	}
+	if err := CheckKeyPairs(keyPairs...); err != nil {
+		panic(err)
+	}
+	for i := 0; i < len(keyPairs); i += 2 {
+		if err := checkKey(keyPairs[i]); err != nil {
+			panic(fmt.Sprintf("sessions: key pair %d: authentication %v", i/2, err))
+		}
+	}
+	codecs := make([]securecookie.Codec, 0, (len(keyPairs)+1)/2)
+	for i := 0; i < len(keyPairs); i += 2 {
+		c := &DerivedCodec{
+			hashKey: keyPairs[i],
+			maxAge:  86400 * 30,
+			codecs:  make(map[string]*securecookie.SecureCookie),
+		}
+		if i+1 < len(keyPairs) {
+			c.blockKey = keyPairs[i+1]
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs
+}
+
+// DerivedCodec is a securecookie.Codec encoding the values of each name with
+// a securecookie codec of its own, whose keys are derived from the master
+// keys and the name with HKDF-SHA256, as defense in depth between the
+// sessions of an application: a key leaked for one session name, e.g. by a
+// component handling only that session, doesn't allow to forge or decrypt
+// the others. Encryption keys keep the length of the master encryption key.
+//
+// The derived codecs are created on first use of each name and kept for the
+// life of the codec, with GobSerializer and the default max length of
+// securecookie.
+type DerivedCodec struct {
+	hashKey  []byte
+	blockKey []byte
+	mu       sync.Mutex
+	maxAge   int
+	codecs   map[string]*securecookie.SecureCookie
+}
+
+// Encode encodes value for the given name with the keys derived for name.
+func (c *DerivedCodec) Encode(name string, value interface{}) (string, error) {
+	sc, err := c.codec(name)
+	if err != nil {
+		return "", err
+	}
+	return sc.Encode(name, value)
+}
+
+// Decode decodes a value for the given name into dst with the keys derived
+// for name.
+func (c *DerivedCodec) Decode(name, value string, dst interface{}) error {
+	sc, err := c.codec(name)
+	if err != nil {
+		return err
+	}
+	return sc.Decode(name, value, dst)
+}
+
+// MaxAge sets the maximum age of the encoded values, for all names.
+func (c *DerivedCodec) MaxAge(age int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxAge = age
+	for _, sc := range c.codecs {
+		sc.MaxAge(age)
+	}
+}
+
+// codec returns the securecookie codec for name, deriving its keys on first
+// use.
+func (c *DerivedCodec) codec(name string) (*securecookie.SecureCookie, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sc, ok := c.codecs[name]; ok {
+		return sc, nil
+	}
+	hashKey, err := hkdf.Key(sha256.New, c.hashKey, nil, "sessions hash key "+name, 32)
+	if err != nil {
+		return nil, err
+	}
+	var blockKey []byte
+	if len(c.blockKey) > 0 {
+		blockKey, err = hkdf.Key(sha256.New, c.blockKey, nil, "sessions block key "+name, len(c.blockKey))
+		if err != nil {
+			return nil, err
+		}
+	}
+	sc := securecookie.New(hashKey, blockKey)
+	sc.SetSerializer(GobSerializer{})
+	sc.MaxAge(c.maxAge)
+	c.codecs[name] = sc
+	return sc, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+)
+
+func TestDerivedCookieStore(t *testing.T) {
+	hashKey, blockKey := []byte("secret-key-0123456"), []byte("0123456789abcdef")
+	store := NewDerivedCookieStore(hashKey, blockKey)
+	values := map[interface{}]interface{}{"name": "gopher"}
+	encoded, err := EncodeSession(store, "a", values)
+	if err != nil {
+		t.Fatalf("Error encoding session: %v", err)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("a", encoded)
+	session, err := store.New(ctx, "a")
+	if err != nil || session.IsNew || session.Values["name"] != "gopher" {
+		t.Fatalf("Expected the session to be decoded; Got %v, %v", session.Values, err)
+	}
+	ctx.Request.Header.SetCookie("b", encoded)
+	if _, err = store.New(ctx, "b"); err == nil {
+		t.Fatal("Expected an error decoding a cookie of a as b")
+	}
+
+	// The keys derived for each name differ from each other and from the
+	// master keys.
+	codec := store.Codecs[0].(*DerivedCodec)
+	other, _ := codec.codec("b")
+	var decoded map[interface{}]interface{}
+	if other.Decode("a", encoded, &decoded) == nil {
+		t.Fatal("Expected the keys derived for b to fail decoding a cookie of a")
+	}
+	if securecookie.New(hashKey, blockKey).Decode("a", encoded, &decoded) == nil {
+		t.Fatal("Expected the master keys to fail decoding a cookie of a")
+	}
+
+	store.MaxAge(60)
+	if sc, _ := codec.codec("a"); sc.Decode("a", encoded, &decoded) != nil {
+		t.Fatal("Expected the derived codec to keep decoding after MaxAge")
+	}
+}
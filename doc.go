@@ -144,6 +144,12 @@ relies on us passing it a value of the desired type. In the example above we've
 it a pointer to a struct and a pointer to a custom type representing a
 map[string]interface. (We could have passed non-pointer values if we wished.) This will
 then allow us to serialise/deserialise values of those types to and from our sessions.
+sessions.RegisterTypes(&Person{}, &M{}) does the same in one call, without panicking
+for types registered twice.
+
+The package itself registers []interface{}, the type of the flashes, when the
+first session is created. Set sessions.DisableGobRegistration to true in an
+init function to take full control of the gob registrations.
 
 Note that because session values are stored in a map[string]interface{}, there's
 a need to type-assert data when retrieving it. We'll use the Person struct we registered above:
@@ -197,6 +203,15 @@ makes it easy to "rotate" secret keys and still be able to validate existing
 sessions. Note: for all pairs the encryption key is optional; set it to nil
 or omit it and and encryption won't be used.
 
+Keys rotated in pairs change together. To rotate the encryption key on its
+own schedule, e.g. more often than the authentication key, list each kind of
+keys separately, newest first; all the combinations are tested:
+
+	var store = sessions.NewRotatingCookieStore(
+		[][]byte{[]byte("authentication-key")},
+		[][]byte{[]byte("new-encryption-key"), []byte("old-encryption-key")},
+	)
+
 Multiple sessions can be used in the same request, even with different
 session backends. When this happens, calling Save() on each session
 individually would be cumbersome, so we have a way to save all sessions
@@ -217,5 +232,39 @@ at once: it's sessions.Save(). Here's an example:
 
 This is possible because when we call Get() from a session store, it adds the
 session to a common registry. Save() uses it to save all registered sessions.
+The registry holds one session per name for the request, so use a single
+store for each name: Get() with the same name and another store returns the
+registered session along with ErrStoreMismatch. Share the store between
+middlewares and handlers rather than constructing one in each.
+
+Server-side stores can invalidate all the sessions of a user at once, which is
+useful to "log out everywhere" after a password change. Tag the session with
+the user ID when the user logs in, and delete by user when needed:
+
+	var store = sessions.NewFilesystemStore("", []byte("something-very-secret"))
+
+	func LoginHandler(ctx *fasthttp.RequestCtx) {
+		session, _ := store.Get(ctx, "session-name")
+		// Authenticate the user, then tag the session.
+		session.SetUser(userID)
+		session.Save(ctx)
+	}
+
+	func ChangePasswordHandler(ctx *fasthttp.RequestCtx) {
+		// Update the password, then remove all the sessions of the user.
+		if _, err := store.DeleteByUser(userID); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+	}
+
+CountByUser returns the number of sessions of a user, e.g. to limit the number
+of concurrent sessions at login. FilesystemStore and the stores of the
+pgxstore, levelstore, badgerstore and etcdstore packages implement both, as
+well as DeleteWhere, which decodes every stored session to remove the ones
+matching a predicate, e.g. for a data subject erasure request; it is meant for
+admin tasks, not for the request hot path. CookieStore cannot remove or count
+sessions stored in the clients, so its DeleteByUser, CountByUser and
+DeleteWhere always return an error.
 */
 package sessions
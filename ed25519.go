@@ -0,0 +1,148 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// NewCookieStoreEd25519 returns a new CookieStore signing sessions with the
+// Ed25519 private key priv, and verifying them with its public key pub, so
+// that the services only holding pub can verify the sessions minted by this
+// one without being able to forge them, see NewVerifyCookieStoreEd25519.
+//
+// The sessions are signed, not encrypted: the values can be read by anyone
+// holding the cookie.
+func NewCookieStoreEd25519(priv ed25519.PrivateKey, pub ed25519.PublicKey) *CookieStore {
+	return newEd25519CookieStore(NewEd25519Codec(priv, pub))
+}
+
+// NewVerifyCookieStoreEd25519 returns a new CookieStore verifying sessions
+// signed with the private key of any of the Ed25519 public keys, e.g. the
+// current key and the previous one during a key rotation.
+//
+// The store can't sign sessions: Save always returns an error.
+func NewVerifyCookieStoreEd25519(pubs ...ed25519.PublicKey) *CookieStore {
+	codecs := make([]securecookie.Codec, len(pubs))
+	for i, pub := range pubs {
+		codecs[i] = NewEd25519Codec(nil, pub)
+	}
+	return newEd25519CookieStore(codecs...)
+}
+
+// newEd25519CookieStore returns a new CookieStore using codecs.
+func newEd25519CookieStore(codecs ...securecookie.Codec) *CookieStore {
+	cs := &CookieStore{
+		Codecs: codecs,
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+
+	cs.MaxAge(cs.Options.MaxAge)
+	return cs
+}
+
+// NewEd25519Codec returns a new Ed25519Codec signing values with priv and
+// verifying them with pub. A nil priv gives a verify-only codec.
+//
+// It panics if a key has not the Ed25519 length, rather than letting
+// crypto/ed25519 panic on the first request.
+func NewEd25519Codec(priv ed25519.PrivateKey, pub ed25519.PublicKey) *Ed25519Codec {
+	if priv != nil && len(priv) != ed25519.PrivateKeySize {
+		panic(fmt.Sprintf("sessions: Ed25519 private key is %d bytes, want %d", len(priv), ed25519.PrivateKeySize))
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		panic(fmt.Sprintf("sessions: Ed25519 public key is %d bytes, want %d", len(pub), ed25519.PublicKeySize))
+	}
+	return &Ed25519Codec{
+		Serializer: GobSerializer{},
+		ClockSkew:  5 * time.Minute,
+		priv:       priv,
+		pub:        pub,
+		maxAge:     86400 * 30,
+	}
+}
+
+// Ed25519Codec is a securecookie.Codec signing serialized values with
+// Ed25519, without encrypting them. The encoded value embeds the time of
+// encoding, so values older than the max age, or from further in the future
+// than the clock skew, are rejected.
+type Ed25519Codec struct {
+	// Serializer serializes the values. It defaults to GobSerializer.
+	Serializer securecookie.Serializer
+	// ClockSkew is how far in the future the time of encoding of a value may
+	// be, for the clocks of the services signing and verifying the values
+	// are never exactly in sync. It defaults to 5 minutes.
+	ClockSkew time.Duration
+	priv      ed25519.PrivateKey
+	pub       ed25519.PublicKey
+	maxAge    int
+}
+
+var errEd25519VerifyOnly = errors.New("sessions: Ed25519Codec without private key cannot encode")
+
+// MaxAge sets the number of seconds values are valid. A value <= 0 means
+// values don't expire.
+func (c *Ed25519Codec) MaxAge(age int) {
+	c.maxAge = age
+}
+
+// Encode serializes and signs value for the given name.
+//
+// It returns an error if the codec has no private key.
+func (c *Ed25519Codec) Encode(name string, value interface{}) (string, error) {
+	if c.priv == nil {
+		return "", errEd25519VerifyOnly
+	}
+	data, err := c.Serializer.Serialize(value)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+	payload := base64.RawURLEncoding.EncodeToString(append(b, data...))
+	sig := ed25519.Sign(c.priv, []byte(name+"|"+payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Decode verifies and deserializes a value for the given name into dst.
+//
+// It returns securecookie.ErrMacInvalid if the signature is not valid.
+func (c *Ed25519Codec) Decode(name, value string, dst interface{}) error {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return errors.New("sessions: malformed signed value")
+	}
+	payload := value[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !ed25519.Verify(c.pub, []byte(name+"|"+payload), sig) {
+		return securecookie.ErrMacInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+	if len(b) < 8 {
+		return errors.New("sessions: malformed signed value")
+	}
+	ts, now := int64(binary.BigEndian.Uint64(b)), time.Now().Unix()
+	if ts > now+int64(c.ClockSkew/time.Second) {
+		return errors.New("sessions: signed value from the future")
+	}
+	if c.maxAge > 0 && now-ts > int64(c.maxAge) {
+		return errors.New("sessions: expired signed value")
+	}
+	return c.Serializer.Deserialize(b[8:], dst)
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCookieStoreEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	minter := NewCookieStoreEd25519(priv, pub)
+	verifier := NewVerifyCookieStoreEd25519(pub)
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := minter.New(ctx, "session-key")
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// Both stores verify the session.
+	for _, store := range []*CookieStore{minter, verifier} {
+		session, err = store.New(requestWithCookie(ctx, "session-key"), "session-key")
+		if err != nil || session.IsNew || session.Values["name"] != "gopher" {
+			t.Fatalf("Expected name gopher; Got %v, %v", session.Values, err)
+		}
+	}
+
+	// The verifier can't mint sessions.
+	if err = session.Save(&fasthttp.RequestCtx{}); err == nil {
+		t.Fatal("Expected an error saving with a verify-only store")
+	}
+
+	// Sessions signed with another key or tampered with are rejected.
+	otherPub, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	forged, _ := EncodeSession(NewCookieStoreEd25519(otherPriv, otherPub), "session-key",
+		map[interface{}]interface{}{"name": "mallory"})
+	value := string(requestWithCookie(ctx, "session-key").Request.Header.Cookie("session-key"))
+	i := strings.LastIndexByte(value, '.')
+	tampered := forged[:strings.LastIndexByte(forged, '.')] + value[i:]
+	for _, c := range []string{forged, tampered} {
+		req := &fasthttp.RequestCtx{}
+		req.Request.Header.SetCookie("session-key", c)
+		if _, err = verifier.New(req, "session-key"); err != ErrSignatureInvalid {
+			t.Fatalf("Expected %v; Got %v", ErrSignatureInvalid, err)
+		}
+	}
+
+	// The signature covers the session name.
+	req := &fasthttp.RequestCtx{}
+	req.Request.Header.SetCookie("other-key", value)
+	if _, err = verifier.New(req, "other-key"); err != ErrSignatureInvalid {
+		t.Fatalf("Expected %v; Got %v", ErrSignatureInvalid, err)
+	}
+}
+
+func TestEd25519CodecChecks(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	for _, keys := range []struct {
+		priv ed25519.PrivateKey
+		pub  ed25519.PublicKey
+	}{
+		{nil, pub[:5]},
+		{priv[:5], pub},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a panic for keys of %d and %d bytes", len(keys.priv), len(keys.pub))
+				}
+			}()
+			NewEd25519Codec(keys.priv, keys.pub)
+		}()
+	}
+
+	// Values signed slightly in the future are accepted, within the clock
+	// skew.
+	codec := NewEd25519Codec(priv, pub)
+	data, err := codec.Serializer.Serialize(map[interface{}]interface{}{"name": "gopher"})
+	if err != nil {
+		t.Fatalf("Error serializing values: %v", err)
+	}
+	signAt := func(at time.Time) string {
+		b := make([]byte, 8, 8+len(data))
+		binary.BigEndian.PutUint64(b, uint64(at.Unix()))
+		payload := base64.RawURLEncoding.EncodeToString(append(b, data...))
+		sig := ed25519.Sign(priv, []byte("session-key|"+payload))
+		return payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	var values map[interface{}]interface{}
+	if err = codec.Decode("session-key", signAt(time.Now().Add(time.Minute)), &values); err != nil || values["name"] != "gopher" {
+		t.Fatalf("Expected a value signed a minute ahead to be accepted; Got %v, %v", values, err)
+	}
+	if err = codec.Decode("session-key", signAt(time.Now().Add(time.Hour)), &values); err == nil {
+		t.Fatal("Expected an error for a value signed in the future")
+	}
+	codec.ClockSkew = 0
+	if err = codec.Decode("session-key", signAt(time.Now().Add(time.Minute)), &values); err == nil {
+		t.Fatal("Expected an error for a value signed in the future without clock skew")
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+)
+
+// Key of the encrypted values of a session saved by EnvelopeStore.
+const envelopeKey = "_envelope"
+
+// Size of the data keys generated by EnvelopeStore.
+const dataKeySize = 32
+
+// envelopeClearKeys are the keys of the values passed in clear to the
+// underlying store beside the envelope: the user tag, so that server-side
+// stores can index it, and the bookkeeping values the stores update on Save,
+// see FilesystemStore.RotateEvery and FilesystemStore.CheckVersion.
+var envelopeClearKeys = []interface{}{userKey, rotateCountKey, rotatedAtKey, versionKey}
+
+var errEnvelopeInvalid = errors.New("sessions: envelope could not be decrypted")
+
+// NewEnvelopeStore returns a new EnvelopeStore in front of store, wrapping
+// the data keys with masterKeys.
+//
+// The first master key wraps the data keys of saved sessions, the others are
+// used to unwrap the data keys of sessions saved before a key rotation. Each
+// key must be either 16, 24, or 32 bytes to select AES-128, AES-192, or
+// AES-256.
+func NewEnvelopeStore(store Store, masterKeys ...[]byte) (*EnvelopeStore, error) {
+	if len(masterKeys) == 0 {
+		return nil, errors.New("sessions: missing master key")
+	}
+	es := &EnvelopeStore{
+		Serializer: GobSerializer{},
+		store:      store,
+	}
+	for _, key := range masterKeys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		es.masters = append(es.masters, aead)
+	}
+	return es, nil
+}
+
+// EnvelopeStore is a Store wrapper applying envelope encryption to the
+// sessions, whatever the underlying store does with them: on every Save the
+// session values are serialized and encrypted with AES-GCM using a new random
+// data key, and the data key is itself encrypted, or wrapped, with the master
+// key. The underlying store only sees the wrapped data key followed by the
+// ciphertext, stored as a single value.
+//
+// Rotating the master key only requires to wrap the data keys with the new
+// key: pass the new key first and the previous ones after it, existing
+// sessions are decrypted with the previous keys and saved with the new one
+// on their next Save.
+//
+// The user tag of the session, see Session.SetUser, is kept in clear beside
+// the envelope so that server-side stores can still index it, as are the
+// values the underlying store keeps for itself, e.g. the save count of
+// FilesystemStore.RotateEvery.
+type EnvelopeStore struct {
+	// Serializer serializes the session values before encryption. It
+	// defaults to GobSerializer.
+	Serializer securecookie.Serializer
+	store      Store
+	masters    []cipher.AEAD
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *EnvelopeStore) Get(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	return GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry,
+// loaded from the underlying store and decrypted.
+//
+// It returns a new session and an error if the envelope could not be
+// decrypted.
+//
+// See CookieStore.New().
+func (s *EnvelopeStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	session, err := s.store.New(ctx, name)
+	if session == nil {
+		return nil, err
+	}
+	session.store = s
+	if err != nil || session.IsNew {
+		return session, err
+	}
+	if data, ok := session.Values[envelopeKey].([]byte); ok {
+		values, err := s.open(name, data)
+		if err != nil {
+			session.Values = make(map[interface{}]interface{})
+			session.IsNew = true
+			return session, err
+		}
+		// Keep the values in clear over their copy in the envelope.
+		for k, v := range session.Values {
+			if k != envelopeKey {
+				values[k] = v
+			}
+		}
+		session.Values = values
+	}
+	return session, nil
+}
+
+// Save encrypts the session values and saves them in the underlying store.
+func (s *EnvelopeStore) Save(ctx *fasthttp.RequestCtx, session *Session) error {
+	if session.Options != nil && session.Options.MaxAge <= 0 {
+		return s.store.Save(ctx, session)
+	}
+	data, err := s.seal(session.Name(), session.Values)
+	if err != nil {
+		return err
+	}
+	values := session.Values
+	session.Values = map[interface{}]interface{}{envelopeKey: data}
+	for _, k := range envelopeClearKeys {
+		if v, ok := values[k]; ok {
+			session.Values[k] = v
+		}
+	}
+	err = s.store.Save(ctx, session)
+	// Copy back what the underlying store added or removed, e.g. the
+	// version of FilesystemStore.CheckVersion.
+	for _, k := range envelopeClearKeys {
+		delete(values, k)
+	}
+	for k, v := range session.Values {
+		if k != envelopeKey {
+			values[k] = v
+		}
+	}
+	session.Values = values
+	return err
+}
+
+// Close closes the underlying store if it implements Closer.
+func (s *EnvelopeStore) Close() error {
+	if c, ok := s.store.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// seal serializes and encrypts values for the session name with a new data
+// key, and returns the wrapped data key followed by the ciphertext.
+func (s *EnvelopeStore) seal(name string, values map[interface{}]interface{}) ([]byte, error) {
+	plaintext, err := s.Serializer.Serialize(values)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err = io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := sealAEAD(s.masters[0], dataKey, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := sealAEAD(aead, plaintext, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return append(wrapped, ciphertext...), nil
+}
+
+// open decrypts data, as returned by seal, for the session name.
+func (s *EnvelopeStore) open(name string, data []byte) (map[interface{}]interface{}, error) {
+	for _, master := range s.masters {
+		size := master.NonceSize() + dataKeySize + master.Overhead()
+		if len(data) < size {
+			return nil, errEnvelopeInvalid
+		}
+		dataKey, err := openAEAD(master, data[:size], []byte(name))
+		if err != nil {
+			continue
+		}
+		aead, err := newAEAD(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := openAEAD(aead, data[size:], []byte(name))
+		if err != nil {
+			return nil, errEnvelopeInvalid
+		}
+		values := make(map[interface{}]interface{})
+		if err = s.Serializer.Deserialize(plaintext, &values); err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+	return nil, errEnvelopeInvalid
+}
+
+// newAEAD returns an AES-GCM cipher for key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD encrypts plaintext with a random nonce, prepended to the result.
+func sealAEAD(aead cipher.AEAD, plaintext, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, data), nil
+}
+
+// openAEAD decrypts a ciphertext returned by sealAEAD.
+func openAEAD(aead cipher.AEAD, ciphertext, data []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errEnvelopeInvalid
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], data)
+}
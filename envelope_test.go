@@ -0,0 +1,156 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+)
+
+// innerValues returns the values of the session cookie as seen by the store
+// wrapped by an EnvelopeStore.
+func innerValues(t *testing.T, inner *CookieStore, ctx *fasthttp.RequestCtx) map[interface{}]interface{} {
+	values := make(map[interface{}]interface{})
+	c := requestWithCookie(ctx, "session-key").Request.Header.Cookie("session-key")
+	if err := securecookie.DecodeMulti("session-key", string(c), &values, inner.Codecs...); err != nil {
+		t.Fatalf("Error decoding cookie: %v", err)
+	}
+	return values
+}
+
+func TestEnvelopeStore(t *testing.T) {
+	inner := NewCookieStore([]byte("secret-key"))
+	oldMaster := []byte("0123456789abcdef")
+	store, err := NewEnvelopeStore(inner, oldMaster)
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	session.Values["name"] = "gopher"
+	session.SetUser("42")
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if session.Values["name"] != "gopher" {
+		t.Fatal("Expected the session values to be restored after Save")
+	}
+
+	// The underlying store only sees the envelope and the user tag.
+	values := innerValues(t, inner, ctx)
+	data, ok := values[envelopeKey].([]byte)
+	if !ok || len(values) != 2 || values[userKey] != "42" {
+		t.Fatalf("Unexpected values in the underlying store: %v", values)
+	}
+	if bytes.Contains(data, []byte("gopher")) {
+		t.Fatal("Expected the session values to be encrypted")
+	}
+
+	session, err = store.New(requestWithCookie(ctx, "session-key"), "session-key")
+	if err != nil || session.IsNew || session.Values["name"] != "gopher" {
+		t.Fatalf("Expected name gopher; Got %v, %v", session.Values, err)
+	}
+	if session.Store() != store {
+		t.Fatal("Expected the session to be bound to the envelope store")
+	}
+
+	// Sessions saved with the previous master key are still decrypted.
+	rotated, err := NewEnvelopeStore(inner, []byte("fedcba9876543210"), oldMaster)
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	session, err = rotated.New(requestWithCookie(ctx, "session-key"), "session-key")
+	if err != nil || session.Values["name"] != "gopher" {
+		t.Fatalf("Expected name gopher after rotation; Got %v, %v", session.Values, err)
+	}
+	if _, err = NewEnvelopeStore(inner, []byte("bad key")); err == nil {
+		t.Fatal("Expected an error for an invalid master key")
+	}
+}
+
+func TestEnvelopeStoreTamper(t *testing.T) {
+	inner := NewCookieStore([]byte("secret-key"))
+	store, _ := NewEnvelopeStore(inner, []byte("0123456789abcdef"))
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	session.Values["name"] = "gopher"
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// Flip a byte of the ciphertext and sign it again with the inner keys.
+	values := innerValues(t, inner, ctx)
+	data := values[envelopeKey].([]byte)
+	data[len(data)-1] ^= 1
+	encoded, err := securecookie.EncodeMulti("session-key", values, inner.Codecs...)
+	if err != nil {
+		t.Fatalf("Error encoding cookie: %v", err)
+	}
+	req := &fasthttp.RequestCtx{}
+	req.Request.Header.SetCookie("session-key", encoded)
+	session, err = store.New(req, "session-key")
+	if err != errEnvelopeInvalid {
+		t.Fatalf("Expected %v; Got %v", errEnvelopeInvalid, err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Fatalf("Expected a new session; Got %v", session.Values)
+	}
+
+	// Another master key can't decrypt the envelope.
+	other, _ := NewEnvelopeStore(inner, []byte("fedcba9876543210"))
+	if _, err = other.New(requestWithCookie(ctx, "session-key"), "session-key"); err != errEnvelopeInvalid {
+		t.Fatalf("Expected %v; Got %v", errEnvelopeInvalid, err)
+	}
+}
+
+func TestEnvelopeStoreFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := NewFilesystemStore(dir, []byte("some key"))
+	inner.RotateEvery = 3
+	inner.CheckVersion = true
+	store, _ := NewEnvelopeStore(inner, []byte("0123456789abcdef"))
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "hello")
+	session.Values["name"] = "gopher"
+
+	// The save count and the version of the inner store survive the
+	// envelope, so the ID rotates and the saves don't conflict.
+	var ids []string
+	for i := 0; i < 4; i++ {
+		if err = session.Save(ctx); err != nil {
+			t.Fatalf("Error saving session %d: %v", i, err)
+		}
+		ids = append(ids, session.ID)
+		ctx = requestWithCookie(ctx, "hello")
+		if session, err = store.New(ctx, "hello"); err != nil || session.Values["name"] != "gopher" {
+			t.Fatalf("Expected name gopher; Got %v, %v", session.Values, err)
+		}
+	}
+	if ids[0] != ids[2] || ids[3] == ids[2] {
+		t.Fatalf("Expected the ID to rotate on the fourth save; Got %v", ids)
+	}
+
+	// A save from a stale copy of the session conflicts.
+	stale, _ := store.New(ctx, "hello")
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if err = stale.Save(ctx); err != ErrConflict {
+		t.Fatalf("Expected %v; Got %v", ErrConflict, err)
+	}
+}
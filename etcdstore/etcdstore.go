@@ -0,0 +1,402 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package etcdstore provides an etcd session store for the sessions package,
+// for clustered deployments already relying on etcd.
+package etcdstore
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"github.com/go-gem/sessions"
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Directory of the user index keys under the prefix of the store.
+const userDir = "users/"
+
+// NewEtcdStore returns a new EtcdStore storing sessions under the given key
+// prefix.
+//
+// See sessions.NewCookieStore() for a description of the other parameters.
+func NewEtcdStore(client *clientv3.Client, prefix string, keyPairs ...[]byte) *EtcdStore {
+	codecs, err := sessions.NewCodecs(keyPairs...)
+	if err != nil {
+		panic(err)
+	}
+	es := &EtcdStore{
+		Codecs: codecs,
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		client: client,
+		prefix: prefix,
+	}
+
+	es.MaxAge(es.Options.MaxAge)
+	return es
+}
+
+// EtcdStore stores sessions in etcd.
+//
+// The cookie only holds the signed session ID, the session values are
+// encoded with the codecs and stored under the prefix followed by the storage
+// key of the ID (see sessions.StorageKey).
+// Each Save attaches the session to a new lease with a TTL of
+// Options.MaxAge and revokes the previous one, so etcd removes expired
+// sessions by itself and there is a single live lease per session. Deleting
+// a session revokes its lease.
+//
+// Sessions tagged with sessions.Session.SetUser are also indexed under the
+// prefix followed by "users/", the storage key of the user ID, "/" and the
+// storage key of the session ID, attached to the lease of the session, for
+// DeleteByUser and CountByUser.
+//
+// etcd is built for small, rarely changing, strongly consistent data: every
+// Save is a replicated write of the whole session plus a lease grant, and
+// all the revisions are kept until compaction. Keep sessions small, avoid
+// saving them on every request, and make sure the cluster is compacted and
+// defragmented regularly, or prefer a dedicated store for high traffic.
+type EtcdStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options // default configuration
+	client  *clientv3.Client
+	prefix  string
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See sessions.CookieStore.Get().
+func (s *EtcdStore) Get(ctx *fasthttp.RequestCtx, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// It returns sessions.ErrSessionNotFound if the session referenced by the
+// cookie does not exist or has expired, and sessions.ErrSignatureInvalid if
+// the cookie signature could not be verified.
+//
+// See sessions.CookieStore.New().
+func (s *EtcdStore) New(ctx *fasthttp.RequestCtx, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	var err error
+	if c := ctx.Request.Header.Cookie(name); len(c) > 0 {
+		err = sessions.DecodeMulti(name, string(c), &session.ID, s.Codecs...)
+		if err == nil {
+			err = s.load(ctx, session)
+			if err == nil {
+				session.IsNew = false
+			}
+		}
+	}
+	return session, err
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is <= 0 then the session is deleted
+// from etcd, else its TTL is refreshed.
+func (s *EtcdStore) Save(ctx *fasthttp.RequestCtx, session *sessions.Session) error {
+	if session.Options == nil {
+		// Defaults of the store at the time of Save, see
+		// sessions.Session.Options.
+		opts := *s.Options
+		session.Options = &opts
+	}
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.erase(ctx, session); err != nil {
+				return err
+			}
+		}
+		sessions.SetCookie(ctx, session.Name(), "", session.Options)
+		return nil
+	}
+
+	if session.ID == "" {
+		key := securecookie.GenerateRandomKey(32)
+		if key == nil {
+			return errors.New("etcdstore: failed to generate session id")
+		}
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(key), "=")
+	}
+	if err := s.save(ctx, session); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
+		s.Codecs...)
+	if err != nil {
+		return err
+	}
+	sessions.SetCookie(ctx, session.Name(), encoded, session.Options)
+	return nil
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *EtcdStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each securecookie instance.
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// DeleteByUser removes all the sessions tagged with the given user ID, see
+// sessions.Session.SetUser, and returns the number of sessions removed.
+func (s *EtcdStore) DeleteByUser(userID string) (int, error) {
+	ctx := context.Background()
+	resp, err := s.client.Get(ctx, s.userKey(userID, ""), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	n := 0
+	for _, kv := range resp.Kvs {
+		index := string(kv.Key)
+		key := s.prefix + index[strings.LastIndexByte(index, '/')+1:]
+		deleted, err := s.client.Delete(ctx, key)
+		if err == nil {
+			_, err = s.client.Delete(ctx, index)
+		}
+		if err == nil && kv.Lease != 0 {
+			_, err = s.client.Revoke(ctx, clientv3.LeaseID(kv.Lease))
+			if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return n, &sessions.StorageError{Op: "delete", Err: err}
+		}
+		n += int(deleted.Deleted)
+	}
+	return n, nil
+}
+
+// DeleteWhere removes the sessions saved with the given session name for
+// which pred returns true, e.g. all the sessions of a user for a data subject
+// erasure request, and returns the number of sessions removed.
+//
+// pred is given the session with its values; its ID is empty, as the store
+// only keeps a hash of it. It reads all the sessions under the prefix in a
+// single range request and decodes them: it is meant for admin tasks, not
+// for the request hot path. Use DeleteByUser for sessions tagged with
+// sessions.Session.SetUser, which only reads an index.
+//
+// See sessions.FilesystemStore.DeleteWhere().
+func (s *EtcdStore) DeleteWhere(name string, pred func(*sessions.Session) bool) (int, error) {
+	ctx := context.Background()
+	resp, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	n := 0
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if strings.HasPrefix(key, s.prefix+userDir) {
+			continue
+		}
+		session := sessions.NewSession(s, name)
+		session.IsNew = false
+		if securecookie.DecodeMulti(name, string(kv.Value), &session.Values, s.Codecs...) != nil {
+			continue
+		}
+		if !pred(session) {
+			continue
+		}
+		if kv.Lease != 0 {
+			_, err = s.client.Revoke(ctx, clientv3.LeaseID(kv.Lease))
+			if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+				err = nil
+			}
+		}
+		if err == nil {
+			_, err = s.client.Delete(ctx, key)
+		}
+		if userID := session.User(); err == nil && userID != "" {
+			_, err = s.client.Delete(ctx, s.userKey(userID, "")+strings.TrimPrefix(key, s.prefix))
+		}
+		if err != nil {
+			return n, &sessions.StorageError{Op: "delete", Err: err}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// CountByUser returns the number of sessions tagged with the given user ID,
+// see sessions.Session.SetUser, e.g. to limit the number of concurrent
+// sessions of a user at login. The user index keys expire with the sessions,
+// so it only counts them.
+func (s *EtcdStore) CountByUser(userID string) (int, error) {
+	resp, err := s.client.Get(context.Background(), s.userKey(userID, ""),
+		clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "load", Err: err}
+	}
+	return int(resp.Count), nil
+}
+
+// List returns the storage keys of the sessions starting with prefix.
+//
+// See sessions.Lister.
+func (s *EtcdStore) List(prefix string) ([]string, error) {
+	resp, err := s.client.Get(context.Background(), s.prefix+prefix,
+		clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, &sessions.StorageError{Op: "list", Err: err}
+	}
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if key := strings.TrimPrefix(string(kv.Key), s.prefix); !strings.HasPrefix(key, userDir) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Ping counts the keys equal to the prefix, a read served by the cluster
+// quorum without side effects.
+//
+// See sessions.Pinger.
+func (s *EtcdStore) Ping(ctx context.Context) error {
+	if _, err := s.client.Get(ctx, s.prefix, clientv3.WithCountOnly()); err != nil {
+		return &sessions.StorageError{Op: "ping", Err: err}
+	}
+	return nil
+}
+
+// Validate writes, reads and deletes a probe key under the prefix. Each
+// call creates new revisions in etcd.
+//
+// See sessions.Validator.
+func (s *EtcdStore) Validate() error {
+	ctx := context.Background()
+	key := s.prefix + "probe"
+	_, err := s.client.Put(ctx, key, "probe")
+	if err == nil {
+		_, err = s.client.Get(ctx, key)
+	}
+	if err == nil {
+		_, err = s.client.Delete(ctx, key)
+	}
+	if err != nil {
+		return &sessions.StorageError{Op: "validate", Err: err}
+	}
+	return nil
+}
+
+// Close closes the client given to NewEtcdStore, so don't call it if the
+// client is shared with other users.
+//
+// See sessions.Closer.
+func (s *EtcdStore) Close() error {
+	return s.client.Close()
+}
+
+// save writes encoded session.Values to etcd, with a new lease of
+// Options.MaxAge, then revokes the lease the session had before, if any.
+// The previous lease is revoked after the Put, which moved the key to the
+// new lease, so revoking it doesn't delete the session, only the user index
+// key of a previous user.
+func (s *EtcdStore) save(ctx context.Context, session *sessions.Session) error {
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
+		s.Codecs...)
+	if err != nil {
+		return err
+	}
+	key := s.prefix + sessions.StorageKey(session.ID)
+	previous, err := s.lease(ctx, key)
+	if err != nil {
+		return &sessions.StorageError{Op: "save", Err: err}
+	}
+	lease, err := s.client.Grant(ctx, int64(session.Options.MaxAge))
+	if err != nil {
+		return &sessions.StorageError{Op: "save", Err: err}
+	}
+	ops := []clientv3.Op{clientv3.OpPut(key, encoded, clientv3.WithLease(lease.ID))}
+	if userID := session.User(); userID != "" {
+		ops = append(ops, clientv3.OpPut(s.userKey(userID, session.ID), "", clientv3.WithLease(lease.ID)))
+	}
+	if _, err = s.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		s.client.Revoke(ctx, lease.ID)
+		return &sessions.StorageError{Op: "save", Err: err}
+	}
+	if previous != clientv3.NoLease {
+		if _, err = s.client.Revoke(ctx, previous); err != nil && !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return &sessions.StorageError{Op: "save", Err: err}
+		}
+	}
+	return nil
+}
+
+// erase deletes a session from etcd by revoking its lease, which deletes the
+// key and its user index key, or deleting the keys if it has no lease.
+func (s *EtcdStore) erase(ctx context.Context, session *sessions.Session) error {
+	key := s.prefix + sessions.StorageKey(session.ID)
+	lease, err := s.lease(ctx, key)
+	if err == nil && lease != clientv3.NoLease {
+		_, err = s.client.Revoke(ctx, lease)
+		if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			err = nil
+		}
+	}
+	if err == nil {
+		_, err = s.client.Delete(ctx, key)
+	}
+	if userID := session.User(); err == nil && userID != "" {
+		_, err = s.client.Delete(ctx, s.userKey(userID, session.ID))
+	}
+	if err != nil {
+		return &sessions.StorageError{Op: "delete", Err: err}
+	}
+	return nil
+}
+
+// userKey returns the user index key of the session with the given ID, or
+// the prefix of the index keys of the user if sessionID is empty.
+func (s *EtcdStore) userKey(userID, sessionID string) string {
+	key := s.prefix + userDir + sessions.StorageKey(userID) + "/"
+	if sessionID != "" {
+		key += sessions.StorageKey(sessionID)
+	}
+	return key
+}
+
+// lease returns the lease of key, or clientv3.NoLease if the key doesn't
+// exist or has no lease.
+func (s *EtcdStore) lease(ctx context.Context, key string) (clientv3.LeaseID, error) {
+	resp, err := s.client.Get(ctx, key, clientv3.WithKeysOnly())
+	if err != nil || len(resp.Kvs) == 0 {
+		return clientv3.NoLease, err
+	}
+	return clientv3.LeaseID(resp.Kvs[0].Lease), nil
+}
+
+// load reads a session from etcd and decodes it into session.Values.
+func (s *EtcdStore) load(ctx context.Context, session *sessions.Session) error {
+	resp, err := s.client.Get(ctx, s.prefix+sessions.StorageKey(session.ID))
+	if err != nil {
+		return &sessions.StorageError{Op: "load", Err: err}
+	}
+	if len(resp.Kvs) == 0 {
+		return sessions.ErrSessionNotFound
+	}
+	return sessions.DecodeMulti(session.Name(), string(resp.Kvs[0].Value),
+		&session.Values, s.Codecs...)
+}
@@ -0,0 +1,281 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package etcdstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gem/sessions"
+	"github.com/valyala/fasthttp"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// newTestStore returns a store on the etcd cluster given by the
+// ETCDSTORE_TEST_ENDPOINTS environment variable, a comma-separated list of
+// endpoints, or skips the test.
+func newTestStore(t *testing.T) *EtcdStore {
+	endpoints := os.Getenv("ETCDSTORE_TEST_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCDSTORE_TEST_ENDPOINTS is not set")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal("failed to connect", err)
+	}
+	t.Cleanup(func() {
+		client.Delete(context.Background(), "sessions_test/", clientv3.WithPrefix())
+		client.Close()
+	})
+	return NewEtcdStore(client, "sessions_test/", []byte("some key"))
+}
+
+// newRequest returns a request context usable as a context.Context, which
+// fasthttp only supports for contexts initialized as by a server.
+func newRequest() *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, nil, nil)
+	return ctx
+}
+
+// request returns a request context carrying the cookies sent in res.
+func request(res *fasthttp.RequestCtx, name string) *fasthttp.RequestCtx {
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey(name)
+	ctx := newRequest()
+	if res.Response.Header.Cookie(cookie) {
+		ctx.Request.Header.SetCookieBytesKV(cookie.Key(), cookie.Value())
+	}
+	return ctx
+}
+
+func TestEtcdStore(t *testing.T) {
+	store := newTestStore(t)
+	ctx := newRequest()
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	session.Options.MaxAge = 60
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	resp, err := store.client.Get(context.Background(), "sessions_test/"+sessions.StorageKey(session.ID))
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatalf("failed to read session: %v", err)
+	}
+	ttl, err := store.client.TimeToLive(context.Background(), clientv3.LeaseID(resp.Kvs[0].Lease))
+	if err != nil {
+		t.Fatal("failed to read lease", err)
+	}
+	if ttl.TTL <= 0 || ttl.TTL > 60 {
+		t.Fatalf("bad lease TTL: got %d, want (0, 60]", ttl.TTL)
+	}
+
+	ctx = request(ctx, "hello")
+	if session, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["name"] != "gopher" {
+		t.Fatalf("bad session: got %v, want name %q", session.Values, "gopher")
+	}
+
+	session.Options.MaxAge = -1
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, err = store.New(ctx, "hello"); !errors.Is(err, sessions.ErrSessionNotFound) {
+		t.Fatalf("bad error: got %v, want %v", err, sessions.ErrSessionNotFound)
+	}
+}
+
+func TestEtcdStoreLeases(t *testing.T) {
+	store := newTestStore(t)
+	ctx := newRequest()
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	key := "sessions_test/"
+	lease := func() clientv3.LeaseID {
+		resp, err := store.client.Get(context.Background(), key+sessions.StorageKey(session.ID))
+		if err != nil || len(resp.Kvs) != 1 {
+			t.Fatalf("failed to read session: %v", err)
+		}
+		return clientv3.LeaseID(resp.Kvs[0].Lease)
+	}
+	alive := func(id clientv3.LeaseID) bool {
+		ttl, err := store.client.TimeToLive(context.Background(), id)
+		if err != nil {
+			t.Fatal("failed to read lease", err)
+		}
+		return ttl.TTL > 0
+	}
+
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	first := lease()
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	second := lease()
+	if first == second || alive(first) || !alive(second) {
+		t.Fatalf("expected the lease %x to be replaced by %x", first, second)
+	}
+
+	session.Options.MaxAge = -1
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if alive(second) {
+		t.Fatal("expected the lease of the deleted session to be revoked")
+	}
+}
+
+func TestEtcdStoreDeleteByUser(t *testing.T) {
+	store := newTestStore(t)
+	var other *fasthttp.RequestCtx
+	for _, userID := range []string{"gopher", "gopher", "someone else"} {
+		ctx := newRequest()
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.SetUser(userID)
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		other = request(ctx, "hello")
+	}
+
+	if n, err := store.CountByUser("gopher"); err != nil || n != 2 {
+		t.Fatalf("bad count: got (%d, %v), want (2, nil)", n, err)
+	}
+	n, err := store.DeleteByUser("gopher")
+	if err != nil {
+		t.Fatal("failed to delete sessions", err)
+	}
+	if n != 2 {
+		t.Fatalf("bad deleted count: got %d, want %d", n, 2)
+	}
+	if n, err = store.DeleteByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad second deletion: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.CountByUser("someone else"); err != nil || n != 1 {
+		t.Fatalf("bad count: got (%d, %v), want (1, nil)", n, err)
+	}
+	if _, err = store.New(other, "hello"); err != nil {
+		t.Fatal("failed to load the session of another user", err)
+	}
+}
+
+func TestEtcdStoreSetUserChange(t *testing.T) {
+	store := newTestStore(t)
+	ctx := newRequest()
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.SetUser("gopher")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// The session moves to another user: it leaves the index of the first.
+	ctx = request(ctx, "hello")
+	if session, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	session.SetUser("someone else")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if n, err := store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count of the previous user: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err := store.CountByUser("someone else"); err != nil || n != 1 {
+		t.Fatalf("bad count: got (%d, %v), want (1, nil)", n, err)
+	}
+	if n, err := store.DeleteByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad delete of the previous user: got (%d, %v), want (0, nil)", n, err)
+	}
+	if _, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load the session of the new user", err)
+	}
+}
+
+func TestEtcdStoreDeleteWhere(t *testing.T) {
+	store := newTestStore(t)
+	users := []string{"gopher", "gopher", "someone else"}
+	requests := make([]*fasthttp.RequestCtx, len(users))
+	for i, userID := range users {
+		ctx := newRequest()
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["userID"] = userID
+		if i == 0 {
+			session.SetUser(userID)
+		}
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		requests[i] = request(ctx, "hello")
+	}
+
+	n, err := store.DeleteWhere("hello", func(session *sessions.Session) bool {
+		return session.Values["userID"] == "gopher"
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("bad deleted count: got (%d, %v), want (2, nil)", n, err)
+	}
+	for i, ctx := range requests {
+		_, err = store.New(ctx, "hello")
+		if users[i] == "gopher" && !errors.Is(err, sessions.ErrSessionNotFound) {
+			t.Errorf("bad error loading deleted session: got %v, want %v", err, sessions.ErrSessionNotFound)
+		} else if users[i] != "gopher" && err != nil {
+			t.Errorf("failed to load session: %v", err)
+		}
+	}
+	if n, err = store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count after delete: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.DeleteWhere("other", func(*sessions.Session) bool { return true }); err != nil || n != 0 {
+		t.Fatalf("bad delete of another name: got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestEtcdStoreList(t *testing.T) {
+	store := newTestStore(t)
+	ctx := newRequest()
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	key := sessions.StorageKey(session.ID)
+	keys, err := store.List(key[:4])
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("bad listed sessions: got %v, want [%s]", keys, key)
+	}
+}
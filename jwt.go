@@ -0,0 +1,196 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// NewJWTCookieStore returns a new CookieStore encoding sessions as JSON Web
+// Tokens signed with HS256, one JWTCodec per key, so that other services
+// can validate the session cookie with any JWT library.
+//
+// The first key signs new tokens, the others are used to validate tokens
+// signed before a key rotation. See JWTCodec for the mapping of the session
+// values to claims.
+//
+// It panics if there are no keys or a key is too short, see CheckKeys.
+func NewJWTCookieStore(keys ...[]byte) *CookieStore {
+	if err := CheckKeys(keys...); err != nil {
+		panic(err)
+	}
+	codecs := make([]securecookie.Codec, len(keys))
+	for i, key := range keys {
+		codecs[i] = NewJWTCodec(key)
+	}
+	cs := &CookieStore{
+		Codecs: codecs,
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+
+	cs.MaxAge(cs.Options.MaxAge)
+	return cs
+}
+
+// NewPublicCookieStore returns a new CookieStore for public claims: data
+// that is not sensitive, such as feature flags or A/B test buckets, that
+// client-side code needs to read.
+//
+// The cookie value is a JWT, see JWTCodec: the values are serialized as JSON
+// and base64url-encoded, then signed with HS256 using the first key. The
+// server verifies the signature on every request, so the values can't be
+// tampered with, but they are NOT encrypted: anyone holding the cookie,
+// including JavaScript on the page, can read them. Never store secrets,
+// personal data or authorization state in a public claims session.
+//
+// The cookie is not HttpOnly, so that scripts can read it from
+// document.cookie; the claims are the JSON object in the second
+// dot-separated part of the value, encoded with base64url without padding.
+func NewPublicCookieStore(keys ...[]byte) *CookieStore {
+	cs := NewJWTCookieStore(keys...)
+	cs.Options.HttpOnly = false
+	return cs
+}
+
+// NewJWTCodec returns a new JWTCodec signing tokens with key. It panics if
+// key is shorter than MinKeyLength.
+func NewJWTCodec(key []byte) *JWTCodec {
+	if err := checkKey(key); err != nil {
+		panic("sessions: " + err.Error())
+	}
+	return &JWTCodec{key: key, maxAge: 86400 * 30}
+}
+
+// JWTCodec is a securecookie.Codec encoding session values as JSON Web
+// Tokens signed with HMAC SHA-256 (HS256). Tokens are signed, not
+// encrypted: the values can be read by anyone holding the cookie.
+//
+// The values are mapped to the claims of the token as follows:
+//
+//   - Keys must be strings, they are the names of the claims.
+//   - Values are encoded with encoding/json, and decoded as the generic
+//     JSON types: numbers are decoded as float64, objects as
+//     map[string]interface{} and arrays as []interface{}.
+//   - The "aud", "iat" and "exp" claims are reserved: the audience is the
+//     session name, and the token is issued at the time of encoding and
+//     expires after the max age. Values with these keys are rejected.
+//
+// Decoding checks the signature, the audience and the expiration, and
+// removes the reserved claims from the values.
+type JWTCodec struct {
+	key    []byte
+	maxAge int
+}
+
+// Reserved claims of the tokens, see JWTCodec.
+const (
+	jwtAudience = "aud"
+	jwtIssuedAt = "iat"
+	jwtExpires  = "exp"
+)
+
+// jwtHeader is the encoded header of the tokens.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// MaxAge sets the number of seconds tokens are valid. A value <= 0 means
+// tokens don't expire.
+func (c *JWTCodec) MaxAge(age int) {
+	c.maxAge = age
+}
+
+// Encode encodes value, a map[interface{}]interface{} of session values, as
+// a token for the session name.
+func (c *JWTCodec) Encode(name string, value interface{}) (string, error) {
+	values, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return "", fmt.Errorf("sessions: JWTCodec cannot encode %T", value)
+	}
+	claims := make(map[string]interface{}, len(values)+3)
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return "", fmt.Errorf("sessions: JWT claim names must be strings, got %T", k)
+		}
+		if key == jwtAudience || key == jwtIssuedAt || key == jwtExpires {
+			return "", fmt.Errorf("sessions: JWT claim %q is reserved", key)
+		}
+		claims[key] = v
+	}
+	now := time.Now().Unix()
+	claims[jwtAudience] = name
+	claims[jwtIssuedAt] = now
+	if c.maxAge > 0 {
+		claims[jwtExpires] = now + int64(c.maxAge)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + c.sign(unsigned), nil
+}
+
+// Decode decodes a token for the session name into dst, a pointer to a
+// map[interface{}]interface{}.
+//
+// It returns securecookie.ErrMacInvalid if the signature is not valid.
+func (c *JWTCodec) Decode(name, value string, dst interface{}) error {
+	values, ok := dst.(*map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("sessions: JWTCodec cannot decode into %T", dst)
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return errors.New("sessions: malformed JWT")
+	}
+	if parts[0] != jwtHeader {
+		return errors.New("sessions: unsupported JWT header")
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(c.sign(parts[0]+"."+parts[1]))) {
+		return securecookie.ErrMacInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var claims map[string]interface{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return err
+	}
+	if aud, _ := claims[jwtAudience].(string); aud != name {
+		return errors.New("sessions: JWT issued for another session")
+	}
+	if exp, ok := claims[jwtExpires].(float64); ok && time.Now().Unix() > int64(exp) {
+		return errors.New("sessions: expired JWT")
+	}
+	if *values == nil {
+		*values = make(map[interface{}]interface{}, len(claims))
+	}
+	for k, v := range claims {
+		if k != jwtAudience && k != jwtIssuedAt && k != jwtExpires {
+			(*values)[k] = v
+		}
+	}
+	return nil
+}
+
+// sign returns the encoded signature of an unsigned token.
+func (c *JWTCodec) sign(unsigned string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
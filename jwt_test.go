@@ -0,0 +1,125 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestJWTCookieStore(t *testing.T) {
+	key := []byte("secret-key-0123456")
+	store := NewJWTCookieStore(key)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.Values["name"] = "gopher"
+	session.SetUser("42")
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// The token can be validated without this package.
+	req := requestWithCookie(ctx, "session-key")
+	token := string(req.Request.Header.Cookie("session-key"))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected a JWT; Got %q", token)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) != parts[2] {
+		t.Fatal("Expected an HS256 signature")
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("Error decoding claims: %v", err)
+	}
+	if claims["name"] != "gopher" || claims["aud"] != "session-key" || claims["exp"] == nil {
+		t.Fatalf("Unexpected claims: %v", claims)
+	}
+
+	session, err = store.New(req, "session-key")
+	if err != nil || session.IsNew {
+		t.Fatalf("Error loading session: %v", err)
+	}
+	if session.Values["name"] != "gopher" || session.User() != "42" {
+		t.Fatalf("Unexpected values: %v", session.Values)
+	}
+	if _, ok := session.Values["exp"]; ok {
+		t.Fatal("Expected the reserved claims to be removed")
+	}
+
+	// Tokens signed with another key or for another session are rejected.
+	other := NewJWTCookieStore([]byte("other-key-0123456"))
+	if _, err = other.New(req, "session-key"); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("Expected %v; Got %v", ErrSignatureInvalid, err)
+	}
+	req.Request.Header.SetCookie("other-session", token)
+	if _, err = store.New(req, "other-session"); err == nil {
+		t.Fatal("Expected an error for a token of another session")
+	}
+}
+
+func TestJWTCodecErrors(t *testing.T) {
+	codec := NewJWTCodec([]byte("secret-key-0123456"))
+	if _, err := codec.Encode("session-key", map[interface{}]interface{}{42: "x"}); err == nil {
+		t.Error("Expected an error for a non-string key")
+	}
+	if _, err := codec.Encode("session-key", map[interface{}]interface{}{"exp": 1}); err == nil {
+		t.Error("Expected an error for a reserved claim")
+	}
+
+	codec.MaxAge(-1)
+	token, _ := codec.Encode("session-key", map[interface{}]interface{}{"name": "gopher"})
+	codec.MaxAge(1)
+	values := make(map[interface{}]interface{})
+	if err := codec.Decode("session-key", token, &values); err != nil {
+		t.Errorf("Error decoding token without expiration: %v", err)
+	}
+}
+
+func TestPublicCookieStore(t *testing.T) {
+	store := NewPublicCookieStore([]byte("secret-key-0123456"))
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "flags")
+	session.Values["bucket"] = "b"
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey("flags")
+	ctx.Response.Header.Cookie(cookie)
+	if cookie.HTTPOnly() {
+		t.Fatal("Expected the cookie to be readable by scripts")
+	}
+
+	// The claims can be read without the key.
+	parts := strings.Split(string(cookie.Value()), ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims["bucket"] != "b" {
+		t.Fatalf("Unexpected claims: %v, %v", claims, err)
+	}
+
+	// But not modified.
+	payload, _ = json.Marshal(map[string]interface{}{"aud": "flags", "bucket": "a"})
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	req := &fasthttp.RequestCtx{}
+	req.Request.Header.SetCookie("flags", tampered)
+	if session, err := store.New(req, "flags"); err == nil || !session.IsNew {
+		t.Fatal("Expected tampered claims to be rejected")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"github.com/valyala/fasthttp"
+)
+
+// NewLazyStore returns a new LazyStore in front of store.
+func NewLazyStore(store Store) *LazyStore {
+	return &LazyStore{store: store}
+}
+
+// LazyStore is a Store wrapper deferring the loading of sessions until they
+// are accessed, to skip decoding, decrypting or fetching sessions on requests
+// that never use them.
+//
+// New returns the session right away, and it is loaded from the underlying
+// store on the first call to one of its methods, such as Get, Set or
+// GetDefault, or explicitly with Load, which returns the error of the
+// underlying store.
+//
+// The fields of the session can't be lazy: ID, Values, Options and IsNew
+// are only set once the session is loaded, so call Load before using them
+// directly. Values set before the session is loaded are lost.
+//
+// Sessions that were never loaded are not saved, as they are unchanged,
+// unless their Options were set, e.g. by DeleteAll.
+type LazyStore struct {
+	store Store
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *LazyStore) Get(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	return GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the
+// registry, loaded from the underlying store on first access. The request
+// must still be running when the session is loaded.
+func (s *LazyStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	session := NewSession(s, name)
+	session.lazy = func() error {
+		loaded, err := s.store.New(ctx, name)
+		if loaded == nil {
+			return err
+		}
+		session.ID = loaded.ID
+		session.Values = loaded.Values
+		if session.Options == nil {
+			session.Options = loaded.Options
+		}
+		session.IsNew = loaded.IsNew
+		session.loaded = loaded.loaded
+		session.codec = loaded.codec
+		return err
+	}
+	return session, nil
+}
+
+// Save saves the session in the underlying store, loading it first if
+// needed. Sessions never loaded nor given Options are not saved.
+func (s *LazyStore) Save(ctx *fasthttp.RequestCtx, session *Session) error {
+	if session.lazy != nil && session.Options == nil {
+		return nil
+	}
+	session.Load()
+	return s.store.Save(ctx, session)
+}
+
+// Close closes the underlying store if it implements Closer.
+func (s *LazyStore) Close() error {
+	if c, ok := s.store.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestLazyStore(t *testing.T) {
+	inner := &countingStore{Store: NewCookieStore([]byte("secret-key"))}
+	store := NewLazyStore(inner)
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	session.Set("name", "gopher")
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	inner.loads = 0
+
+	// Sessions never accessed are neither loaded nor saved.
+	req := requestWithCookie(ctx, "session-key")
+	session, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if err = Save(req); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	Clear(req)
+	if inner.loads != 0 {
+		t.Fatalf("Expected no load; Got %d", inner.loads)
+	}
+	if c := req.Response.Header.PeekCookie("session-key"); len(c) > 0 {
+		t.Fatal("Expected the session not to be saved")
+	}
+
+	// The session is loaded on first access.
+	req = requestWithCookie(ctx, "session-key")
+	defer Clear(req)
+	session, _ = store.Get(req, "session-key")
+	if session.Get("name") != "gopher" || session.User() != "" {
+		t.Fatalf("Expected name gopher; Got %v", session.Values)
+	}
+	if err = session.Load(); err != nil || session.IsNew || inner.loads != 1 {
+		t.Fatalf("Expected a single load; Got %d, %v", inner.loads, err)
+	}
+	if session.Store() != store {
+		t.Fatal("Expected the session to be bound to the lazy store")
+	}
+
+	// Sessions given options without being accessed are saved.
+	req = requestWithCookie(ctx, "session-key")
+	session, _ = store.New(req, "session-key")
+	session.Options = &Options{MaxAge: -1}
+	if err = session.Save(req); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey("session-key")
+	if !req.Response.Header.Cookie(cookie) || !cookie.Expire().Before(time.Now()) {
+		t.Fatal("Expected the session cookie to be expired")
+	}
+}
@@ -0,0 +1,528 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package levelstore provides a LevelDB session store for the sessions
+// package.
+package levelstore
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gem/sessions"
+	"github.com/gorilla/securecookie"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/valyala/fasthttp"
+)
+
+// Prefixes of the session keys and of the user index keys in the database.
+const (
+	keyPrefix  = "session_"
+	userPrefix = "user_"
+)
+
+// NewLevelStore returns a new LevelStore.
+//
+// See sessions.NewCookieStore() for a description of the other parameters.
+func NewLevelStore(db *leveldb.DB, keyPairs ...[]byte) *LevelStore {
+	codecs, err := sessions.NewCodecs(keyPairs...)
+	if err != nil {
+		panic(err)
+	}
+	ls := &LevelStore{
+		Codecs: codecs,
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		db: db,
+	}
+
+	ls.MaxAge(ls.Options.MaxAge)
+	return ls
+}
+
+// LevelStore stores sessions in a LevelDB database.
+//
+// The cookie only holds the signed session ID. Each session is stored under
+// the "session_" prefix followed by the storage key of its ID (see
+// sessions.StorageKey), as its expiration time followed
+// by the session values encoded with the codecs. Expired sessions are not
+// loaded, and they can be removed with GC.
+//
+// Sessions tagged with sessions.Session.SetUser are also indexed under the
+// "user_" prefix followed by the storage keys of the user ID and of the
+// session ID, for DeleteByUser and CountByUser.
+type LevelStore struct {
+	Codecs   []securecookie.Codec
+	Options  *sessions.Options // default configuration
+	db       *leveldb.DB
+	codecsMu sync.RWMutex // guards Codecs during Reencrypt
+	writeMu  sync.RWMutex // held for reading by writes, for writing by Reencrypt
+}
+
+// codecs returns the current codecs, which Reencrypt may replace while the
+// store is serving.
+func (s *LevelStore) codecs() []securecookie.Codec {
+	s.codecsMu.RLock()
+	defer s.codecsMu.RUnlock()
+	return s.Codecs
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See sessions.CookieStore.Get().
+func (s *LevelStore) Get(ctx *fasthttp.RequestCtx, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// It returns sessions.ErrSessionNotFound if the session referenced by the
+// cookie does not exist or has expired, and sessions.ErrSignatureInvalid if
+// the cookie signature could not be verified.
+//
+// See sessions.CookieStore.New().
+func (s *LevelStore) New(ctx *fasthttp.RequestCtx, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	var err error
+	if c := ctx.Request.Header.Cookie(name); len(c) > 0 {
+		err = sessions.DecodeMulti(name, string(c), &session.ID, s.codecs()...)
+		if err == nil {
+			err = s.load(session)
+			if err == nil {
+				session.IsNew = false
+			}
+		}
+	}
+	return session, err
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is <= 0 then the session is deleted
+// from the database.
+func (s *LevelStore) Save(ctx *fasthttp.RequestCtx, session *sessions.Session) error {
+	if session.Options == nil {
+		// Defaults of the store at the time of Save, see
+		// sessions.Session.Options.
+		opts := *s.Options
+		session.Options = &opts
+	}
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			batch := new(leveldb.Batch)
+			batch.Delete([]byte(keyPrefix + sessions.StorageKey(session.ID)))
+			if userID := session.User(); userID != "" {
+				batch.Delete(userKey(userID, session.ID))
+			}
+			if err := s.write(batch); err != nil {
+				return &sessions.StorageError{Op: "delete", Err: err}
+			}
+		}
+		sessions.SetCookie(ctx, session.Name(), "", session.Options)
+		return nil
+	}
+
+	if session.ID == "" {
+		key := securecookie.GenerateRandomKey(32)
+		if key == nil {
+			return errors.New("levelstore: failed to generate session id")
+		}
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(key), "=")
+	}
+	if err := s.save(session); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
+		s.codecs()...)
+	if err != nil {
+		return err
+	}
+	sessions.SetCookie(ctx, session.Name(), encoded, session.Options)
+	return nil
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *LevelStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each securecookie instance.
+	for _, codec := range s.codecs() {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// GC deletes the expired sessions from the database and returns the number
+// of sessions deleted. It also deletes the user index keys of the sessions
+// that don't exist anymore.
+func (s *LevelStore) GC() (int, error) {
+	now := time.Now().Unix()
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	expired := make(map[string]bool)
+	for iter.Next() {
+		if expires, _, ok := split(iter.Value()); !ok || expires <= now {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+			expired[strings.TrimPrefix(string(iter.Key()), keyPrefix)] = true
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	n := batch.Len()
+
+	index := s.db.NewIterator(util.BytesPrefix([]byte(userPrefix)), nil)
+	defer index.Release()
+	for index.Next() {
+		key := indexedKey(index.Key())
+		if !expired[key] {
+			ok, err := s.db.Has([]byte(keyPrefix+key), nil)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				continue
+			}
+		}
+		batch.Delete(append([]byte(nil), index.Key()...))
+	}
+	if err := index.Error(); err != nil {
+		return 0, err
+	}
+	if err := s.write(batch); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// DeleteByUser removes all the sessions tagged with the given user ID, see
+// sessions.Session.SetUser, and returns the number of sessions removed.
+func (s *LevelStore) DeleteByUser(userID string) (int, error) {
+	iter := s.db.NewIterator(util.BytesPrefix(userKey(userID, "")), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	n := 0
+	for iter.Next() {
+		key := []byte(keyPrefix + indexedKey(iter.Key()))
+		ok, err := s.db.Has(key, nil)
+		if err != nil {
+			return 0, &sessions.StorageError{Op: "delete", Err: err}
+		}
+		if ok {
+			batch.Delete(key)
+			n++
+		}
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	if err := s.write(batch); err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	return n, nil
+}
+
+// DeleteWhere removes the unexpired sessions saved with the given session
+// name for which pred returns true, e.g. all the sessions of a user for a
+// data subject erasure request, and returns the number of sessions removed.
+//
+// pred is given the session with its values; its ID is empty, as the store
+// only keeps a hash of it. It reads and decodes every session: it is meant
+// for admin tasks, not for the request hot path. Use DeleteByUser for
+// sessions tagged with sessions.Session.SetUser, which only reads an index.
+//
+// See sessions.FilesystemStore.DeleteWhere().
+func (s *LevelStore) DeleteWhere(name string, pred func(*sessions.Session) bool) (int, error) {
+	now := time.Now().Unix()
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	n := 0
+	for iter.Next() {
+		expires, encoded, ok := split(iter.Value())
+		if !ok || expires <= now {
+			continue
+		}
+		session := sessions.NewSession(s, name)
+		session.IsNew = false
+		if securecookie.DecodeMulti(name, string(encoded), &session.Values, s.codecs()...) != nil {
+			continue
+		}
+		if !pred(session) {
+			continue
+		}
+		key := strings.TrimPrefix(string(iter.Key()), keyPrefix)
+		batch.Delete([]byte(keyPrefix + key))
+		if userID := session.User(); userID != "" {
+			batch.Delete(append(userKey(userID, ""), key...))
+		}
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	if err := s.write(batch); err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	return n, nil
+}
+
+// CountByUser returns the number of unexpired sessions tagged with the given
+// user ID, see sessions.Session.SetUser, e.g. to limit the number of
+// concurrent sessions of a user at login.
+func (s *LevelStore) CountByUser(userID string) (int, error) {
+	now := time.Now().Unix()
+	iter := s.db.NewIterator(util.BytesPrefix(userKey(userID, "")), nil)
+	defer iter.Release()
+	n := 0
+	for iter.Next() {
+		value, err := s.db.Get([]byte(keyPrefix+indexedKey(iter.Key())), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, &sessions.StorageError{Op: "load", Err: err}
+		}
+		if expires, _, ok := split(value); ok && expires > now {
+			n++
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return 0, &sessions.StorageError{Op: "load", Err: err}
+	}
+	return n, nil
+}
+
+// List returns the storage keys of the unexpired sessions starting with
+// prefix.
+//
+// See sessions.Lister.
+func (s *LevelStore) List(prefix string) ([]string, error) {
+	now := time.Now().Unix()
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(keyPrefix+prefix)), nil)
+	defer iter.Release()
+	var keys []string
+	for iter.Next() {
+		if expires, _, ok := split(iter.Value()); ok && expires > now {
+			keys = append(keys, strings.TrimPrefix(string(iter.Key()), keyPrefix))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, &sessions.StorageError{Op: "list", Err: err}
+	}
+	return keys, nil
+}
+
+// Reencrypt rewrites the stored sessions saved with the given session name
+// with codecs created from newKeyPairs by sessions.NewCodecs, which are used
+// by the store afterwards, and returns the number of sessions rewritten. It
+// can be called while the store is serving: each session is read again and
+// rewritten while the writes of the store wait, so a session saved or
+// deleted meanwhile is not overwritten with its previous values.
+//
+// See sessions.FilesystemStore.Reencrypt().
+func (s *LevelStore) Reencrypt(name string, newKeyPairs ...[]byte) (int, error) {
+	codecs, err := sessions.NewCodecs(newKeyPairs...)
+	if err != nil {
+		return 0, err
+	}
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(s.Options.MaxAge)
+		}
+	}
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	defer iter.Release()
+	n := 0
+	for iter.Next() {
+		ok, err := s.reencrypt(name, append([]byte(nil), iter.Key()...), codecs)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return n, err
+	}
+	s.codecsMu.Lock()
+	s.Codecs = codecs
+	s.codecsMu.Unlock()
+	return n, nil
+}
+
+// reencrypt reads the session stored under key and rewrites it with codecs,
+// holding writeMu. It reports whether the session was rewritten.
+func (s *LevelStore) reencrypt(name string, key []byte, codecs []securecookie.Codec) (bool, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	value, err := s.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	expires, encoded, ok := split(value)
+	if !ok {
+		return false, nil
+	}
+	values := make(map[interface{}]interface{})
+	if securecookie.DecodeMulti(name, string(encoded), &values, s.codecs()...) != nil {
+		return false, nil
+	}
+	reencoded, err := securecookie.EncodeMulti(name, values, codecs...)
+	if err != nil {
+		return false, err
+	}
+	value = make([]byte, 8+len(reencoded))
+	binary.BigEndian.PutUint64(value, uint64(expires))
+	copy(value[8:], reencoded)
+	if err = s.db.Put(key, value, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ping checks that the database is open. The database is local, so it is
+// always reachable otherwise.
+//
+// See sessions.Pinger.
+func (s *LevelStore) Ping(ctx context.Context) error {
+	if _, err := s.db.GetProperty("leveldb.alivesnaps"); err != nil {
+		return &sessions.StorageError{Op: "ping", Err: err}
+	}
+	return nil
+}
+
+// Validate writes, reads and deletes a probe key in the database.
+//
+// See sessions.Validator.
+func (s *LevelStore) Validate() error {
+	key := []byte("probe_" + sessions.StorageKey("probe"))
+	err := s.db.Put(key, []byte("probe"), nil)
+	if err == nil {
+		_, err = s.db.Get(key, nil)
+	}
+	if err == nil {
+		err = s.db.Delete(key, nil)
+	}
+	if err != nil {
+		return &sessions.StorageError{Op: "validate", Err: err}
+	}
+	return nil
+}
+
+// Close closes the database given to NewLevelStore, so don't call it if the
+// database is shared with other users.
+//
+// See sessions.Closer.
+func (s *LevelStore) Close() error {
+	return s.db.Close()
+}
+
+// write writes batch to the database, unless Reencrypt is rewriting a
+// session.
+func (s *LevelStore) write(batch *leveldb.Batch) error {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	return s.db.Write(batch, nil)
+}
+
+// save writes the expiration time and encoded session.Values to the database.
+// If the stored session was tagged with another user, its entry in the index
+// of that user is removed.
+func (s *LevelStore) save(session *sessions.Session) error {
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
+		s.codecs()...)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	value := make([]byte, 8+len(encoded))
+	binary.BigEndian.PutUint64(value, uint64(expires.Unix()))
+	copy(value[8:], encoded)
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(keyPrefix+sessions.StorageKey(session.ID)), value)
+	userID := session.User()
+	if userID != "" {
+		batch.Put(userKey(userID, session.ID), nil)
+	}
+	if previous := s.storedUser(session); previous != "" && previous != userID {
+		batch.Delete(userKey(previous, session.ID))
+	}
+	if err = s.write(batch); err != nil {
+		return &sessions.StorageError{Op: "save", Err: err}
+	}
+	return nil
+}
+
+// storedUser returns the user tagged on the stored copy of session, or an
+// empty string if it is not tagged or could not be loaded.
+func (s *LevelStore) storedUser(session *sessions.Session) string {
+	stored := sessions.NewSession(s, session.Name())
+	stored.ID = session.ID
+	if s.load(stored) != nil {
+		return ""
+	}
+	return stored.User()
+}
+
+// userKey returns the user index key of the session with the given ID, or
+// the prefix of the index keys of the user if sessionID is empty.
+func userKey(userID, sessionID string) []byte {
+	key := userPrefix + sessions.StorageKey(userID) + "_"
+	if sessionID != "" {
+		key += sessions.StorageKey(sessionID)
+	}
+	return []byte(key)
+}
+
+// indexedKey returns the storage key of the session of a user index key.
+func indexedKey(index []byte) string {
+	return string(index[strings.LastIndexByte(string(index), '_')+1:])
+}
+
+// load reads a session from the database and decodes it into session.Values.
+func (s *LevelStore) load(session *sessions.Session) error {
+	value, err := s.db.Get([]byte(keyPrefix+sessions.StorageKey(session.ID)), nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return sessions.ErrSessionNotFound
+		}
+		return &sessions.StorageError{Op: "load", Err: err}
+	}
+	expires, encoded, ok := split(value)
+	if !ok || expires <= time.Now().Unix() {
+		return sessions.ErrSessionNotFound
+	}
+	return sessions.DecodeMulti(session.Name(), string(encoded),
+		&session.Values, s.codecs()...)
+}
+
+// split returns the expiration time and the encoded values of a stored
+// session.
+func split(value []byte) (expires int64, encoded []byte, ok bool) {
+	if len(value) < 8 {
+		return 0, nil, false
+	}
+	return int64(binary.BigEndian.Uint64(value)), value[8:], true
+}
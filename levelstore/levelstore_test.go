@@ -0,0 +1,416 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package levelstore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gem/sessions"
+	"github.com/gorilla/securecookie"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/valyala/fasthttp"
+)
+
+func newTestStore(t *testing.T) *LevelStore {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return NewLevelStore(db, []byte("some key"))
+}
+
+// request returns a request context carrying the cookies sent in res.
+func request(res *fasthttp.RequestCtx, name string) *fasthttp.RequestCtx {
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey(name)
+	ctx := &fasthttp.RequestCtx{}
+	if res.Response.Header.Cookie(cookie) {
+		ctx.Request.Header.SetCookieBytesKV(cookie.Key(), cookie.Value())
+	}
+	return ctx
+}
+
+func TestLevelStore(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	ctx = request(ctx, "hello")
+	if session, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["name"] != "gopher" {
+		t.Fatalf("bad session: got %v, want name %q", session.Values, "gopher")
+	}
+
+	session.Options.MaxAge = -1
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, err = store.New(ctx, "hello"); !errors.Is(err, sessions.ErrSessionNotFound) {
+		t.Fatalf("bad error: got %v, want %v", err, sessions.ErrSessionNotFound)
+	}
+}
+
+func TestLevelStoreTampered(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// A session ID signed with another key.
+	forged, err := securecookie.EncodeMulti("hello", session.ID, securecookie.New([]byte("other key"), nil))
+	if err != nil {
+		t.Fatal("failed to encode cookie", err)
+	}
+	req := &fasthttp.RequestCtx{}
+	req.Request.Header.SetCookie("hello", forged)
+	if tampered, err := store.New(req, "hello"); !errors.Is(err, sessions.ErrSignatureInvalid) {
+		t.Fatalf("bad error: got %v, want %v", err, sessions.ErrSignatureInvalid)
+	} else if !tampered.IsNew {
+		t.Fatal("bad session: got a loaded session, want a new one")
+	}
+
+	// Stored values signed with another key.
+	encoded, err := securecookie.EncodeMulti("hello", map[interface{}]interface{}{"name": "gopher"},
+		securecookie.New([]byte("other key"), nil))
+	if err != nil {
+		t.Fatal("failed to encode values", err)
+	}
+	value := make([]byte, 8+len(encoded))
+	binary.BigEndian.PutUint64(value, uint64(time.Now().Add(time.Hour).Unix()))
+	copy(value[8:], encoded)
+	if err = store.db.Put([]byte(keyPrefix+sessions.StorageKey(session.ID)), value, nil); err != nil {
+		t.Fatal("failed to write session", err)
+	}
+	if _, err = store.New(request(ctx, "hello"), "hello"); !errors.Is(err, sessions.ErrSignatureInvalid) {
+		t.Fatalf("bad error: got %v, want %v", err, sessions.ErrSignatureInvalid)
+	}
+}
+
+func TestLevelStoreGC(t *testing.T) {
+	store := newTestStore(t)
+
+	var expired *fasthttp.RequestCtx
+	for i := 0; i < 3; i++ {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		if i == 1 {
+			// Make the second session expired.
+			key := []byte(keyPrefix + sessions.StorageKey(session.ID))
+			value, err := store.db.Get(key, nil)
+			if err != nil {
+				t.Fatal("failed to read session", err)
+			}
+			binary.BigEndian.PutUint64(value, uint64(time.Now().Add(-time.Hour).Unix()))
+			if err = store.db.Put(key, value, nil); err != nil {
+				t.Fatal("failed to write session", err)
+			}
+			expired = request(ctx, "hello")
+		}
+	}
+
+	if _, err := store.New(expired, "hello"); !errors.Is(err, sessions.ErrSessionNotFound) {
+		t.Fatalf("bad error: got %v, want %v", err, sessions.ErrSessionNotFound)
+	}
+	n, err := store.GC()
+	if err != nil {
+		t.Fatal("failed to collect sessions", err)
+	}
+	if n != 1 {
+		t.Fatalf("bad collected count: got %d, want %d", n, 1)
+	}
+	if n, err = store.GC(); err != nil || n != 0 {
+		t.Fatalf("bad second collection: got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestLevelStoreDeleteByUser(t *testing.T) {
+	store := newTestStore(t)
+	var other *fasthttp.RequestCtx
+	for _, userID := range []string{"gopher", "gopher", "someone else"} {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.SetUser(userID)
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		other = request(ctx, "hello")
+	}
+
+	if n, err := store.CountByUser("gopher"); err != nil || n != 2 {
+		t.Fatalf("bad count: got (%d, %v), want (2, nil)", n, err)
+	}
+	n, err := store.DeleteByUser("gopher")
+	if err != nil {
+		t.Fatal("failed to delete sessions", err)
+	}
+	if n != 2 {
+		t.Fatalf("bad deleted count: got %d, want %d", n, 2)
+	}
+	if n, err = store.DeleteByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad second deletion: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.CountByUser("someone else"); err != nil || n != 1 {
+		t.Fatalf("bad count: got (%d, %v), want (1, nil)", n, err)
+	}
+	if _, err = store.New(other, "hello"); err != nil {
+		t.Fatal("failed to load the session of another user", err)
+	}
+}
+
+func TestLevelStoreSetUserChange(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.SetUser("gopher")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// The session moves to another user: it leaves the index of the first.
+	ctx = request(ctx, "hello")
+	if session, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	session.SetUser("someone else")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if n, err := store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count of the previous user: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err := store.CountByUser("someone else"); err != nil || n != 1 {
+		t.Fatalf("bad count: got (%d, %v), want (1, nil)", n, err)
+	}
+	if n, err := store.DeleteByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad delete of the previous user: got (%d, %v), want (0, nil)", n, err)
+	}
+	if _, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load the session of the new user", err)
+	}
+}
+
+func TestLevelStoreDeleteWhere(t *testing.T) {
+	store := newTestStore(t)
+	users := []string{"gopher", "gopher", "someone else"}
+	requests := make([]*fasthttp.RequestCtx, len(users))
+	for i, userID := range users {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["userID"] = userID
+		if i == 0 {
+			session.SetUser(userID)
+		}
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		requests[i] = request(ctx, "hello")
+	}
+
+	n, err := store.DeleteWhere("hello", func(session *sessions.Session) bool {
+		return session.Values["userID"] == "gopher"
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("bad deleted count: got (%d, %v), want (2, nil)", n, err)
+	}
+	for i, ctx := range requests {
+		_, err = store.New(ctx, "hello")
+		if users[i] == "gopher" && !errors.Is(err, sessions.ErrSessionNotFound) {
+			t.Errorf("bad error loading deleted session: got %v, want %v", err, sessions.ErrSessionNotFound)
+		} else if users[i] != "gopher" && err != nil {
+			t.Errorf("failed to load session: %v", err)
+		}
+	}
+	if n, err = store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count after delete: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.DeleteWhere("other", func(*sessions.Session) bool { return true }); err != nil || n != 0 {
+		t.Fatalf("bad delete of another name: got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestLevelStoreReencrypt(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	n, err := store.Reencrypt("hello", []byte("new key"), nil, []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to re-encrypt sessions", err)
+	}
+	if n != 1 {
+		t.Fatalf("bad re-encrypted count: got %d, want %d", n, 1)
+	}
+
+	// Only the new key decodes the stored session.
+	loaded := sessions.NewSession(nil, "hello")
+	loaded.ID = session.ID
+	if err = NewLevelStore(store.db, []byte("some key")).load(loaded); err == nil {
+		t.Fatal("expected an error decoding with the old key, got nil")
+	}
+	if loaded, err = store.New(request(ctx, "hello"), "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.Values["name"] != "gopher" {
+		t.Fatalf("bad session value: got %v, want %q", loaded.Values["name"], "gopher")
+	}
+}
+
+// hookCodec is a codec calling hook on the first Decode.
+type hookCodec struct {
+	securecookie.Codec
+	once sync.Once
+	hook func()
+}
+
+func (c *hookCodec) Decode(name, value string, dst interface{}) error {
+	c.once.Do(c.hook)
+	return c.Codec.Decode(name, value, dst)
+}
+
+func TestLevelStoreReencryptConcurrentSave(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// The session is saved again while Reencrypt decodes it: the save waits
+	// for the rewrite and is not overwritten.
+	done := make(chan error, 1)
+	store.Codecs = []securecookie.Codec{&hookCodec{Codec: store.Codecs[0], hook: func() {
+		session.Values["name"] = "updated"
+		go func() {
+			done <- session.Save(&fasthttp.RequestCtx{})
+		}()
+		select {
+		case err := <-done:
+			done <- err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}}}
+	if _, err = store.Reencrypt("hello", []byte("new key"), nil, []byte("some key")); err != nil {
+		t.Fatal("failed to re-encrypt sessions", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	loaded := sessions.NewSession(store, "hello")
+	loaded.ID = session.ID
+	if err = store.load(loaded); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.Values["name"] != "updated" {
+		t.Fatalf("bad session value: got %v, want %q", loaded.Values["name"], "updated")
+	}
+}
+
+func TestLevelStoreList(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	key := sessions.StorageKey(session.ID)
+	keys, err := store.List(key[:4])
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("bad listed sessions: got %v, want [%s]", keys, key)
+	}
+	if keys, err = store.List("x"); err != nil || len(keys) != 0 {
+		t.Fatalf("bad listed sessions for prefix: got (%v, %v)", keys, err)
+	}
+}
+
+func TestLevelStoreClose(t *testing.T) {
+	store := newTestStore(t)
+	var closer sessions.Closer = store
+	if err := closer.Close(); err != nil {
+		t.Fatal("failed to close store", err)
+	}
+	if _, err := store.List(""); err == nil {
+		t.Fatal("expected an error using a closed store")
+	}
+}
+
+func TestLevelStoreValidate(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Validate(); err != nil {
+		t.Fatal("failed to validate store", err)
+	}
+	key := []byte("probe_" + sessions.StorageKey("probe"))
+	if ok, _ := store.db.Has(key, nil); ok {
+		t.Fatal("expected the probe to be removed")
+	}
+}
+
+func TestLevelStorePing(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Ping(context.Background()); err != nil {
+		t.Fatal("failed to ping store", err)
+	}
+	store.Close()
+	if err := store.Ping(context.Background()); !errors.Is(err, sessions.ErrStorageUnavailable) {
+		t.Fatalf("bad error for a closed store: got %v, want %v", err, sessions.ErrStorageUnavailable)
+	}
+}
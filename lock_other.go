@@ -0,0 +1,15 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package sessions
+
+import "os"
+
+// lockFile does nothing: advisory file locking is only supported on Unix.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"github.com/valyala/fasthttp"
+)
+
+// NopStore is a Store that doesn't persist sessions, to disable sessions
+// without changing the handlers, e.g. in a stateless service: sessions
+// always appear new and empty on each request, and changes are discarded.
+//
+// Within a request, Get still returns the same session for a name, so
+// values set by a handler can be read back until the end of the request.
+type NopStore struct{}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s NopStore) Get(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	return GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a new empty session for the given name.
+func (s NopStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	session := NewSession(s, name)
+	session.Options = &Options{Path: "/"}
+	session.IsNew = true
+	return session, nil
+}
+
+// Save does nothing: no cookie is sent and nothing is stored.
+func (s NopStore) Save(ctx *fasthttp.RequestCtx, session *Session) error {
+	return nil
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestNopStore(t *testing.T) {
+	var store Store = NopStore{}
+	ctx := &fasthttp.RequestCtx{}
+	defer Clear(ctx)
+
+	session, err := store.Get(ctx, "session-key")
+	if err != nil || !session.IsNew {
+		t.Fatalf("Expected a new session; Got %v", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = Save(ctx); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	if c := ctx.Response.Header.PeekCookie("session-key"); len(c) > 0 {
+		t.Fatalf("Unexpected cookie: %s", c)
+	}
+	if session, _ = store.Get(ctx, "session-key"); session.Values["name"] != "gopher" {
+		t.Fatal("Expected the same session within the request")
+	}
+	if session, _ = store.New(ctx, "session-key"); len(session.Values) != 0 {
+		t.Fatalf("Expected an empty session; Got %v", session.Values)
+	}
+}
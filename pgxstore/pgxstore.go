@@ -0,0 +1,480 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package pgxstore provides a PostgreSQL session store for the sessions
+// package, using the pgx driver directly.
+package pgxstore
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gem/sessions"
+	"github.com/gorilla/securecookie"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/valyala/fasthttp"
+)
+
+// NewPgxStore returns a new PgxStore.
+//
+// Sessions are stored in the "sessions" table, see CreateTable to create it.
+//
+// See sessions.NewCookieStore() for a description of the other parameters.
+func NewPgxStore(pool *pgxpool.Pool, keyPairs ...[]byte) *PgxStore {
+	codecs, err := sessions.NewCodecs(keyPairs...)
+	if err != nil {
+		panic(err)
+	}
+	ps := &PgxStore{
+		Codecs: codecs,
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		Table: "sessions",
+		pool:  pool,
+	}
+
+	ps.MaxAge(ps.Options.MaxAge)
+	return ps
+}
+
+// PgxStore stores sessions in PostgreSQL.
+//
+// The cookie only holds the signed session ID, the session values are
+// encoded with the codecs and stored in a bytea column, in the row of the
+// storage key of the ID (see sessions.StorageKey).
+type PgxStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options // default configuration
+	// Table is the name of the sessions table.
+	Table string
+	// Channel, if set, is the channel where the storage keys of deleted
+	// sessions are sent with NOTIFY, so other nodes can be informed with
+	// Listen.
+	Channel string
+	// OnInvalidCookie, if set, is called by New when the session ID in the
+	// request could not be decoded.
+	//
+	// See sessions.CookieStore.OnInvalidCookie.
+	OnInvalidCookie func(name string, err error)
+	pool            *pgxpool.Pool
+	codecsMu        sync.RWMutex // guards Codecs during Reencrypt
+}
+
+// codecs returns the current codecs, which Reencrypt may replace while the
+// store is serving.
+func (s *PgxStore) codecs() []securecookie.Codec {
+	s.codecsMu.RLock()
+	defer s.codecsMu.RUnlock()
+	return s.Codecs
+}
+
+// CreateTable creates the sessions table and its indexes if they don't
+// exist.
+func (s *PgxStore) CreateTable(ctx context.Context) error {
+	table := s.table()
+	_, err := s.pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+	id text PRIMARY KEY,
+	user_id text NOT NULL DEFAULT '',
+	data bytea NOT NULL,
+	expires_at timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS `+pgx.Identifier{s.Table + "_user_id"}.Sanitize()+` ON `+table+` (user_id);
+CREATE INDEX IF NOT EXISTS `+pgx.Identifier{s.Table + "_expires_at"}.Sanitize()+` ON `+table+` (expires_at);`)
+	return err
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See sessions.CookieStore.Get().
+func (s *PgxStore) Get(ctx *fasthttp.RequestCtx, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// It returns sessions.ErrSessionNotFound if the session referenced by the
+// cookie does not exist or has expired, and sessions.ErrSignatureInvalid if
+// the cookie signature could not be verified.
+//
+// See sessions.CookieStore.New().
+func (s *PgxStore) New(ctx *fasthttp.RequestCtx, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	var err error
+	if c := ctx.Request.Header.Cookie(name); len(c) > 0 {
+		err = sessions.DecodeMulti(name, string(c), &session.ID, s.codecs()...)
+		if err == nil {
+			err = s.load(ctx, session)
+			if err == nil {
+				session.IsNew = false
+			}
+		} else if s.OnInvalidCookie != nil {
+			s.OnInvalidCookie(name, err)
+		}
+	}
+	return session, err
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is <= 0 then the session is deleted
+// from the database.
+func (s *PgxStore) Save(ctx *fasthttp.RequestCtx, session *sessions.Session) error {
+	if session.Options == nil {
+		// Defaults of the store at the time of Save, see
+		// sessions.Session.Options.
+		opts := *s.Options
+		session.Options = &opts
+	}
+	if session.Options.MaxAge <= 0 {
+		if err := s.erase(ctx, session.ID); err != nil {
+			return err
+		}
+		sessions.SetCookie(ctx, session.Name(), "", session.Options)
+		return nil
+	}
+
+	if session.ID == "" {
+		key := securecookie.GenerateRandomKey(32)
+		if key == nil {
+			return errors.New("pgxstore: failed to generate session id")
+		}
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(key), "=")
+	}
+	if err := s.save(ctx, session); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
+		s.codecs()...)
+	if err != nil {
+		return err
+	}
+	sessions.SetCookie(ctx, session.Name(), encoded, session.Options)
+	return nil
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *PgxStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each securecookie instance.
+	for _, codec := range s.codecs() {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// DeleteByUser removes all the sessions tagged with the given user ID, see
+// sessions.Session.SetUser, and returns the number of sessions removed.
+func (s *PgxStore) DeleteByUser(userID string) (int, error) {
+	ctx := context.Background()
+	rows, err := s.pool.Query(ctx, `DELETE FROM `+s.table()+` WHERE user_id = $1 RETURNING id`, userID)
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	for _, key := range keys {
+		if err = s.notify(ctx, key); err != nil {
+			return len(keys), &sessions.StorageError{Op: "notify", Err: err}
+		}
+	}
+	return len(keys), nil
+}
+
+// CountByUser returns the number of unexpired sessions tagged with the given
+// user ID, see sessions.Session.SetUser.
+func (s *PgxStore) CountByUser(userID string) (int, error) {
+	var n int
+	err := s.pool.QueryRow(context.Background(), `SELECT count(*) FROM `+s.table()+`
+		WHERE user_id = $1 AND expires_at > now()`, userID).Scan(&n)
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "load", Err: err}
+	}
+	return n, nil
+}
+
+// DeleteWhere removes the unexpired sessions saved with the given session
+// name for which pred returns true, e.g. all the sessions of a user for a
+// data subject erasure request, and returns the number of sessions removed.
+//
+// pred is given the session with its values; its ID is empty, as the store
+// only keeps a hash of it. It reads and decodes every session row, locking
+// them until it returns: it is meant for admin tasks, not for the request hot
+// path. Use DeleteByUser for sessions tagged with sessions.Session.SetUser,
+// which uses the user_id index.
+//
+// See sessions.FilesystemStore.DeleteWhere().
+func (s *PgxStore) DeleteWhere(name string, pred func(*sessions.Session) bool) (int, error) {
+	ctx := context.Background()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `SELECT id, data FROM `+s.table()+`
+WHERE expires_at > now() FOR UPDATE`)
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	type row struct {
+		ID   string
+		Data []byte
+	}
+	stored, err := pgx.CollectRows(rows, pgx.RowToStructByPos[row])
+	if err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	var keys []string
+	for _, r := range stored {
+		session := sessions.NewSession(s, name)
+		session.IsNew = false
+		if securecookie.DecodeMulti(name, string(r.Data), &session.Values, s.codecs()...) != nil {
+			continue
+		}
+		if !pred(session) {
+			continue
+		}
+		if _, err = tx.Exec(ctx, `DELETE FROM `+s.table()+` WHERE id = $1`, r.ID); err != nil {
+			return 0, &sessions.StorageError{Op: "delete", Err: err}
+		}
+		keys = append(keys, r.ID)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return 0, &sessions.StorageError{Op: "delete", Err: err}
+	}
+	for _, key := range keys {
+		if err = s.notify(ctx, key); err != nil {
+			return len(keys), &sessions.StorageError{Op: "notify", Err: err}
+		}
+	}
+	return len(keys), nil
+}
+
+// Reencrypt rewrites the stored sessions saved with the given session name
+// with codecs created from newKeyPairs by sessions.NewCodecs, which are used
+// by the store afterwards, and returns the number of sessions rewritten. It
+// is safe to call while the store is serving.
+//
+// See sessions.FilesystemStore.Reencrypt().
+func (s *PgxStore) Reencrypt(name string, newKeyPairs ...[]byte) (int, error) {
+	codecs, err := sessions.NewCodecs(newKeyPairs...)
+	if err != nil {
+		return 0, err
+	}
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(s.Options.MaxAge)
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `SELECT id, data FROM `+s.table()+`
+WHERE expires_at > now() FOR UPDATE`)
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		ID   string
+		Data []byte
+	}
+	stored, err := pgx.CollectRows(rows, pgx.RowToStructByPos[row])
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, r := range stored {
+		values := make(map[interface{}]interface{})
+		if securecookie.DecodeMulti(name, string(r.Data), &values, s.codecs()...) != nil {
+			continue
+		}
+		encoded, err := securecookie.EncodeMulti(name, values, codecs...)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec(ctx, `UPDATE `+s.table()+` SET data = $2 WHERE id = $1`,
+			r.ID, []byte(encoded)); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	s.codecsMu.Lock()
+	s.Codecs = codecs
+	s.codecsMu.Unlock()
+	return n, nil
+}
+
+// List returns the storage keys of the unexpired sessions starting with
+// prefix.
+//
+// See sessions.Lister.
+func (s *PgxStore) List(prefix string) ([]string, error) {
+	ctx := context.Background()
+	rows, err := s.pool.Query(ctx, `SELECT id FROM `+s.table()+`
+WHERE left(id, length($1)) = $1 AND expires_at > now() ORDER BY id`, prefix)
+	if err != nil {
+		return nil, &sessions.StorageError{Op: "list", Err: err}
+	}
+	keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, &sessions.StorageError{Op: "list", Err: err}
+	}
+	return keys, nil
+}
+
+// Ping pings the database.
+//
+// See sessions.Pinger.
+func (s *PgxStore) Ping(ctx context.Context) error {
+	if err := s.pool.Ping(ctx); err != nil {
+		return &sessions.StorageError{Op: "ping", Err: err}
+	}
+	return nil
+}
+
+// Validate pings the database and reads the sessions table, to detect an
+// unreachable database or a missing table. It has no side effects.
+//
+// See sessions.Validator.
+func (s *PgxStore) Validate() error {
+	ctx := context.Background()
+	if err := s.pool.Ping(ctx); err != nil {
+		return &sessions.StorageError{Op: "validate", Err: err}
+	}
+	rows, err := s.pool.Query(ctx, `SELECT id FROM `+s.table()+` LIMIT 1`)
+	if err != nil {
+		return &sessions.StorageError{Op: "validate", Err: err}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return &sessions.StorageError{Op: "validate", Err: err}
+	}
+	return nil
+}
+
+// DeleteExpired removes the expired sessions from the database.
+func (s *PgxStore) DeleteExpired(ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM `+s.table()+` WHERE expires_at <= now()`)
+	return err
+}
+
+// Listen waits for the notifications of deleted sessions sent to Channel,
+// possibly by other nodes, and calls fn with the storage key of each deleted
+// session (see sessions.StorageKey).
+//
+// It blocks until ctx is done or the connection fails, so it is usually run
+// in its own goroutine.
+func (s *PgxStore) Listen(ctx context.Context, fn func(key string)) error {
+	if s.Channel == "" {
+		return errors.New("pgxstore: missing notification channel")
+	}
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err = conn.Exec(ctx, `LISTEN `+pgx.Identifier{s.Channel}.Sanitize()); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		fn(n.Payload)
+	}
+}
+
+// Close closes the connection pool given to NewPgxStore, so don't call it
+// if the pool is shared with other users.
+//
+// See sessions.Closer.
+func (s *PgxStore) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+// save writes encoded session.Values to the database.
+func (s *PgxStore) save(ctx context.Context, session *sessions.Session) error {
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
+		s.codecs()...)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	_, err = s.pool.Exec(ctx, `INSERT INTO `+s.table()+` (id, user_id, data, expires_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (id) DO UPDATE SET user_id = $2, data = $3, expires_at = $4`,
+		sessions.StorageKey(session.ID), session.User(), []byte(encoded), expires)
+	if err != nil {
+		return &sessions.StorageError{Op: "save", Err: err}
+	}
+	return nil
+}
+
+// load reads a session from the database and decodes it into session.Values.
+func (s *PgxStore) load(ctx context.Context, session *sessions.Session) error {
+	var data []byte
+	err := s.pool.QueryRow(ctx, `SELECT data FROM `+s.table()+`
+WHERE id = $1 AND expires_at > now()`, sessions.StorageKey(session.ID)).Scan(&data)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return sessions.ErrSessionNotFound
+		}
+		return &sessions.StorageError{Op: "load", Err: err}
+	}
+	return sessions.DecodeMulti(session.Name(), string(data),
+		&session.Values, s.codecs()...)
+}
+
+// erase deletes a session from the database.
+func (s *PgxStore) erase(ctx context.Context, id string) error {
+	if id == "" {
+		return nil
+	}
+	key := sessions.StorageKey(id)
+	if _, err := s.pool.Exec(ctx, `DELETE FROM `+s.table()+` WHERE id = $1`, key); err != nil {
+		return &sessions.StorageError{Op: "delete", Err: err}
+	}
+	if err := s.notify(ctx, key); err != nil {
+		return &sessions.StorageError{Op: "notify", Err: err}
+	}
+	return nil
+}
+
+// notify sends the storage key of a deleted session to Channel, if set.
+func (s *PgxStore) notify(ctx context.Context, key string) error {
+	if s.Channel == "" {
+		return nil
+	}
+	_, err := s.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, s.Channel, key)
+	return err
+}
+
+// table returns the quoted name of the sessions table.
+func (s *PgxStore) table() string {
+	return pgx.Identifier{s.Table}.Sanitize()
+}
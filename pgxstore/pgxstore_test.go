@@ -0,0 +1,194 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package pgxstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gem/sessions"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/valyala/fasthttp"
+)
+
+// newTestStore returns a store on the database given by the
+// PGXSTORE_TEST_DATABASE environment variable, or skips the test.
+func newTestStore(t *testing.T) *PgxStore {
+	dsn := os.Getenv("PGXSTORE_TEST_DATABASE")
+	if dsn == "" {
+		t.Skip("PGXSTORE_TEST_DATABASE is not set")
+	}
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatal("failed to connect", err)
+	}
+	t.Cleanup(pool.Close)
+
+	store := NewPgxStore(pool, []byte("some key"))
+	store.Table = "sessions_test"
+	store.Channel = "sessions_test"
+	if err = store.CreateTable(context.Background()); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	t.Cleanup(func() {
+		pool.Exec(context.Background(), "DROP TABLE sessions_test")
+	})
+	return store
+}
+
+// request returns a request context carrying the cookies sent in res.
+func request(res *fasthttp.RequestCtx, name string) *fasthttp.RequestCtx {
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey(name)
+	ctx := &fasthttp.RequestCtx{}
+	if res.Response.Header.Cookie(cookie) {
+		ctx.Request.Header.SetCookieBytesKV(cookie.Key(), cookie.Value())
+	}
+	return ctx
+}
+
+func TestPgxStore(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	ctx = request(ctx, "hello")
+	if session, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["name"] != "gopher" {
+		t.Fatalf("bad session: got %v, want name %q", session.Values, "gopher")
+	}
+
+	session.Options.MaxAge = -1
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, err = store.New(ctx, "hello"); !errors.Is(err, sessions.ErrSessionNotFound) {
+		t.Fatalf("bad error: got %v, want %v", err, sessions.ErrSessionNotFound)
+	}
+}
+
+func TestPgxStoreDeleteByUser(t *testing.T) {
+	store := newTestStore(t)
+
+	listenCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deleted := make(chan string, 2)
+	go store.Listen(listenCtx, func(key string) {
+		deleted <- key
+	})
+	// Give the listener some time to subscribe.
+	time.Sleep(100 * time.Millisecond)
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.SetUser("gopher")
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		ids[sessions.StorageKey(session.ID)] = true
+	}
+
+	if n, err := store.CountByUser("gopher"); err != nil || n != 2 {
+		t.Fatalf("bad count: got (%d, %v), want (2, nil)", n, err)
+	}
+	n, err := store.DeleteByUser("gopher")
+	if err != nil {
+		t.Fatal("failed to delete sessions", err)
+	}
+	if n != 2 {
+		t.Fatalf("bad deleted count: got %d, want %d", n, 2)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case key := <-deleted:
+			if !ids[key] {
+				t.Errorf("unexpected notification for session %q", key)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("missing notification of deleted session")
+		}
+	}
+}
+
+func TestPgxStoreDeleteWhere(t *testing.T) {
+	store := newTestStore(t)
+	users := []string{"gopher", "gopher", "someone else"}
+	requests := make([]*fasthttp.RequestCtx, len(users))
+	for i, userID := range users {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["userID"] = userID
+		if i == 0 {
+			session.SetUser(userID)
+		}
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		requests[i] = request(ctx, "hello")
+	}
+
+	n, err := store.DeleteWhere("hello", func(session *sessions.Session) bool {
+		return session.Values["userID"] == "gopher"
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("bad deleted count: got (%d, %v), want (2, nil)", n, err)
+	}
+	for i, ctx := range requests {
+		_, err = store.New(ctx, "hello")
+		if users[i] == "gopher" && !errors.Is(err, sessions.ErrSessionNotFound) {
+			t.Errorf("bad error loading deleted session: got %v, want %v", err, sessions.ErrSessionNotFound)
+		} else if users[i] != "gopher" && err != nil {
+			t.Errorf("failed to load session: %v", err)
+		}
+	}
+	if n, err = store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count after delete: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.DeleteWhere("other", func(*sessions.Session) bool { return true }); err != nil || n != 0 {
+		t.Fatalf("bad delete of another name: got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestPgxStoreList(t *testing.T) {
+	store := newTestStore(t)
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	key := sessions.StorageKey(session.ID)
+	keys, err := store.List(key[:4])
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("bad listed sessions: got %v, want [%s]", keys, key)
+	}
+}
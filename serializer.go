@@ -0,0 +1,416 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/gorilla/securecookie"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackSerializer encodes session values using MessagePack.
+//
+// It produces more compact payloads than gob, and they can be read from
+// other languages. Set it on a store with the Serializer method:
+//
+//	store.Serializer(sessions.MsgpackSerializer{})
+//
+// MessagePack is not as expressive as gob, be aware of the following
+// restrictions:
+//
+//   - Integers are decoded as int64 and floats as float64, both as values
+//     and as map keys, so store int64 keys to be able to look them up.
+//   - Complex numbers, channels and functions are not supported.
+//   - Structs are decoded as map[string]interface{} unless they are
+//     registered with RegisterMsgpack, the counterpart of gob.Register.
+type MsgpackSerializer struct{}
+
+// Serialize encodes a value using MessagePack.
+func (s MsgpackSerializer) Serialize(src interface{}) ([]byte, error) {
+	return msgpack.Marshal(src)
+}
+
+// Deserialize decodes a value using MessagePack.
+func (s MsgpackSerializer) Deserialize(src []byte, dst interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(src))
+	dec.UseLooseInterfaceDecoding(true)
+	return dec.Decode(dst)
+}
+
+// JSONSerializer encodes session values using JSON, e.g. for human-readable
+// session files, see FilesystemStore.FileSerializer.
+//
+// Unlike securecookie.JSONEncoder it supports the map[interface{}]interface{}
+// of session values, with the following restrictions:
+//
+//   - Keys must be strings.
+//   - Values are decoded as the generic JSON types: numbers as float64,
+//     objects as map[string]interface{} and arrays as []interface{}.
+type JSONSerializer struct{}
+
+// Serialize encodes a value using JSON.
+func (s JSONSerializer) Serialize(src interface{}) ([]byte, error) {
+	values, ok := src.(map[interface{}]interface{})
+	if !ok {
+		return json.Marshal(src)
+	}
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("sessions: JSON keys must be strings, got %T", k)
+		}
+		m[key] = v
+	}
+	return json.Marshal(m)
+}
+
+// Deserialize decodes a value using JSON.
+func (s JSONSerializer) Deserialize(src []byte, dst interface{}) error {
+	values, ok := dst.(*map[interface{}]interface{})
+	if !ok {
+		return json.Unmarshal(src, dst)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(src, &m); err != nil {
+		return err
+	}
+	if *values == nil {
+		*values = make(map[interface{}]interface{}, len(m))
+	}
+	for k, v := range m {
+		(*values)[k] = v
+	}
+	return nil
+}
+
+// StreamSerializer is implemented by serializers that can encode values to a
+// stream and decode them from one, without holding the whole encoding in
+// memory. FilesystemStore streams the session files to and from the disk
+// when its FileSerializer implements it, which pays off for large sessions.
+type StreamSerializer interface {
+	SerializeTo(w io.Writer, src interface{}) error
+	DeserializeFrom(r io.Reader, dst interface{}) error
+}
+
+// MigrateFunc converts data serialized with an older, or newer, version of
+// the session values to the current version, see VersionedSerializer.
+// Payloads written without a version header have version 0.
+type MigrateFunc func(version int, data []byte) ([]byte, error)
+
+// ErrVersionInvalid is returned by VersionedSerializer for a version out of
+// the range of the header.
+var ErrVersionInvalid = errors.New("sessions: invalid serialization version")
+
+// versionMagic starts the version header of VersionedSerializer. No gob,
+// JSON or MessagePack encoding of the session values starts with it.
+const versionMagic = 0x00
+
+// VersionedSerializer wraps a serializer to prepend a version header to the
+// serialized values, so that sessions written before a change of the types
+// stored in them can be migrated rather than failing to decode:
+//
+//	store.Serializer(sessions.VersionedSerializer{
+//		Serializer: sessions.GobSerializer{},
+//		Version:    2,
+//		Migrate:    migrateSession,
+//	})
+//
+// Payloads of another version than Version are passed to Migrate before
+// being deserialized; an error from Migrate fails the decoding, so that the
+// stores start a new session. Without Migrate they are deserialized as is.
+type VersionedSerializer struct {
+	// Serializer serializes the values after the header.
+	Serializer securecookie.Serializer
+	// Version is the version written in the header, from 1 to 255.
+	Version int
+	// Migrate, if set, converts the payloads of other versions.
+	Migrate MigrateFunc
+}
+
+// Serialize encodes a value with the inner serializer, after the version
+// header.
+func (s VersionedSerializer) Serialize(src interface{}) ([]byte, error) {
+	if s.Version < 1 || s.Version > 255 {
+		return nil, fmt.Errorf("%w: %d", ErrVersionInvalid, s.Version)
+	}
+	data, err := s.Serializer.Serialize(src)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{versionMagic, byte(s.Version)}, data...), nil
+}
+
+// Deserialize decodes a value with the inner serializer, migrating it first
+// if its version is not the current one.
+func (s VersionedSerializer) Deserialize(src []byte, dst interface{}) error {
+	version := 0
+	if len(src) >= 2 && src[0] == versionMagic {
+		version, src = int(src[1]), src[2:]
+	}
+	if version != s.Version && s.Migrate != nil {
+		var err error
+		if src, err = s.Migrate(version, src); err != nil {
+			return err
+		}
+	}
+	return s.Serializer.Deserialize(src, dst)
+}
+
+// Default limits of GobSerializer, generous enough for any reasonable
+// session.
+const (
+	DefaultMaxDecodeSize  = 8 << 20
+	DefaultMaxDecodeDepth = 64
+)
+
+// ErrDecodeLimit is returned by GobSerializer when decoding a value exceeding
+// its limits.
+var ErrDecodeLimit = errors.New("sessions: decoding limit exceeded")
+
+// GobSerializer encodes session values using gob, in the same format as
+// securecookie.GobEncoder unless Sorted is set. It implements
+// StreamSerializer, e.g. to stream large sessions with
+// FilesystemStore.FileSerializer.
+//
+// It limits the size and the nesting depth of the decoded values, to bound
+// the resources spent decoding adversarial input, e.g. a session signed with
+// a leaked old key. The codecs created by NewCodecs, and so by the store
+// constructors of this package and its subpackages, use it with the default
+// limits, as do DerivedCodec, Ed25519Codec and EnvelopeStore.
+//
+// The size is checked before decoding, but the depth only once the value is
+// decoded, so the size limit alone bounds the work spent decoding.
+type GobSerializer struct {
+	// MaxSize is the maximum length of the encoded values. Zero means
+	// DefaultMaxDecodeSize, and < 0 no limit.
+	MaxSize int
+	// MaxDepth is the maximum nesting depth of the decoded values, where
+	// the session values have a depth of 1 and each map, slice, array or
+	// struct in them adds one level. Zero means DefaultMaxDecodeDepth, and
+	// < 0 no limit.
+	MaxDepth int
+	// Sorted, if set, encodes the session values as a list of key and value
+	// pairs sorted by key, so that the same values always give the same
+	// encoding, see SignedCodec. Maps nested in the values are still
+	// encoded in random order by gob. Deserialize reads both encodings
+	// whatever Sorted, DeserializeFrom only the encoding of maps, so don't
+	// set it on a FileSerializer.
+	Sorted bool
+}
+
+// gobEntry is a session value encoded by GobSerializer with Sorted set.
+type gobEntry struct {
+	Key, Value interface{}
+}
+
+// Serialize encodes a value using gob.
+func (s GobSerializer) Serialize(src interface{}) ([]byte, error) {
+	if values, ok := src.(map[interface{}]interface{}); ok && s.Sorted {
+		src = sortedEntries(values)
+	}
+	var buf bytes.Buffer
+	if err := s.SerializeTo(&buf, src); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize decodes a value using gob.
+func (s GobSerializer) Deserialize(src []byte, dst interface{}) error {
+	if max := limit(s.MaxSize, DefaultMaxDecodeSize); max > 0 && len(src) > max {
+		return fmt.Errorf("%w: %d bytes, more than %d", ErrDecodeLimit, len(src), max)
+	}
+	values, ok := dst.(*map[interface{}]interface{})
+	if !ok {
+		return s.DeserializeFrom(bytes.NewReader(src), dst)
+	}
+	err := s.DeserializeFrom(bytes.NewReader(src), dst)
+	if err == nil || errors.Is(err, ErrDecodeLimit) {
+		return err
+	}
+	// Try the encoding of Sorted.
+	var entries []gobEntry
+	if s.DeserializeFrom(bytes.NewReader(src), &entries) != nil {
+		return err
+	}
+	if *values == nil {
+		*values = make(map[interface{}]interface{}, len(entries))
+	}
+	for _, e := range entries {
+		(*values)[e.Key] = e.Value
+	}
+	return nil
+}
+
+// sortedEntries returns the entries of values sorted by the type and the
+// formatted value of their keys.
+func sortedEntries(values map[interface{}]interface{}) []gobEntry {
+	entries := make([]gobEntry, 0, len(values))
+	order := make(map[interface{}]string, len(values))
+	for k, v := range values {
+		entries = append(entries, gobEntry{k, v})
+		order[k] = fmt.Sprintf("%T %v", k, k)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return order[entries[i].Key] < order[entries[j].Key]
+	})
+	return entries
+}
+
+// SerializeTo encodes a value to w using gob.
+func (s GobSerializer) SerializeTo(w io.Writer, src interface{}) error {
+	return gob.NewEncoder(w).Encode(src)
+}
+
+// DeserializeFrom decodes a value from r using gob.
+func (s GobSerializer) DeserializeFrom(r io.Reader, dst interface{}) error {
+	max := limit(s.MaxSize, DefaultMaxDecodeSize)
+	if max > 0 {
+		r = &limitedReader{r: r, n: max}
+	}
+	if err := gob.NewDecoder(r).Decode(dst); err != nil {
+		if lr, ok := r.(*limitedReader); ok && lr.n < 0 {
+			return fmt.Errorf("%w: more than %d bytes", ErrDecodeLimit, max)
+		}
+		return err
+	}
+	if max := limit(s.MaxDepth, DefaultMaxDecodeDepth); max > 0 && exceedsDepth(reflect.ValueOf(dst), max) {
+		return fmt.Errorf("%w: nested deeper than %d", ErrDecodeLimit, max)
+	}
+	return nil
+}
+
+// limit returns the limit n, or def if n is zero.
+func limit(n, def int) int {
+	if n == 0 {
+		return def
+	}
+	return n
+}
+
+// limitedReader reads at most n bytes from r, and then fails, leaving n < 0.
+type limitedReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		l.n = -1
+		return 0, ErrDecodeLimit
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= n
+	return n, err
+}
+
+// exceedsDepth reports whether v holds maps, slices, arrays or structs
+// nested more than depth levels, v being the first level.
+func exceedsDepth(v reflect.Value, depth int) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return false
+		}
+		return exceedsDepth(v.Elem(), depth)
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		if depth == 0 {
+			return true
+		}
+	default:
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if exceedsDepth(iter.Key(), depth-1) || exceedsDepth(iter.Value(), depth-1) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return false
+		}
+		for i := 0; i < v.Len(); i++ {
+			if exceedsDepth(v.Index(i), depth-1) {
+				return true
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if exceedsDepth(v.Field(i), depth-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RegisterMsgpack records a struct type, identified by the MessagePack
+// extension ID extID, so that its values keep their type when decoded by
+// MsgpackSerializer. As for gob.Register, value can be either a struct or a
+// pointer to a struct, and the same type must be registered with the same
+// ID by every reader of the sessions.
+//
+// All the fields of the struct must be exported. It panics if value is not
+// a struct.
+func RegisterMsgpack(extID int8, value interface{}) {
+	typ := reflect.TypeOf(value)
+	st := typ
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("sessions: RegisterMsgpack of non-struct type %s", typ))
+	}
+	fields := make([]reflect.StructField, st.NumField())
+	for i := range fields {
+		if fields[i] = st.Field(i); fields[i].PkgPath != "" {
+			panic(fmt.Sprintf("sessions: RegisterMsgpack of %s with unexported field %s",
+				typ, fields[i].Name))
+		}
+	}
+	// Values are converted to an unnamed struct type with the same fields
+	// to be encoded as plain structs, not as the registered extension.
+	plain := reflect.StructOf(fields)
+
+	msgpack.RegisterExtEncoder(extID, value, func(e *msgpack.Encoder, v reflect.Value) ([]byte, error) {
+		if v.Kind() == reflect.Ptr {
+			v = v.Elem()
+		}
+		return msgpack.Marshal(v.Convert(plain).Interface())
+	})
+	msgpack.RegisterExtDecoder(extID, value, func(d *msgpack.Decoder, v reflect.Value, extLen int) error {
+		b := make([]byte, extLen)
+		if err := d.ReadFull(b); err != nil {
+			return err
+		}
+		p := reflect.New(plain)
+		if err := (MsgpackSerializer{}).Deserialize(b, p.Interface()); err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(st))
+			}
+			v = v.Elem()
+		}
+		v.Set(p.Elem().Convert(st))
+		return nil
+	})
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func init() {
+	RegisterMsgpack(1, flashMessage{})
+}
+
+func TestMsgpackSerializer(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	store.Serializer(MsgpackSerializer{})
+
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.Values["name"] = "gopher"
+	session.Values[int64(42)] = int64(43)
+	session.Values["message"] = flashMessage{1, "bar"}
+	session.AddFlash("foo")
+	session.AddFlash(flashMessage{42, "foo"})
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey("session-key")
+	if !ctx.Response.Header.Cookie(cookie) {
+		t.Fatalf("The cookie has not been sent to client.")
+	}
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookieBytesKV(cookie.Key(), cookie.Value())
+	if session, err = store.New(ctx, "session-key"); err != nil {
+		t.Fatalf("Error decoding session: %v", err)
+	}
+
+	if v := session.Values["name"]; v != "gopher" {
+		t.Errorf("Expected %q; Got %#v", "gopher", v)
+	}
+	if v := session.Values[int64(42)]; v != int64(43) {
+		t.Errorf("Expected %d; Got %#v", 43, v)
+	}
+	if v, ok := session.Values["message"].(flashMessage); !ok || v.Type != 1 || v.Message != "bar" {
+		t.Errorf("Expected %#v; Got %#v", flashMessage{1, "bar"}, session.Values["message"])
+	}
+	flashes := session.Flashes()
+	if len(flashes) != 2 {
+		t.Fatalf("Expected flashes; Got %v", flashes)
+	}
+	if flashes[0] != "foo" {
+		t.Errorf("Expected foo; Got %#v", flashes[0])
+	}
+	if v, ok := flashes[1].(flashMessage); !ok || v.Type != 42 || v.Message != "foo" {
+		t.Errorf("Expected %#v; Got %#v", flashMessage{42, "foo"}, flashes[1])
+	}
+}
+
+func TestGobSerializerLimits(t *testing.T) {
+	RegisterTypes([]interface{}{})
+	nested := func(depth int) map[interface{}]interface{} {
+		var v interface{} = "leaf"
+		for i := 0; i < depth; i++ {
+			v = []interface{}{v}
+		}
+		return map[interface{}]interface{}{"nested": v}
+	}
+	var s GobSerializer
+	encoded, err := s.Serialize(nested(DefaultMaxDecodeDepth - 1))
+	if err != nil {
+		t.Fatalf("Error encoding values: %v", err)
+	}
+	var values map[interface{}]interface{}
+	if err = s.Deserialize(encoded, &values); err != nil {
+		t.Fatalf("Expected values within the limits to be decoded; Got %v", err)
+	}
+
+	encoded, err = s.Serialize(nested(DefaultMaxDecodeDepth))
+	if err != nil {
+		t.Fatalf("Error encoding values: %v", err)
+	}
+	if err = s.Deserialize(encoded, &values); !errors.Is(err, ErrDecodeLimit) {
+		t.Fatalf("Expected %v; Got %v", ErrDecodeLimit, err)
+	}
+	if err = (GobSerializer{MaxDepth: -1}).Deserialize(encoded, &values); err != nil {
+		t.Fatalf("Expected no depth limit; Got %v", err)
+	}
+
+	s.MaxSize = 64
+	encoded, err = s.Serialize(map[interface{}]interface{}{"name": strings.Repeat("x", 64)})
+	if err != nil {
+		t.Fatalf("Error encoding values: %v", err)
+	}
+	if err = s.Deserialize(encoded, &values); !errors.Is(err, ErrDecodeLimit) {
+		t.Fatalf("Expected %v; Got %v", ErrDecodeLimit, err)
+	}
+	if err = s.DeserializeFrom(strings.NewReader(string(encoded)), &values); !errors.Is(err, ErrDecodeLimit) {
+		t.Fatalf("Expected %v; Got %v", ErrDecodeLimit, err)
+	}
+
+	// The stores decode with the default limits.
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	for _, store := range []*CookieStore{
+		NewCookieStore([]byte("secret-key")),
+		NewDerivedCookieStore([]byte("secret-key-0123456")),
+		NewCookieStoreEd25519(priv, pub),
+	} {
+		cookie, err := EncodeSession(store, "session-key", nested(DefaultMaxDecodeDepth))
+		if err != nil {
+			t.Fatalf("Error encoding session: %v", err)
+		}
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetCookie("session-key", cookie)
+		if _, err = store.New(ctx, "session-key"); err == nil {
+			t.Fatalf("%T: Expected an error decoding a session nested too deeply", store.Codecs[0])
+		}
+	}
+}
+
+func TestVersionedSerializer(t *testing.T) {
+	v1 := NewCookieStore([]byte("secret-key"))
+	v1.Serializer(VersionedSerializer{Serializer: GobSerializer{}, Version: 1})
+	cookie, err := EncodeSession(v1, "session-key", map[interface{}]interface{}{"name": "gopher"})
+	if err != nil {
+		t.Fatalf("Error encoding session: %v", err)
+	}
+
+	// Version 2 renamed name to first_name.
+	var migrated []int
+	v2 := NewCookieStore([]byte("secret-key"))
+	v2.Serializer(VersionedSerializer{
+		Serializer: GobSerializer{},
+		Version:    2,
+		Migrate: func(version int, data []byte) ([]byte, error) {
+			migrated = append(migrated, version)
+			var values map[interface{}]interface{}
+			if err := (GobSerializer{}).Deserialize(data, &values); err != nil {
+				return nil, err
+			}
+			if name, ok := values["name"]; ok {
+				values["first_name"] = name
+				delete(values, "name")
+			}
+			return GobSerializer{}.Serialize(values)
+		},
+	})
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("session-key", cookie)
+	session, err := v2.New(ctx, "session-key")
+	if err != nil {
+		t.Fatalf("Error decoding session: %v", err)
+	}
+	if _, ok := session.Values["name"]; ok || session.Values["first_name"] != "gopher" {
+		t.Fatalf("Expected the session to be migrated; Got %v", session.Values)
+	}
+	if len(migrated) != 1 || migrated[0] != 1 {
+		t.Fatalf("Expected a migration from version 1; Got %v", migrated)
+	}
+
+	// Current payloads are not migrated, payloads without header are v0.
+	if cookie, err = EncodeSession(v2, "session-key", session.Values); err != nil {
+		t.Fatalf("Error encoding session: %v", err)
+	}
+	ctx.Request.Header.SetCookie("session-key", cookie)
+	if _, err = v2.New(ctx, "session-key"); err != nil || len(migrated) != 1 {
+		t.Fatalf("Expected the current version to be decoded as is; Got %v, %v", migrated, err)
+	}
+	if cookie, err = EncodeSession(NewCookieStore([]byte("secret-key")), "session-key", session.Values); err != nil {
+		t.Fatalf("Error encoding session: %v", err)
+	}
+	ctx.Request.Header.SetCookie("session-key", cookie)
+	if _, err = v2.New(ctx, "session-key"); err != nil || len(migrated) != 2 || migrated[1] != 0 {
+		t.Fatalf("Expected a migration from version 0; Got %v, %v", migrated, err)
+	}
+}
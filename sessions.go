@@ -5,16 +5,88 @@
 package sessions
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gorilla/securecookie"
 	"github.com/valyala/fasthttp"
 )
 
-// Default flashes key.
-const flashesKey = "_flash"
+// DefaultFlashKey is the flashes key used by Session.Flashes and
+// Session.AddFlash when they are called without a key.
+//
+// Changing it does not affect calls passing a key explicitly. Set it once at
+// initialization, before handling requests, as it is not safe to change it
+// concurrently and flashes stored under the previous key are not moved.
+var DefaultFlashKey = "_flash"
+
+// MaxFlashes, if > 0, is the maximum number of flash messages stored under a
+// key: AddFlash drops the oldest ones beyond it, to guard against runaway
+// accumulation growing the session until it can't be saved. The default, 0,
+// means no limit. Set it once at initialization, like DefaultFlashKey.
+var MaxFlashes int
+
+// FlashSerializer, if set, serializes the flash messages stored by AddFlash
+// into a single []byte value of the session, e.g. securecookie.JSONEncoder
+// for string messages, so that their types don't need to be registered in
+// encoding/gob. The default, nil, stores the messages as an []interface{}.
+// Set it once at initialization, like DefaultFlashKey: both formats are read
+// back, but messages stored with it can't be read once it is unset.
+var FlashSerializer securecookie.Serializer
+
+// TrackLastAccess, if set, makes sessions record the time they are loaded,
+// see Session.LastAccessedAt, e.g. to expire idle sessions or count the
+// active users. Set it once at initialization, like DefaultFlashKey.
+//
+// The time is stored in the session values when the session is got from the
+// registry, and only persisted when the session is saved: requests that don't
+// save it are not recorded, and no write is added to reads. As the values
+// change on every request, it defeats CookieStore.SkipUnchanged.
+var TrackLastAccess bool
+
+// Key of the user ID tagged on a session.
+const userKey = "_user"
+
+// Key of the CSRF token of a session.
+const csrfKey = "_csrf"
+
+// Keys of the number of saves and of the time of the last ID rotation of a
+// session, see FilesystemStore.RotateEvery.
+const (
+	rotateCountKey = "_rotate_count"
+	rotatedAtKey   = "_rotated_at"
+)
+
+// Key of the client fingerprint of a session, see CookieStore.BindTo.
+const bindKey = "_bind"
+
+// Key of the expiration times of the values stored by Session.SetWithTTL.
+const ttlKey = "_ttl"
+
+// Key of the version of a session, see FilesystemStore.CheckVersion.
+const versionKey = "_version"
+
+// Key of the last access time of a session, see TrackLastAccess.
+const lastAccessedKey = "_last_accessed"
+
+// Prefix of the keys of the values stored by Session.SetSecure.
+const secureKeyPrefix = "_secure:"
+
+var errNoValueCodecs = errors.New("sessions: the store does not support secure values")
 
 // Options
 
@@ -27,19 +99,64 @@ type Options struct {
 	// MaxAge=0 means no 'Max-Age' attribute specified.
 	// MaxAge<0 means delete cookie now, equivalently 'Max-Age: 0'.
 	// MaxAge>0 means Max-Age attribute present and given in seconds.
+	// See MakeSessionCookie, MakePersistent and MakeDelete to set it by
+	// intent.
 	MaxAge   int
 	Secure   bool
 	HttpOnly bool
+	// SameSite sets the 'SameSite' attribute, e.g.
+	// fasthttp.CookieSameSiteNoneMode for cross-site contexts. The default,
+	// fasthttp.CookieSameSiteDisabled, omits it.
+	SameSite fasthttp.CookieSameSite
+	// Partitioned adds the 'Partitioned' attribute (CHIPS) so the cookie is
+	// kept in a per top-level site jar, e.g. for cross-site iframes.
+	// Browsers only accept partitioned cookies that are also Secure and
+	// SameSite=None, so setting it forces Secure and a Path of "/".
+	Partitioned bool
+	// ExpirySkew is added to the Expires attribute computed from MaxAge > 0,
+	// so that clients with a clock slightly ahead don't drop the cookie
+	// before its time. Zero, the default, adds nothing.
+	ExpirySkew time.Duration
+	// Priority adds the 'Priority' attribute, one of "Low", "Medium" or
+	// "High", which Chromium uses to choose the cookies evicted first when
+	// a site sets too many. Empty, the default, omits it. fasthttp.Cookie
+	// has no such attribute, so it is only sent by SetCookie.
+	Priority string
+}
+
+// MakeSessionCookie makes the cookie a session cookie, without expiration
+// time, which browsers drop when they are closed. The session is still
+// stored by server-side stores for the MaxAge of the store.
+func (o *Options) MakeSessionCookie() {
+	o.MaxAge = 0
+}
+
+// MakePersistent makes the cookie expire after d, sent as an Expires
+// attribute so that all browsers understand it. d is rounded up to a whole
+// number of seconds, and at least one second.
+func (o *Options) MakePersistent(d time.Duration) {
+	o.MaxAge = int((d + time.Second - 1) / time.Second)
+	if o.MaxAge < 1 {
+		o.MaxAge = 1
+	}
+}
+
+// MakeDelete makes Save delete the session: the cookie is expired, and
+// server-side stores remove the stored session.
+func (o *Options) MakeDelete() {
+	o.MaxAge = -1
 }
 
 // Session
 
 // NewSession is called by session stores to create a new session instance.
 func NewSession(store Store, name string) *Session {
+	registerGobTypes()
 	return &Session{
 		Values: make(map[interface{}]interface{}),
 		store:  store,
 		name:   name,
+		codec:  -1,
 	}
 }
 
@@ -49,45 +166,529 @@ type Session struct {
 	// user data.
 	ID string
 	// Values contains the user-data for the session.
-	Values  map[interface{}]interface{}
+	Values map[interface{}]interface{}
+	// Options are the cookie options of the session. Stores set them to a
+	// copy of their defaults in New, so changing the defaults of a store
+	// doesn't affect sessions already loaded, and handlers can change them
+	// for a single session. Set them to nil to use the defaults of the
+	// store at the time of Save instead.
 	Options *Options
 	IsNew   bool
 	store   Store
 	name    string
+	// loaded is a copy of the session as decoded by stores tracking
+	// changes, see CookieStore.SkipUnchanged.
+	loaded *loadedSession
+	// typed caches the values converted by Typed.
+	typed map[string]typedValue
+	// lazy, if set, loads the session on first access, see LazyStore, and
+	// lazyErr is the error it returned.
+	lazy    func() error
+	lazyErr error
+	// codec is the index of the codec that decoded the session, see
+	// CodecIndex.
+	codec int
+	// lastAccessed is the previous access time of the session, see
+	// LastAccessedAt.
+	lastAccessed time.Time
+}
+
+// typedValue stores a value converted by Session.Typed, along with the raw
+// value it was converted from.
+type typedValue struct {
+	raw   interface{}
+	value interface{}
+}
+
+// loadedSession stores a copy of the values and options of a session, and
+// its ID for server-side stores.
+type loadedSession struct {
+	values  map[interface{}]interface{}
+	options Options
+	id      string
 }
 
 // Flashes returns a slice of flash messages from the session.
 //
 // A single variadic argument is accepted, and it is optional: it defines
-// the flash key. If not defined "_flash" is used by default.
+// the flash key. If not defined DefaultFlashKey is used.
 func (s *Session) Flashes(vars ...string) []interface{} {
+	s.Load()
 	var flashes []interface{}
-	key := flashesKey
+	key := DefaultFlashKey
 	if len(vars) > 0 {
 		key = vars[0]
 	}
-	if v, ok := s.Values[key]; ok {
+	if _, ok := s.Values[key]; ok {
 		// Drop the flashes and return it.
+		flashes = s.flashes(key)
 		delete(s.Values, key)
-		flashes = v.([]interface{})
 	}
 	return flashes
 }
 
+// FlashesAndRequeue returns the flash messages of the session for which
+// filter returns true, and keeps the others for a later request, in order.
+// This is the same as Flashes followed by AddFlash for the messages to keep,
+// in a single step.
+//
+// A single variadic argument is accepted, and it is optional: it defines
+// the flash key. If not defined DefaultFlashKey is used.
+func (s *Session) FlashesAndRequeue(filter func(interface{}) bool, vars ...string) []interface{} {
+	s.Load()
+	key := DefaultFlashKey
+	if len(vars) > 0 {
+		key = vars[0]
+	}
+	if _, ok := s.Values[key]; !ok {
+		return nil
+	}
+	var consumed, kept []interface{}
+	for _, flash := range s.flashes(key) {
+		if filter(flash) {
+			consumed = append(consumed, flash)
+		} else {
+			kept = append(kept, flash)
+		}
+	}
+	if len(kept) == 0 {
+		delete(s.Values, key)
+	} else {
+		s.setFlashes(key, kept)
+	}
+	return consumed
+}
+
 // AddFlash adds a flash message to the session.
 //
 // A single variadic argument is accepted, and it is optional: it defines
-// the flash key. If not defined "_flash" is used by default.
+// the flash key. If not defined DefaultFlashKey is used.
 func (s *Session) AddFlash(value interface{}, vars ...string) {
-	key := flashesKey
+	s.Load()
+	key := DefaultFlashKey
 	if len(vars) > 0 {
 		key = vars[0]
 	}
-	var flashes []interface{}
+	s.setFlashes(key, append(s.flashes(key), value))
+}
+
+// setFlashes stores flashes under key, keeping the last MaxFlashes ones.
+func (s *Session) setFlashes(key string, flashes []interface{}) {
+	if MaxFlashes > 0 && len(flashes) > MaxFlashes {
+		flashes = append([]interface{}(nil), flashes[len(flashes)-MaxFlashes:]...)
+	}
+	if FlashSerializer == nil {
+		s.Values[key] = flashes
+	} else if b, err := FlashSerializer.Serialize(flashes); err == nil {
+		s.Values[key] = b
+	}
+}
+
+// flashes returns the flash messages stored under key, serialized with
+// FlashSerializer or not.
+func (s *Session) flashes(key string) []interface{} {
+	switch v := s.Values[key].(type) {
+	case []interface{}:
+		return v
+	case []byte:
+		var flashes []interface{}
+		if FlashSerializer != nil && FlashSerializer.Deserialize(v, &flashes) == nil {
+			return flashes
+		}
+	}
+	return nil
+}
+
+// Merge copies the values of other into the session, e.g. to keep the cart
+// of an anonymous session after login. Values already in the session are
+// replaced only if overwrite is true.
+//
+// Flash messages, stored under DefaultFlashKey or the keys of Flash, are
+// appended to the flash messages of the session instead, in order.
+func (s *Session) Merge(other *Session, overwrite bool) {
+	s.Load()
+	other.Load()
+	for k, v := range other.Values {
+		if key, ok := k.(string); ok && isFlashKey(key) {
+			flashes := append([]interface{}(nil), s.flashes(key)...)
+			s.setFlashes(key, append(flashes, other.flashes(key)...))
+			continue
+		}
+		if _, ok := s.Values[k]; ok && !overwrite {
+			continue
+		}
+		s.Values[k] = v
+	}
+}
+
+// isFlashKey reports whether key is DefaultFlashKey or a key of Flash.
+func isFlashKey(key string) bool {
+	return key == DefaultFlashKey || strings.HasPrefix(key, DefaultFlashKey+":")
+}
+
+// GetDefault returns the value stored in the session for key, or def if
+// there is none. A nil value stored for key is returned as is.
+func (s *Session) GetDefault(key, def interface{}) interface{} {
+	s.Load()
+	s.expire()
 	if v, ok := s.Values[key]; ok {
-		flashes = v.([]interface{})
+		return v
+	}
+	return def
+}
+
+// Get returns the value stored in the session for key, or nil if there is
+// none.
+//
+// Unlike reading Values directly, Get and the other methods of Session load
+// lazy sessions first, see LazyStore.
+func (s *Session) Get(key interface{}) interface{} {
+	return s.GetDefault(key, nil)
+}
+
+// Set stores value in the session for key.
+func (s *Session) Set(key, value interface{}) {
+	s.Load()
+	s.Values[key] = value
+}
+
+// Delete removes the value stored in the session for key.
+func (s *Session) Delete(key interface{}) {
+	s.Load()
+	delete(s.Values, key)
+}
+
+// Load loads a lazy session from the underlying store, see LazyStore, and
+// returns the error returned by the store. It does nothing and returns nil
+// for other sessions, which are loaded by the store right away.
+func (s *Session) Load() error {
+	if s.lazy != nil {
+		load := s.lazy
+		s.lazy = nil
+		s.lazyErr = load()
+		s.expire()
+		s.touch()
+	}
+	return s.lazyErr
+}
+
+// LastAccessedAt returns the time the session was last loaded by a request
+// that saved it, before the current one, with a precision of one second. It
+// returns the zero time for new sessions, and if TrackLastAccess is not set.
+func (s *Session) LastAccessedAt() time.Time {
+	s.Load()
+	return s.lastAccessed
+}
+
+// touch keeps the previous access time of the session and stores the current
+// one in its values, if TrackLastAccess is set. Lazy sessions are left
+// untouched until loaded.
+func (s *Session) touch() {
+	if !TrackLastAccess || s.lazy != nil {
+		return
+	}
+	if t := valueInt64(s.Values[lastAccessedKey]); t > 0 {
+		s.lastAccessed = time.Unix(t, 0)
+	}
+	s.Values[lastAccessedKey] = time.Now().Unix()
+}
+
+// Typed stores the value of the session for key into the value pointed to
+// by into, e.g. a **User, and caches the result, so that the value is only
+// type-asserted or converted once per request.
+//
+// Values assignable to the type pointed to by into are assigned as is.
+// Others, such as the generic maps returned by some serializers, are
+// converted through JSON. It returns an error if there is no value for key
+// or if it can't be converted.
+//
+// The cache belongs to the session instance: it is dropped with the session
+// registry at the end of the request, see Clear, and an entry is not reused
+// once another value is stored for its key.
+func (s *Session) Typed(key string, into interface{}) error {
+	s.Load()
+	dst := reflect.ValueOf(into)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return fmt.Errorf("sessions: Typed into non-pointer %T", into)
+	}
+	dst = dst.Elem()
+	raw, ok := s.Values[key]
+	if !ok {
+		return fmt.Errorf("sessions: no value for key %q", key)
+	}
+	if c, ok := s.typed[key]; ok && sameValue(c.raw, raw) &&
+		reflect.TypeOf(c.value) == dst.Type() {
+		dst.Set(reflect.ValueOf(c.value))
+		return nil
+	}
+	if v := reflect.ValueOf(raw); v.IsValid() && v.Type().AssignableTo(dst.Type()) {
+		dst.Set(v)
+	} else {
+		b, err := json.Marshal(raw)
+		if err == nil {
+			err = json.Unmarshal(b, into)
+		}
+		if err != nil {
+			return fmt.Errorf("sessions: cannot convert value for key %q to %s: %w",
+				key, dst.Type(), err)
+		}
+	}
+	if s.typed == nil {
+		s.typed = make(map[string]typedValue)
+	}
+	s.typed[key] = typedValue{raw: raw, value: dst.Interface()}
+	return nil
+}
+
+// sameValue reports whether a and b are the same value: equal values of a
+// comparable type, or references to the same data.
+func sameValue(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() || va.Type() != vb.Type() {
+		return false
+	}
+	switch va.Kind() {
+	case reflect.Map, reflect.Ptr:
+		return va.Pointer() == vb.Pointer()
+	case reflect.Slice:
+		return va.Pointer() == vb.Pointer() && va.Len() == vb.Len()
+	}
+	return va.Type().Comparable() && a == b
+}
+
+// SetWithTTL stores value in the session for key until ttl elapsed, e.g. for
+// a one-time verification code, independently of the session lifetime.
+//
+// Expired values are removed from Values when the session is registered,
+// see Registry.Get, and by GetDefault. The expiration times are stored in
+// the session values too, and storing the key again with SetWithTTL
+// replaces its expiration time.
+func (s *Session) SetWithTTL(key, value interface{}, ttl time.Duration) {
+	s.Load()
+	s.Values[key] = value
+	entries, _ := s.Values[ttlKey].([]interface{})
+	var kept []interface{}
+	for i := 0; i+1 < len(entries); i += 2 {
+		if entries[i] != key {
+			kept = append(kept, entries[i], entries[i+1])
+		}
+	}
+	s.Values[ttlKey] = append(kept, key, time.Now().Add(ttl).UnixNano())
+}
+
+// expire removes the expired values stored by SetWithTTL. Lazy sessions are
+// left untouched until loaded.
+func (s *Session) expire() {
+	if s.lazy != nil {
+		return
+	}
+	entries, ok := s.Values[ttlKey].([]interface{})
+	if !ok {
+		return
+	}
+	now := time.Now().UnixNano()
+	var kept []interface{}
+	for i := 0; i+1 < len(entries); i += 2 {
+		if valueInt64(entries[i+1]) <= now {
+			delete(s.Values, entries[i])
+		} else {
+			kept = append(kept, entries[i], entries[i+1])
+		}
+	}
+	if len(kept) == 0 {
+		delete(s.Values, ttlKey)
+	} else {
+		s.Values[ttlKey] = kept
+	}
+}
+
+// SetSecure stores value in the session for key encrypted on its own with the
+// value codecs of the store, e.g. to encrypt a sensitive token in a session
+// that is only signed otherwise. See CookieStore.ValueCodecs.
+//
+// The encrypted value is stored under a key derived from key, read it back
+// with GetSecure. It returns an error if the store has no value codecs.
+func (s *Session) SetSecure(key string, value interface{}) error {
+	s.Load()
+	codecs := secureCodecs(s.store)
+	if len(codecs) == 0 {
+		return errNoValueCodecs
+	}
+	encoded, err := securecookie.EncodeMulti(s.name+":"+key, value, codecs...)
+	if err != nil {
+		return err
+	}
+	s.Values[secureKeyPrefix+key] = encoded
+	return nil
+}
+
+// GetSecure decrypts the value stored for key by SetSecure into dst, a
+// pointer to a value of the stored type. Values are only decrypted when
+// requested.
+//
+// It returns an error if there is no secure value for key.
+func (s *Session) GetSecure(key string, dst interface{}) error {
+	s.Load()
+	encoded, ok := s.Values[secureKeyPrefix+key].(string)
+	if !ok {
+		return fmt.Errorf("sessions: no secure value for key %q", key)
+	}
+	codecs := secureCodecs(s.store)
+	if len(codecs) == 0 {
+		return errNoValueCodecs
+	}
+	return securecookie.DecodeMulti(s.name+":"+key, encoded, dst, codecs...)
+}
+
+// SetUser tags the session with the ID of the user that owns it.
+//
+// Server-side stores index tagged sessions on Save, so all the sessions of a
+// user can be removed at once, e.g. with FilesystemStore.DeleteByUser. A
+// session tagged with another user leaves the index of the previous one on
+// its next Save.
+func (s *Session) SetUser(userID string) {
+	s.Load()
+	s.Values[userKey] = userID
+}
+
+// User returns the user ID tagged on the session, or an empty string if the
+// session is not tagged.
+func (s *Session) User() string {
+	s.Load()
+	userID, _ := s.Values[userKey].(string)
+	return userID
+}
+
+// CSRFToken returns the CSRF token bound to the session, generating a random
+// one on the first call. The token is stored in the session values, so the
+// session must be saved to keep it across requests, and it lasts until the
+// session is destroyed.
+//
+// It returns an empty string if the token could not be generated.
+func (s *Session) CSRFToken() string {
+	s.Load()
+	if token, ok := s.Values[csrfKey].(string); ok && token != "" {
+		return token
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	s.Values[csrfKey] = token
+	return token
+}
+
+// ValidateCSRF reports whether token matches the CSRF token bound to the
+// session, see CSRFToken. The comparison is done in constant time.
+func (s *Session) ValidateCSRF(token string) bool {
+	s.Load()
+	expected, _ := s.Values[csrfKey].(string)
+	if expected == "" || token == "" {
+		return false
+	}
+	return SecureCompare(expected, token)
+}
+
+// Dump returns a human-readable representation of the session values, with
+// keys sorted and the flashes under DefaultFlashKey marked as such.
+//
+// It is meant for logging and debugging only, don't use it in hot paths.
+func (s *Session) Dump() string {
+	s.Load()
+	lines := make([]string, 0, len(s.Values))
+	for k, v := range s.Values {
+		line := fmt.Sprintf("%#v", k)
+		if k == DefaultFlashKey {
+			line += " (flashes)"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %#v", line, v))
+	}
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "session %q (ID %q, IsNew %t)", s.name, s.ID, s.IsNew)
+	for _, line := range lines {
+		buf.WriteString("\n\t")
+		buf.WriteString(line)
+	}
+	return buf.String()
+}
+
+// EmptySessionHash is the hash returned by Session.Hash for sessions without
+// values, e.g. anonymous sessions.
+const EmptySessionHash = "empty"
+
+// hashIgnoredKeys are the keys of the bookkeeping values changing without
+// the contents of a session, which are not hashed by Session.Hash.
+var hashIgnoredKeys = map[interface{}]bool{
+	lastAccessedKey: true,
+	rotateCountKey:  true,
+	rotatedAtKey:    true,
+	versionKey:      true,
+}
+
+// Hash returns a stable hash of the session values, e.g. as a component of
+// the cache key of an edge cache that must vary on the session: the hex
+// SHA-256 of their JSONSerializer encoding, or EmptySessionHash if the
+// session has no values. The bookkeeping values updated by the stores, such
+// as the last access time, are ignored.
+//
+// The hash is only stable if the encoding is deterministic: JSONSerializer
+// writes map keys in sorted order, but the keys of the session must be
+// strings and the values must encode to JSON the same way every time. It
+// returns an empty string for values that can't be encoded, e.g. with keys
+// that are not strings.
+func (s *Session) Hash() string {
+	s.Load()
+	values := make(map[interface{}]interface{}, len(s.Values))
+	for k, v := range s.Values {
+		if !hashIgnoredKeys[k] {
+			values[k] = v
+		}
+	}
+	if len(values) == 0 {
+		return EmptySessionHash
 	}
-	s.Values[key] = append(flashes, value)
+	b, err := JSONSerializer{}.Serialize(values)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Flash returns the queue of flash messages of the given category, e.g.
+// "form-errors" or "notices", so several independent flash streams can be
+// managed in a session.
+//
+// The messages of a category are stored under DefaultFlashKey followed by a
+// colon and the category, so they can also be accessed with Flashes and
+// AddFlash using that key.
+func (s *Session) Flash(category string) *FlashQueue {
+	return &FlashQueue{session: s, key: DefaultFlashKey + ":" + category}
+}
+
+// FlashQueue is a queue of flash messages of a session, see Session.Flash.
+type FlashQueue struct {
+	session *Session
+	key     string
+}
+
+// Add adds a flash message to the queue.
+func (q *FlashQueue) Add(value interface{}) {
+	q.session.AddFlash(value, q.key)
+}
+
+// Drain returns the flash messages of the queue and removes them.
+func (q *FlashQueue) Drain() []interface{} {
+	return q.session.Flashes(q.key)
+}
+
+// Peek returns the flash messages of the queue without removing them.
+func (q *FlashQueue) Peek() []interface{} {
+	q.session.Load()
+	return append([]interface{}(nil), q.session.flashes(q.key)...)
 }
 
 // Save is a convenience method to save this session. It is the same as calling
@@ -97,6 +698,36 @@ func (s *Session) Save(ctx *fasthttp.RequestCtx) error {
 	return s.store.Save(ctx, s)
 }
 
+// FlashAndRedirect adds message as a flash under DefaultFlashKey, saves the
+// session and redirects to location with the given status code, for the
+// common flash-then-redirect flow, e.g. after a form post:
+//
+//	return session.FlashAndRedirect(ctx, "Saved!", "/items", fasthttp.StatusSeeOther)
+//
+// The session is saved before the redirect is written; if saving fails it
+// returns the error without redirecting. Codes other than 301, 302, 303, 307
+// and 308 are replaced with 302 by fasthttp.
+func (s *Session) FlashAndRedirect(ctx *fasthttp.RequestCtx, message, location string, code int) error {
+	s.AddFlash(message)
+	if err := s.Save(ctx); err != nil {
+		return err
+	}
+	ctx.Redirect(location, code)
+	return nil
+}
+
+// CodecIndex returns the index of the codec, or key pair, that decoded the
+// session from the request, e.g. to monitor how many requests still use an
+// old key pair before retiring it. It is only read by CookieStore and
+// FilesystemStore, and it returns -1 for new sessions and sessions read from
+// a fallback name.
+//
+// Sessions decoded with an old codec are encoded with the first one by their
+// next Save, even if they are unchanged.
+func (s *Session) CodecIndex() int {
+	return s.codec
+}
+
 // Name returns the name used to register the session.
 func (s *Session) Name() string {
 	return s.name
@@ -111,8 +742,9 @@ func (s *Session) Store() Store {
 
 // sessionInfo stores a session tracked by the registry.
 type sessionInfo struct {
-	s *Session
-	e error
+	s     *Session
+	e     error
+	store Store // store that registered the session
 }
 
 var (
@@ -123,6 +755,18 @@ var (
 	}
 )
 
+// OnRegistryOpen and OnRegistryClose, if set, are called with the request
+// when a registry is created for it by GetRegistry, and when it is closed by
+// Clear, e.g. to check in tests that every registry is closed or to profile
+// the use of sessions. They are called synchronously on the hot path, so
+// keep them cheap; OnRegistryClose is called with the lock of Clear held
+// and must not call the functions of this package. Set them once at
+// initialization, like DefaultFlashKey.
+var (
+	OnRegistryOpen  func(ctx *fasthttp.RequestCtx)
+	OnRegistryClose func(ctx *fasthttp.RequestCtx)
+)
+
 // GetRegistry returns a registry instance for the current request.
 func GetRegistry(ctx *fasthttp.RequestCtx) (registry *Registry) {
 	if registry = Get(ctx); registry != nil {
@@ -131,7 +775,11 @@ func GetRegistry(ctx *fasthttp.RequestCtx) (registry *Registry) {
 	registry = registryPool.Get().(*Registry)
 	registry.ctx = ctx
 	registry.sessions = make(map[string]sessionInfo)
+	registry.skipAutoSave = false
 	Set(ctx, registry)
+	if OnRegistryOpen != nil {
+		OnRegistryOpen(ctx)
+	}
 	return
 }
 
@@ -139,26 +787,79 @@ func GetRegistry(ctx *fasthttp.RequestCtx) (registry *Registry) {
 type Registry struct {
 	ctx      *fasthttp.RequestCtx
 	sessions map[string]sessionInfo
+	// skipAutoSave disables AutoSaveHandler for the request.
+	skipAutoSave bool
 }
 
 // Get registers and returns a session for the given name and session store.
 //
 // It returns a new session if there are no sessions registered for the name.
+//
+// Sessions are registered by name only, and a name must be used with a
+// single store during a request. If the session for the name was registered
+// with another store, e.g. by a middleware constructing its own store, Get
+// logs a warning and returns the registered session, still bound to the store
+// that registered it, along with ErrStoreMismatch.
+//
+// The name must be a valid cookie name, unless the store sends sessions in a
+// header, see CookieStore.TokenHeader, in which case any non-empty name is
+// accepted.
 func (r *Registry) Get(store Store, name string) (session *Session, err error) {
-	if !isCookieNameValid(name) {
+	if tokenHeader(store) != "" {
+		if name == "" {
+			return nil, errors.New("sessions: empty session name")
+		}
+	} else if !isCookieNameValid(name) {
 		return nil, fmt.Errorf("sessions: invalid character in cookie name: %s", name)
 	}
 	if info, ok := r.sessions[name]; ok {
+		if !sameStore(info.store, store) {
+			log.Printf("sessions: session %q used with a %T other than the %T it was registered with",
+				name, store, info.store)
+			return info.s, ErrStoreMismatch
+		}
 		session, err = info.s, info.e
 	} else {
 		session, err = store.New(r.ctx, name)
 		session.name = name
-		r.sessions[name] = sessionInfo{s: session, e: err}
+		session.expire()
+		session.touch()
+		r.sessions[name] = sessionInfo{s: session, e: err, store: store}
 	}
 	session.store = store
 	return
 }
 
+// sameStore reports whether a and b are the same store. Stores of
+// non-comparable types are compared with reflect.DeepEqual.
+func sameStore(a, b Store) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb {
+		return false
+	}
+	if ta != nil && !ta.Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
+// Delete removes the session registered for the given name from the
+// registry, so it is not saved by Save or AutoSaveHandler. The stored session
+// is left untouched; a later Get loads it again from the store.
+func (r *Registry) Delete(name string) {
+	delete(r.sessions, name)
+}
+
+// ForEach calls fn for each session registered for the current request, with
+// the error returned when it was loaded. The order is not specified.
+//
+// The sessions may be modified by fn, changes are persisted by Save.
+func (r *Registry) ForEach(fn func(name string, s *Session, err error)) {
+	for name, info := range r.sessions {
+		fn(name, info.s, info.e)
+	}
+}
+
 // Save saves all sessions registered for the current request.
 func (r *Registry) Save() error {
 	var errMulti MultiError
@@ -169,7 +870,7 @@ func (r *Registry) Save() error {
 				"sessions: missing store for session %q", name))
 		} else if err := session.store.Save(r.ctx, session); err != nil {
 			errMulti = append(errMulti, fmt.Errorf(
-				"sessions: error saving session %q -- %v", name, err))
+				"sessions: error saving session %q -- %w", name, err))
 		}
 	}
 	if errMulti != nil {
@@ -178,16 +879,111 @@ func (r *Registry) Save() error {
 	return nil
 }
 
-// close put the registry instance into pool for reusing.
+// DeleteAll deletes all sessions registered for the current request.
+//
+// Each session is saved with Options.MaxAge = -1, so the cookie is expired
+// and server-side stores remove the stored session. Sessions with nil
+// Options get a copy of the default options of their store first, so that
+// the cookie is expired with the Path and Domain it was set with.
+func (r *Registry) DeleteAll() error {
+	var errMulti MultiError
+	for name, info := range r.sessions {
+		session := info.s
+		if session.store == nil {
+			errMulti = append(errMulti, fmt.Errorf(
+				"sessions: missing store for session %q", name))
+			continue
+		}
+		session.Load()
+		if session.Options == nil {
+			session.Options = deleteOptions(r.ctx, session)
+		}
+		session.Options.MaxAge = -1
+		if err := session.store.Save(r.ctx, session); err != nil {
+			errMulti = append(errMulti, fmt.Errorf(
+				"sessions: error deleting session %q -- %w", name, err))
+		}
+	}
+	if errMulti != nil {
+		return errMulti
+	}
+	return nil
+}
+
+// deleteOptions returns a copy of the default options of the store of
+// session, taken from a new session of the store, so that the cookie deleting
+// it has the Path and Domain of the cookie to delete.
+func deleteOptions(ctx *fasthttp.RequestCtx, session *Session) *Options {
+	fresh, _ := session.store.New(ctx, session.Name())
+	if fresh != nil {
+		fresh.Load()
+		if fresh.Options != nil {
+			opts := *fresh.Options
+			return &opts
+		}
+	}
+	return &Options{Path: "/"}
+}
+
+// close put the registry instance into pool for reusing, dropping its
+// sessions so they can't leak to another request.
 func (r *Registry) close() {
+	if r == nil {
+		return
+	}
+	if OnRegistryClose != nil {
+		OnRegistryClose(r.ctx)
+	}
 	r.ctx = nil
+	r.sessions = nil
 	registryPool.Put(r)
 }
 
 // Helpers
 
-func init() {
-	gob.Register([]interface{}{})
+// DisableGobRegistration disables the registration of []interface{} in the
+// encoding/gob package, used to encode flashes, for applications that want
+// full control over gob registrations.
+//
+// The registration happens when the first session is created, so set it
+// before, e.g. in an init function. Types already registered by the
+// application, even under another name, are kept as is.
+var DisableGobRegistration bool
+
+var gobOnce sync.Once
+
+// registerGobTypes registers the types used by the package in encoding/gob,
+// unless DisableGobRegistration is set.
+func registerGobTypes() {
+	gobOnce.Do(func() {
+		if !DisableGobRegistration {
+			registerGob([]interface{}{})
+		}
+	})
+}
+
+// registerGob registers value in encoding/gob, ignoring the panic raised if
+// its type was already registered under another name.
+func registerGob(value interface{}) {
+	defer func() {
+		recover()
+	}()
+	gob.Register(value)
+}
+
+// RegisterTypes registers the types of values in encoding/gob, as
+// gob.Register does, so that they can be stored in sessions encoded with gob.
+// Call it once with all the custom types of the application, e.g. in an init
+// function.
+//
+// Unlike gob.Register it doesn't panic for types already registered, even
+// under another name, or for names already used by other types: the first
+// registration is kept, so make sure that the types stored in sessions have
+// distinct names.
+func RegisterTypes(values ...interface{}) {
+	for _, value := range values {
+		registerGob(value)
+	}
 }
 
 // Save saves all sessions used during the current request.
@@ -195,9 +991,87 @@ func Save(ctx *fasthttp.RequestCtx) error {
 	return GetRegistry(ctx).Save()
 }
 
+// Migrate moves the session with the given name from a store to another: it
+// loads the session with from.New and saves it with to.Save, preserving its
+// ID, Values and Options.
+//
+// Nothing is saved if the request does not carry a session for from.
+func Migrate(ctx *fasthttp.RequestCtx, name string, from, to Store) error {
+	session, err := from.New(ctx, name)
+	if err != nil {
+		return err
+	}
+	if session.IsNew {
+		return nil
+	}
+	session.store = to
+	return to.Save(ctx, session)
+}
+
+// StorageKey returns the key under which server-side stores save the session
+// with the given ID: the hex-encoded SHA-256 hash of the ID. Someone able to
+// read the storage can't use the keys to forge session cookies.
+//
+// FilesystemStore still loads the files saved by previous versions under the
+// raw ID, and replaces them on Save; the stores of the subpackages always used
+// storage keys.
+func StorageKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// SecureCompare reports whether a and b are equal, in a time that doesn't
+// depend on their content, to compare secrets such as tokens stored in a
+// session without leaking them through timing. The time still depends on
+// their lengths.
+func SecureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// DeleteAll deletes all sessions used during the current request, e.g. in a
+// logout handler.
+func DeleteAll(ctx *fasthttp.RequestCtx) error {
+	return GetRegistry(ctx).DeleteAll()
+}
+
+// SecureFromForwardedProto reports whether the client reached the server over
+// HTTPS, either directly or through a TLS-terminating proxy that sets the
+// X-Forwarded-Proto header. It is meant to set the Secure flag per request
+// before saving the session:
+//
+//	session.Options.Secure = sessions.SecureFromForwardedProto(ctx)
+//
+// The header is set by the client when there is no proxy, so only use it
+// behind a proxy that overwrites X-Forwarded-Proto.
+func SecureFromForwardedProto(ctx *fasthttp.RequestCtx) bool {
+	if ctx.IsTLS() {
+		return true
+	}
+	proto := ctx.Request.Header.Peek("X-Forwarded-Proto")
+	// Proxies chained may append their own scheme, use the client one.
+	if i := bytes.IndexByte(proto, ','); i >= 0 {
+		proto = proto[:i]
+	}
+	return bytes.EqualFold(bytes.TrimSpace(proto), []byte("https"))
+}
+
+// HasCookie reports whether the request carries a cookie with the given
+// name, or the first chunk of a session split by CookieStore.ChunkSize,
+// without decoding or validating it, e.g. to skip the work of loading a
+// session for anonymous requests. The name is the cookie name, including
+// any CookieStore.NamePrefix, and sessions sent in a TokenHeader are not
+// seen.
+func HasCookie(ctx *fasthttp.RequestCtx, name string) bool {
+	return len(ctx.Request.Header.Cookie(name)) > 0 || len(ctx.Request.Header.Cookie(chunkName(name, 0))) > 0
+}
+
 // NewCookie returns an pointer of fasthttp.Cookie with the options set.
 // It also sets the Expires field calculated based on the MaxAge value,
 // for Internet Explorer compatibility.
+//
+// Path and Domain are set for cookies expiring a session too, as browsers
+// only remove a cookie when they match the ones it was set with. The
+// Priority option is not set, see SetCookie.
 func NewCookie(name, value string, options *Options) *fasthttp.Cookie {
 	cookie := &fasthttp.Cookie{}
 	cookie.SetKey(name)
@@ -206,10 +1080,14 @@ func NewCookie(name, value string, options *Options) *fasthttp.Cookie {
 	cookie.SetDomain(options.Domain)
 	cookie.SetHTTPOnly(options.HttpOnly)
 	cookie.SetSecure(options.Secure)
+	cookie.SetSameSite(options.SameSite)
+	if options.Partitioned {
+		cookie.SetPartitioned(true)
+	}
 
 	if options.MaxAge > 0 {
 		d := time.Duration(options.MaxAge) * time.Second
-		cookie.SetExpire(time.Now().Add(d))
+		cookie.SetExpire(time.Now().Add(d + options.ExpirySkew))
 	} else if options.MaxAge < 0 {
 		// Set it to the past to expire now.
 		cookie.SetExpire(time.Unix(1, 0))
@@ -217,8 +1095,109 @@ func NewCookie(name, value string, options *Options) *fasthttp.Cookie {
 	return cookie
 }
 
+// SetCookie sets the cookie with the given name, value and options in the
+// response, replacing any cookie of the same name set before, like
+// fasthttp.ResponseHeader.SetCookie with NewCookie; unlike NewCookie it also
+// sends the Priority option.
+func SetCookie(ctx *fasthttp.RequestCtx, name, value string, options *Options) {
+	cookie := NewCookie(name, value, options)
+	if options.Priority == "" {
+		ctx.Response.Header.SetCookie(cookie)
+		return
+	}
+	ctx.Response.Header.DelCookie(name)
+	ctx.Response.Header.Add(fasthttp.HeaderSetCookie, cookie.String()+"; Priority="+options.Priority)
+}
+
+// DeleteCookieEverywhere expires the cookie with the given name for every
+// combination of paths and domains, e.g. to clean up stale cookies left by
+// options used in the past. Browsers only remove a cookie when the path and
+// domain match the ones it was set with.
+//
+// An empty domain expires the host-only cookie. With no paths, "/" is used,
+// and with no domains, only the host-only cookie is expired. The expiring
+// cookies are added to the response along with the other cookies, as
+// separate Set-Cookie headers.
+func DeleteCookieEverywhere(ctx *fasthttp.RequestCtx, name string, paths []string, domains []string) {
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	for _, path := range paths {
+		for _, domain := range domains {
+			cookie := NewCookie(name, "", &Options{Path: path, Domain: domain, MaxAge: -1})
+			ctx.Response.Header.Add(fasthttp.HeaderSetCookie, cookie.String())
+		}
+	}
+}
+
 // Error
 
+// ErrSessionNotFound is returned by server-side stores when the request
+// carries a valid session cookie but the referenced session does not exist
+// in the backend, e.g. because it expired or was deleted.
+//
+// Other errors indicate a real failure of the backend, so handlers can use
+// errors.Is(err, ErrSessionNotFound) to tell an anonymous request apart from
+// an unavailable store.
+var ErrSessionNotFound = errors.New("sessions: session not found")
+
+// ErrSignatureInvalid is returned by stores when the signature of an encoded
+// session could not be verified with any of the keys. It may indicate a
+// tampered cookie, as opposed to a malformed or expired one.
+var ErrSignatureInvalid = errors.New("sessions: signature is not valid")
+
+// ErrTokenExpired is returned by CookieStore.DecodeToken for expired tokens.
+var ErrTokenExpired = errors.New("sessions: token expired")
+
+// ErrConflict is returned by stores checking the version of sessions, see
+// FilesystemStore.CheckVersion, when saving a session modified by another
+// request since it was loaded.
+var ErrConflict = errors.New("sessions: session modified concurrently")
+
+// ErrSessionTooLarge is wrapped by the errors returned by stores when saving a
+// session larger than their limit, see CookieStore.MaxBytes.
+var ErrSessionTooLarge = errors.New("sessions: session too large")
+
+// ErrBindingMismatch is returned by stores binding sessions to their client,
+// see CookieStore.BindTo, along with a new session when the session in the
+// request is bound to another client.
+var ErrBindingMismatch = errors.New("sessions: session bound to another client")
+
+// ErrStoreMismatch is returned by Registry.Get, along with the registered
+// session, when a session name is used with different stores during a
+// request.
+var ErrStoreMismatch = errors.New("sessions: session registered with another store")
+
+// ErrStorageUnavailable matches, with errors.Is, the errors returned by stores
+// when the underlying storage failed, e.g. because the disk is full or the
+// database is down. See StorageError.
+var ErrStorageUnavailable = errors.New("sessions: storage unavailable")
+
+// StorageError is returned by stores when an operation on the underlying
+// storage failed. It matches ErrStorageUnavailable, and Unwrap returns the
+// error of the storage.
+type StorageError struct {
+	Op  string // operation, e.g. "save"
+	Err error  // error of the storage
+}
+
+func (e *StorageError) Error() string {
+	return "sessions: storage unavailable: " + e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the storage.
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrStorageUnavailable.
+func (e *StorageError) Is(target error) bool {
+	return target == ErrStorageUnavailable
+}
+
 // MultiError stores multiple errors.
 //
 // Borrowed from the App Engine SDK.
@@ -244,3 +1223,34 @@ func (m MultiError) Error() string {
 	}
 	return fmt.Sprintf("%s (and %d other errors)", s, n-1)
 }
+
+// Unwrap returns the stored errors, so errors.Is and errors.As match any of
+// them.
+func (m MultiError) Unwrap() []error {
+	return m
+}
+
+// Errors returns the non-nil stored errors.
+func (m MultiError) Errors() []error {
+	var errs []error
+	for _, e := range m {
+		if e != nil {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// VerboseError returns the messages of all the stored errors, separated by
+// "; ", unlike Error which only returns the first one.
+func (m MultiError) VerboseError() string {
+	errs := m.Errors()
+	if len(errs) == 0 {
+		return "(0 errors)"
+	}
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -5,10 +5,18 @@
 package sessions
 
 import (
+	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/securecookie"
 	"github.com/valyala/fasthttp"
 )
 
@@ -178,3 +186,938 @@ func checkCookieOptions(cookie *fasthttp.Cookie, options *Options) error {
 
 	return nil
 }
+
+func TestNewCookiePartitioned(t *testing.T) {
+	cookie := NewCookie("session-key", "value", &Options{Path: "/"})
+	if cookie.Partitioned() {
+		t.Fatal("Expected a non-partitioned cookie by default")
+	}
+
+	cookie = NewCookie("session-key", "value", &Options{
+		Path:        "/",
+		Partitioned: true,
+	})
+	if !cookie.Partitioned() {
+		t.Fatal("Expected a partitioned cookie")
+	}
+	if !cookie.Secure() {
+		t.Error("Expected a partitioned cookie to be secure")
+	}
+	if !strings.Contains(cookie.String(), "Partitioned") {
+		t.Errorf("Expected Partitioned attribute; Got %s", cookie.String())
+	}
+}
+
+func TestNewCookieExpirySkew(t *testing.T) {
+	cookie := NewCookie("session-key", "value", &Options{MaxAge: 60})
+	if d := time.Until(cookie.Expire()); d > time.Minute {
+		t.Errorf("Expected an expiration in at most a minute; Got %v", d)
+	}
+
+	cookie = NewCookie("session-key", "value", &Options{
+		MaxAge:     60,
+		ExpirySkew: time.Minute,
+	})
+	if d := time.Until(cookie.Expire()); d <= time.Minute || d > 2*time.Minute {
+		t.Errorf("Expected an expiration in two minutes; Got %v", d)
+	}
+
+	// Deletion cookies are not affected.
+	cookie = NewCookie("session-key", "", &Options{
+		MaxAge:     -1,
+		ExpirySkew: time.Minute,
+	})
+	if !cookie.Expire().Equal(time.Unix(1, 0)) {
+		t.Errorf("Expected an expiration in the past; Got %v", cookie.Expire())
+	}
+}
+
+func TestHasCookie(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	if HasCookie(ctx, "session-key") {
+		t.Fatal("Expected no cookie in an empty request")
+	}
+	ctx.Request.Header.SetCookie("session-key", "not even encoded")
+	if !HasCookie(ctx, "session-key") || HasCookie(ctx, "other") {
+		t.Fatal("Expected only the session-key cookie to be found")
+	}
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("session-key.0", "chunk")
+	if !HasCookie(ctx, "session-key") {
+		t.Fatal("Expected a chunked session cookie to be found")
+	}
+}
+
+func TestSetCookiePriority(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	SetCookie(ctx, "session-key", "old", &Options{Path: "/", Priority: "High"})
+	SetCookie(ctx, "session-key", "value", &Options{Path: "/", Priority: "High"})
+	headers := ctx.Response.Header.PeekAll(fasthttp.HeaderSetCookie)
+	if len(headers) != 1 || !strings.HasSuffix(string(headers[0]), "; Priority=High") {
+		t.Fatalf("Expected one cookie with the Priority attribute; Got %q", headers)
+	}
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey("session-key")
+	if !ctx.Response.Header.Cookie(cookie) || string(cookie.Value()) != "value" {
+		t.Fatalf("Expected the cookie to be readable; Got %q", cookie.Value())
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	SetCookie(ctx, "session-key", "value", &Options{Path: "/"})
+	if header := ctx.Response.Header.Peek(fasthttp.HeaderSetCookie); strings.Contains(string(header), "Priority") {
+		t.Fatalf("Expected no Priority attribute by default; Got %s", header)
+	}
+}
+
+func TestOptionsHelpers(t *testing.T) {
+	options := &Options{MaxAge: 60}
+	options.MakeSessionCookie()
+	if cookie := NewCookie("session-key", "value", options); !cookie.Expire().Equal(fasthttp.CookieExpireUnlimited) {
+		t.Errorf("Expected a session cookie; Got an expiration at %v", cookie.Expire())
+	}
+
+	for _, tc := range []struct {
+		d      time.Duration
+		maxAge int
+	}{
+		{time.Hour, 3600},
+		{1500 * time.Millisecond, 2},
+		{0, 1},
+	} {
+		options.MakePersistent(tc.d)
+		if options.MaxAge != tc.maxAge {
+			t.Errorf("MakePersistent(%v): Expected MaxAge %d; Got %d", tc.d, tc.maxAge, options.MaxAge)
+		}
+	}
+
+	options.MakeDelete()
+	if cookie := NewCookie("session-key", "", options); !cookie.Expire().Equal(time.Unix(1, 0)) {
+		t.Errorf("Expected an expiration in the past; Got %v", cookie.Expire())
+	}
+}
+
+func TestSecureFromForwardedProto(t *testing.T) {
+	tests := []struct {
+		proto  string
+		secure bool
+	}{
+		{"", false},
+		{"http", false},
+		{"https", true},
+		{"HTTPS", true},
+		{"https, http", true},
+		{"http, https", false},
+	}
+	for _, test := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		if test.proto != "" {
+			ctx.Request.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		if secure := SecureFromForwardedProto(ctx); secure != test.secure {
+			t.Errorf("X-Forwarded-Proto %q: Expected %t; Got %t", test.proto, test.secure, secure)
+		}
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	ctx := &fasthttp.RequestCtx{}
+	defer Clear(ctx)
+
+	for _, name := range []string{"session-one", "session-two"} {
+		session, err := store.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		session.Values["foo"] = "bar"
+	}
+	if err := DeleteAll(ctx); err != nil {
+		t.Fatalf("Error deleting sessions: %v", err)
+	}
+
+	for _, name := range []string{"session-one", "session-two"} {
+		cookie := &fasthttp.Cookie{}
+		cookie.SetKey(name)
+		if !ctx.Response.Header.Cookie(cookie) {
+			t.Fatalf("The cookie %s has not been sent to client.", name)
+		}
+		if !cookie.Expire().Before(time.Now()) {
+			t.Errorf("Expected cookie %s to be expired; Got %v", name, cookie.Expire())
+		}
+	}
+}
+
+func TestDeleteAllNilOptions(t *testing.T) {
+	cookies := NewCookieStore([]byte("secret-key"))
+	cookies.Options.Path = "/app"
+	cookies.Options.Domain = "example.com"
+	for _, store := range []Store{cookies, NewLazyStore(cookies)} {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.Get(ctx, "session-key")
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		if _, ok := store.(*CookieStore); ok {
+			session.Options = nil
+		}
+		if err = DeleteAll(ctx); err != nil {
+			t.Fatalf("Error deleting sessions: %v", err)
+		}
+		cookie := &fasthttp.Cookie{}
+		cookie.SetKey("session-key")
+		if !ctx.Response.Header.Cookie(cookie) {
+			t.Fatalf("%T: the cookie has not been sent to client.", store)
+		}
+		if string(cookie.Path()) != "/app" || string(cookie.Domain()) != "example.com" || !cookie.Expire().Before(time.Now()) {
+			t.Errorf("%T: expected an expired cookie with the store path and domain; Got %s", store, cookie.String())
+		}
+		Clear(ctx)
+	}
+}
+
+func TestDeleteCookieEverywhere(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	DeleteCookieEverywhere(ctx, "session-key", []string{"/", "/app"}, []string{"", "example.com"})
+
+	var cookies []string
+	ctx.Response.Header.VisitAllCookie(func(key, value []byte) {
+		cookie := &fasthttp.Cookie{}
+		if err := cookie.ParseBytes(value); err != nil {
+			t.Fatalf("Error parsing cookie: %v", err)
+		}
+		if string(cookie.Key()) != "session-key" || !cookie.Expire().Before(time.Now()) {
+			t.Errorf("Expected an expired session-key cookie; Got %s", value)
+		}
+		cookies = append(cookies, string(cookie.Path())+"|"+string(cookie.Domain()))
+	})
+	want := []string{"/|", "/|example.com", "/app|", "/app|example.com"}
+	if strings.Join(cookies, " ") != strings.Join(want, " ") {
+		t.Fatalf("Expected cookies %v; Got %v", want, cookies)
+	}
+}
+
+func TestDefaultFlashKey(t *testing.T) {
+	defer func(key string) {
+		DefaultFlashKey = key
+	}(DefaultFlashKey)
+	DefaultFlashKey = "_messages"
+
+	session := NewSession(nil, "session-key")
+	session.AddFlash("foo")
+	session.AddFlash("bar", "_flash")
+	if _, ok := session.Values["_messages"]; !ok {
+		t.Fatalf("Expected flashes under the default key; Got %v", session.Values)
+	}
+	if flashes := session.Flashes(); len(flashes) != 1 || flashes[0] != "foo" {
+		t.Errorf("Expected [foo]; Got %v", flashes)
+	}
+	if flashes := session.Flashes("_flash"); len(flashes) != 1 || flashes[0] != "bar" {
+		t.Errorf("Expected [bar]; Got %v", flashes)
+	}
+}
+
+func TestMaxFlashes(t *testing.T) {
+	defer func(max int) {
+		MaxFlashes = max
+	}(MaxFlashes)
+	MaxFlashes = 2
+
+	session := NewSession(nil, "session-key")
+	for _, v := range []string{"foo", "bar", "baz"} {
+		session.AddFlash(v)
+	}
+	session.Flash("errors").Add("qux")
+	flashes := session.Flashes()
+	if len(flashes) != 2 || flashes[0] != "bar" || flashes[1] != "baz" {
+		t.Errorf("Expected [bar baz]; Got %v", flashes)
+	}
+	if flashes = session.Flash("errors").Drain(); len(flashes) != 1 {
+		t.Errorf("Expected [qux]; Got %v", flashes)
+	}
+}
+
+func TestFlashSerializer(t *testing.T) {
+	defer func(serializer securecookie.Serializer) {
+		FlashSerializer = serializer
+	}(FlashSerializer)
+	FlashSerializer = securecookie.JSONEncoder{}
+
+	store := NewCookieStore([]byte("secret-key"))
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	session.Values[DefaultFlashKey] = []interface{}{"old"}
+	session.AddFlash("foo")
+	session.AddFlash("bar")
+	if _, ok := session.Values[DefaultFlashKey].([]byte); !ok {
+		t.Fatalf("Expected serialized flashes; Got %T", session.Values[DefaultFlashKey])
+	}
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	session, _ = store.New(requestWithCookie(ctx, "session-key"), "session-key")
+	flashes := session.Flashes()
+	if len(flashes) != 3 || flashes[0] != "old" || flashes[2] != "bar" {
+		t.Fatalf("Expected [old foo bar]; Got %v", flashes)
+	}
+}
+
+func TestFlashesAndRequeue(t *testing.T) {
+	isString := func(v interface{}) bool {
+		_, ok := v.(string)
+		return ok
+	}
+	session := NewSession(nil, "session-key")
+	if flashes := session.FlashesAndRequeue(isString); flashes != nil {
+		t.Fatalf("Expected no flashes; Got %v", flashes)
+	}
+	session.AddFlash("foo")
+	session.AddFlash(1)
+	session.AddFlash("bar")
+	session.AddFlash(2)
+	session.AddFlash("baz", "custom_key")
+
+	flashes := session.FlashesAndRequeue(isString)
+	if !reflect.DeepEqual(flashes, []interface{}{"foo", "bar"}) {
+		t.Fatalf("Expected [foo bar]; Got %v", flashes)
+	}
+	if flashes = session.Flashes(); !reflect.DeepEqual(flashes, []interface{}{1, 2}) {
+		t.Fatalf("Expected the requeued flashes [1 2]; Got %v", flashes)
+	}
+
+	if flashes = session.FlashesAndRequeue(isString, "custom_key"); len(flashes) != 1 || flashes[0] != "baz" {
+		t.Fatalf("Expected [baz]; Got %v", flashes)
+	}
+	if _, ok := session.Values["custom_key"]; ok {
+		t.Fatal("Expected the flash key to be removed once all flashes are consumed")
+	}
+}
+
+func TestFlashAndRedirect(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.Get(ctx, "session-key")
+	if err := session.FlashAndRedirect(ctx, "Saved!", "/items", fasthttp.StatusSeeOther); err != nil {
+		t.Fatalf("Error redirecting: %v", err)
+	}
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusSeeOther {
+		t.Fatalf("Expected status %d; Got %d", fasthttp.StatusSeeOther, code)
+	}
+	if location := string(ctx.Response.Header.Peek("Location")); !strings.HasSuffix(location, "/items") {
+		t.Fatalf("Expected a redirect to /items; Got %q", location)
+	}
+
+	session, err := store.New(requestWithCookie(ctx, "session-key"), "session-key")
+	if err != nil {
+		t.Fatalf("Error decoding session: %v", err)
+	}
+	if flashes := session.Flashes(); len(flashes) != 1 || flashes[0] != "Saved!" {
+		t.Fatalf("Expected the flash to be saved; Got %v", flashes)
+	}
+}
+
+func TestSessionMerge(t *testing.T) {
+	newSessions := func() (*Session, *Session) {
+		s := NewSession(nil, "session-key")
+		s.Values["name"] = "gopher"
+		s.AddFlash("welcome back")
+		other := NewSession(nil, "anonymous")
+		other.Values["name"] = "anonymous"
+		other.Values["cart"] = []string{"book"}
+		other.AddFlash("item added")
+		other.Flash("notices").Add("notice")
+		return s, other
+	}
+
+	s, other := newSessions()
+	s.Merge(other, false)
+	if s.Values["name"] != "gopher" {
+		t.Errorf("Expected the existing value to be kept; Got %v", s.Values["name"])
+	}
+	if cart, ok := s.Values["cart"].([]string); !ok || len(cart) != 1 {
+		t.Errorf("Expected the cart to be copied; Got %v", s.Values["cart"])
+	}
+	flashes := s.Flashes()
+	if len(flashes) != 2 || flashes[0] != "welcome back" || flashes[1] != "item added" {
+		t.Errorf("Expected the flashes to be appended; Got %v", flashes)
+	}
+	if notices := s.Flash("notices").Drain(); len(notices) != 1 {
+		t.Errorf("Expected the notices to be copied; Got %v", notices)
+	}
+
+	s, other = newSessions()
+	s.Merge(other, true)
+	if s.Values["name"] != "anonymous" {
+		t.Errorf("Expected the existing value to be overwritten; Got %v", s.Values["name"])
+	}
+	if flashes = s.Flashes(); len(flashes) != 2 {
+		t.Errorf("Expected the flashes to be appended; Got %v", flashes)
+	}
+	if flashes = other.Flashes(); len(flashes) != 1 {
+		t.Errorf("Expected the other session to be left untouched; Got %v", flashes)
+	}
+}
+
+func TestSecureCompare(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"", "", true},
+		{"token", "token", true},
+		{"token", "tokem", false},
+		{"token", "token2", false},
+		{"token", "", false},
+	}
+	for _, test := range tests {
+		if equal := SecureCompare(test.a, test.b); equal != test.equal {
+			t.Errorf("%q, %q: Expected %t; Got %t", test.a, test.b, test.equal, equal)
+		}
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	session.SetWithTTL("code", "1234", 50*time.Millisecond)
+	session.SetWithTTL("other", "5678", time.Hour)
+	session.Values["name"] = "gopher"
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	req := requestWithCookie(ctx, "session-key")
+	defer Clear(req)
+	session, _ = store.Get(req, "session-key")
+	if v := session.GetDefault("code", nil); v != "1234" {
+		t.Fatalf("Expected 1234; Got %v", v)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if v := session.GetDefault("code", nil); v != nil {
+		t.Fatalf("Expected the value to expire; Got %v", v)
+	}
+	if _, ok := session.Values["code"]; ok {
+		t.Fatal("Expected the expired value to be removed")
+	}
+	if session.Values["other"] != "5678" || session.Values["name"] != "gopher" {
+		t.Fatalf("Expected the other values to be kept; Got %v", session.Values)
+	}
+
+	// Expired values are removed when the session is loaded.
+	session, _ = store.New(requestWithCookie(ctx, "session-key"), "session-key")
+	if _, ok := session.Values["code"]; !ok {
+		t.Fatal("Expected New to keep the raw values")
+	}
+	req2 := requestWithCookie(ctx, "session-key")
+	defer Clear(req2)
+	if session, _ = store.Get(req2, "session-key"); session.Values["code"] != nil {
+		t.Fatalf("Expected the value to expire; Got %v", session.Values["code"])
+	}
+}
+
+func TestSetWithTTLJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFilesystemStore(dir, []byte("secret-key"))
+	store.FileSerializer = JSONSerializer{}
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	session.SetWithTTL("code", "1234", time.Hour)
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// JSON decodes the expiration times as float64.
+	req := requestWithCookie(ctx, "session-key")
+	defer Clear(req)
+	if session, err = store.Get(req, "session-key"); err != nil {
+		t.Fatalf("Error loading session: %v", err)
+	}
+	if v := session.GetDefault("code", nil); v != "1234" {
+		t.Fatalf("Expected 1234; Got %v", session.Values)
+	}
+}
+
+func TestLastAccessedAt(t *testing.T) {
+	defer func(track bool) {
+		TrackLastAccess = track
+	}(TrackLastAccess)
+	TrackLastAccess = true
+
+	store := NewCookieStore([]byte("secret-key"))
+	ctx := &fasthttp.RequestCtx{}
+	defer Clear(ctx)
+	session, _ := store.Get(ctx, "session-key")
+	if !session.LastAccessedAt().IsZero() {
+		t.Fatalf("Expected no last access for a new session; Got %v", session.LastAccessedAt())
+	}
+	past := time.Now().Add(-time.Hour).Unix()
+	session.Values[lastAccessedKey] = past
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// Not saved: the access is not recorded.
+	for i := 0; i < 2; i++ {
+		req := requestWithCookie(ctx, "session-key")
+		session, _ = store.Get(req, "session-key")
+		if at := session.LastAccessedAt(); at.Unix() != past {
+			t.Fatalf("Expected the last access at %d; Got %v", past, at)
+		}
+		if at := valueInt64(session.Values[lastAccessedKey]); at < time.Now().Unix()-1 {
+			t.Fatalf("Expected the current access time in the values; Got %d", at)
+		}
+		Clear(req)
+	}
+
+	// Saved: the next request sees the recorded access.
+	req := requestWithCookie(ctx, "session-key")
+	session, _ = store.Get(req, "session-key")
+	if err := session.Save(req); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	Clear(req)
+	req = requestWithCookie(req, "session-key")
+	defer Clear(req)
+	session, _ = store.Get(req, "session-key")
+	if at := session.LastAccessedAt(); time.Since(at) > 2*time.Second {
+		t.Fatalf("Expected the recorded access time; Got %v", at)
+	}
+}
+
+func TestSessionHash(t *testing.T) {
+	session := NewSession(nil, "session-key")
+	if h := session.Hash(); h != EmptySessionHash {
+		t.Fatalf("Expected %q for an empty session; Got %q", EmptySessionHash, h)
+	}
+	session.Values[lastAccessedKey] = time.Now().Unix()
+	if h := session.Hash(); h != EmptySessionHash {
+		t.Fatalf("Expected bookkeeping values to be ignored; Got %q", h)
+	}
+
+	for i := 0; i < 20; i++ {
+		session.Values[fmt.Sprint("key", i)] = i
+	}
+	session.Values["nested"] = map[string]interface{}{"b": 1, "a": []string{"x"}}
+	h := session.Hash()
+	if len(h) != 64 {
+		t.Fatalf("Expected a hex SHA-256; Got %q", h)
+	}
+	for i := 0; i < 10; i++ {
+		if other := session.Hash(); other != h {
+			t.Fatalf("Expected a stable hash; Got %q and %q", h, other)
+		}
+	}
+	session.Values["key0"] = "changed"
+	if session.Hash() == h {
+		t.Fatal("Expected the hash to change with the values")
+	}
+
+	session.Values[42] = "not a string key"
+	if h = session.Hash(); h != "" {
+		t.Fatalf("Expected an empty hash for non-string keys; Got %q", h)
+	}
+}
+
+func TestTyped(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+
+	session := NewSession(nil, "session-key")
+	session.Values["user"] = &user{"gopher", 7}
+	var u *user
+	if err := session.Typed("user", &u); err != nil {
+		t.Fatalf("Error getting typed value: %v", err)
+	}
+	if u.Name != "gopher" {
+		t.Errorf("Expected gopher; Got %v", u)
+	}
+
+	// Generic values are converted once and cached.
+	session.Values["decoded"] = map[string]interface{}{"Name": "gopher", "Age": 7.0}
+	var d1, d2 user
+	if err := session.Typed("decoded", &d1); err != nil {
+		t.Fatalf("Error getting typed value: %v", err)
+	}
+	session.typed["decoded"] = typedValue{raw: session.Values["decoded"], value: user{"cached", 1}}
+	if err := session.Typed("decoded", &d2); err != nil {
+		t.Fatalf("Error getting typed value: %v", err)
+	}
+	if d1 != (user{"gopher", 7}) || d2.Name != "cached" {
+		t.Errorf("Expected a converted then cached value; Got %v, %v", d1, d2)
+	}
+
+	// The cache is not used for a new value.
+	session.Values["decoded"] = map[string]interface{}{"Name": "other"}
+	if err := session.Typed("decoded", &d2); err != nil || d2.Name != "other" {
+		t.Errorf("Expected other; Got %v, %v", d2, err)
+	}
+
+	if err := session.Typed("missing", &d1); err == nil {
+		t.Error("Expected an error for a missing value")
+	}
+	var n int
+	if err := session.Typed("user", &n); err == nil {
+		t.Error("Expected an error for an inconvertible value")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	from := NewFilesystemStore(dir, []byte("secret-key"))
+	to := NewCookieStore([]byte("secret-key"))
+
+	// Nothing to migrate.
+	ctx := &fasthttp.RequestCtx{}
+	if err = Migrate(ctx, "session-key", from, to); err != nil {
+		t.Fatalf("Error migrating session: %v", err)
+	}
+	if c := ctx.Response.Header.PeekCookie("session-key"); len(c) > 0 {
+		t.Fatalf("Unexpected cookie: %s", c)
+	}
+
+	session, err := from.New(ctx, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	ctx = requestWithCookie(ctx, "session-key")
+	if err = Migrate(ctx, "session-key", from, to); err != nil {
+		t.Fatalf("Error migrating session: %v", err)
+	}
+
+	ctx = requestWithCookie(ctx, "session-key")
+	migrated, err := to.New(ctx, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting migrated session: %v", err)
+	}
+	if migrated.IsNew || migrated.Values["name"] != "gopher" {
+		t.Errorf("Expected name gopher; Got %v", migrated.Values)
+	}
+}
+
+// requestWithCookie returns a new request context carrying the cookie with
+// the given name sent in the response of ctx.
+func requestWithCookie(ctx *fasthttp.RequestCtx, name string) *fasthttp.RequestCtx {
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey(name)
+	req := &fasthttp.RequestCtx{}
+	if ctx.Response.Header.Cookie(cookie) {
+		req.Request.Header.SetCookieBytesKV(cookie.Key(), cookie.Value())
+	}
+	return req
+}
+
+func TestDump(t *testing.T) {
+	type unregistered struct {
+		name string
+	}
+
+	session := NewSession(nil, "session-key")
+	session.ID = "id"
+	session.Values["name"] = "gopher"
+	session.Values[42] = &unregistered{"foo"}
+	session.AddFlash("foo")
+
+	dump := session.Dump()
+	expected := `session "session-key" (ID "id", IsNew false)
+	"_flash" (flashes): []interface {}{"foo"}
+	"name": "gopher"
+	42: &sessions.unregistered{name:"foo"}`
+	if dump != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, dump)
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if session.ValidateCSRF("") {
+		t.Fatal("Expected an empty token to be invalid")
+	}
+	token := session.CSRFToken()
+	if token == "" {
+		t.Fatal("Expected a token")
+	}
+	if session.CSRFToken() != token {
+		t.Fatal("Expected the same token on the second call")
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	ctx = requestWithCookie(ctx, "session-key")
+	if session, err = store.New(ctx, "session-key"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if !session.ValidateCSRF(token) {
+		t.Error("Expected the token to be valid on the next request")
+	}
+	if session.ValidateCSRF(token + "x") {
+		t.Error("Expected a different token to be invalid")
+	}
+}
+
+func TestRegistryForEach(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	ctx := &fasthttp.RequestCtx{}
+	defer Clear(ctx)
+
+	for _, name := range []string{"session-one", "session-two"} {
+		if _, err := store.Get(ctx, name); err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+	}
+	seen := make(map[string]bool)
+	GetRegistry(ctx).ForEach(func(name string, s *Session, err error) {
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", name, err)
+		}
+		if s.Name() != name {
+			t.Errorf("Expected session %s; Got %s", name, s.Name())
+		}
+		s.Values["seen"] = true
+		seen[name] = true
+	})
+	if len(seen) != 2 || !seen["session-one"] || !seen["session-two"] {
+		t.Fatalf("Expected both sessions; Got %v", seen)
+	}
+	session, _ := store.Get(ctx, "session-one")
+	if session.Values["seen"] != true {
+		t.Error("Expected changes to be kept in the registered session")
+	}
+}
+
+func TestRegistryDelete(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	ctx := &fasthttp.RequestCtx{}
+	defer Clear(ctx)
+
+	for _, name := range []string{"session-one", "session-two"} {
+		session, err := store.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		session.Values["foo"] = "bar"
+	}
+	GetRegistry(ctx).Delete("session-two")
+	if err := Save(ctx); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey("session-one")
+	if !ctx.Response.Header.Cookie(cookie) {
+		t.Fatal("Expected session-one to be saved")
+	}
+	cookie.SetKey("session-two")
+	if ctx.Response.Header.Cookie(cookie) {
+		t.Fatal("Expected session-two not to be saved")
+	}
+
+	session, _ := store.Get(ctx, "session-two")
+	if _, ok := session.Values["foo"]; ok {
+		t.Fatal("Expected a new session after Delete")
+	}
+}
+
+type gobNames []int
+
+func TestRegistryStoreMismatch(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	ctx := &fasthttp.RequestCtx{}
+	defer Clear(ctx)
+	session, err := store.Get(ctx, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if s, err := store.Get(ctx, "session-key"); err != nil || s != session {
+		t.Fatalf("Expected the registered session; Got %p, %v", s, err)
+	}
+
+	other := NewCookieStore([]byte("secret-key"))
+	s, err := other.Get(ctx, "session-key")
+	if !errors.Is(err, ErrStoreMismatch) {
+		t.Fatalf("Expected %v; Got %v", ErrStoreMismatch, err)
+	}
+	if s != session || s.Store() != store {
+		t.Fatalf("Expected the registered session bound to its store; Got %p bound to %p", s, s.Store())
+	}
+
+	// Stores used by value are compared by value.
+	if _, err = GetRegistry(ctx).Get(NopStore{}, "nop"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if _, err = GetRegistry(ctx).Get(NopStore{}, "nop"); err != nil {
+		t.Fatalf("Expected no error for an equal store; Got %v", err)
+	}
+}
+
+func TestRegisterGob(t *testing.T) {
+	gob.RegisterName("sessions_test.gobNames", gobNames{})
+	// Must not panic.
+	registerGob(gobNames{})
+	registerGob(gobNames{})
+}
+
+func TestRegisterTypes(t *testing.T) {
+	type registered struct{ Name string }
+	// Must not panic on types already registered.
+	RegisterTypes(registered{}, &registered{}, gobNames{})
+	RegisterTypes(registered{}, gobNames{})
+
+	var buf bytes.Buffer
+	var v interface{} = registered{Name: "gopher"}
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		t.Fatalf("Error encoding registered type: %v", err)
+	}
+	var decoded interface{}
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil || decoded != v {
+		t.Fatalf("Expected %v; Got %v, %v", v, decoded, err)
+	}
+}
+
+func TestFlashQueue(t *testing.T) {
+	session := NewSession(nil, "session-key")
+	formErrors := session.Flash("form-errors")
+	notices := session.Flash("notices")
+
+	formErrors.Add("invalid email")
+	formErrors.Add("missing name")
+	notices.Add("saved")
+	session.AddFlash("default")
+
+	if flashes := formErrors.Peek(); len(flashes) != 2 {
+		t.Fatalf("Expected 2 flashes; Got %v", flashes)
+	}
+	// Peeking does not remove the messages.
+	if flashes := session.Flash("form-errors").Peek(); len(flashes) != 2 {
+		t.Fatalf("Expected 2 flashes; Got %v", flashes)
+	}
+	flashes := formErrors.Drain()
+	if len(flashes) != 2 || flashes[0] != "invalid email" || flashes[1] != "missing name" {
+		t.Errorf("Expected [invalid email missing name]; Got %v", flashes)
+	}
+	if flashes = formErrors.Drain(); len(flashes) != 0 {
+		t.Errorf("Expected drained flashes; Got %v", flashes)
+	}
+	if flashes = notices.Drain(); len(flashes) != 1 || flashes[0] != "saved" {
+		t.Errorf("Expected [saved]; Got %v", flashes)
+	}
+	if flashes = session.Flashes(); len(flashes) != 1 || flashes[0] != "default" {
+		t.Errorf("Expected [default]; Got %v", flashes)
+	}
+}
+
+func TestMultiErrorUnwrap(t *testing.T) {
+	cause := &StorageError{Op: "save", Err: errors.New("disk full")}
+	err := error(MultiError{
+		errors.New("first"),
+		fmt.Errorf("sessions: error saving session %q -- %w", "session-key", cause),
+	})
+
+	if !errors.Is(err, ErrStorageUnavailable) {
+		t.Errorf("Expected errors.Is to match %v in %v", ErrStorageUnavailable, err)
+	}
+	if errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Unexpected match of %v in %v", ErrSessionNotFound, err)
+	}
+	var storageErr *StorageError
+	if !errors.As(err, &storageErr) || storageErr != cause {
+		t.Errorf("Expected errors.As to find %v in %v", cause, err)
+	}
+}
+
+func TestMultiErrorErrors(t *testing.T) {
+	m := MultiError{errors.New("first"), nil, errors.New("second")}
+	if errs := m.Errors(); len(errs) != 2 || errs[1].Error() != "second" {
+		t.Errorf("Expected [first second]; Got %v", errs)
+	}
+	if m.Error() != "first (and 1 other error)" {
+		t.Errorf("Unexpected error: %s", m.Error())
+	}
+	if s := m.VerboseError(); s != "first; second" {
+		t.Errorf("Expected %q; Got %q", "first; second", s)
+	}
+	if s := (MultiError{}).VerboseError(); s != "(0 errors)" {
+		t.Errorf("Expected (0 errors); Got %q", s)
+	}
+}
+
+func TestGetDefault(t *testing.T) {
+	session := NewSession(nil, "session-key")
+	session.Values["theme"] = "dark"
+	session.Values["nil"] = nil
+
+	if v := session.GetDefault("theme", "light"); v != "dark" {
+		t.Errorf("Expected dark; Got %v", v)
+	}
+	if v := session.GetDefault("lang", "en"); v != "en" {
+		t.Errorf("Expected en; Got %v", v)
+	}
+	if v := session.GetDefault("nil", "set"); v != nil {
+		t.Errorf("Expected nil; Got %v", v)
+	}
+}
+
+func TestSecureValues(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	store.ValueCodecs = securecookie.CodecsFromPairs([]byte("value-key"),
+		[]byte("0123456789abcdef"))
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	session.Values["theme"] = "dark"
+	if err := session.SetSecure("token", "sensitive"); err != nil {
+		t.Fatalf("Error setting secure value: %v", err)
+	}
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// The cookie is only signed, the secure value is encrypted.
+	values := make(map[interface{}]interface{})
+	encoded := string(requestWithCookie(ctx, "session-key").Request.Header.Cookie("session-key"))
+	if err := securecookie.DecodeMulti("session-key", encoded, &values, store.Codecs...); err != nil {
+		t.Fatalf("Error decoding cookie: %v", err)
+	}
+	if v, _ := values[secureKeyPrefix+"token"].(string); v == "" || strings.Contains(v, "sensitive") {
+		t.Fatalf("Expected an encrypted value; Got %q", v)
+	}
+
+	session, _ = store.New(requestWithCookie(ctx, "session-key"), "session-key")
+	var token string
+	if err := session.GetSecure("token", &token); err != nil {
+		t.Fatalf("Error getting secure value: %v", err)
+	}
+	if token != "sensitive" {
+		t.Errorf("Expected sensitive; Got %q", token)
+	}
+	if err := session.GetSecure("missing", &token); err == nil {
+		t.Error("Expected an error for a missing secure value")
+	}
+
+	// Stores without value codecs.
+	session = NewSession(NewCookieStore([]byte("secret-key")), "session-key")
+	if err := session.SetSecure("token", "sensitive"); err == nil {
+		t.Error("Expected an error without value codecs")
+	}
+}
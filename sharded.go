@@ -0,0 +1,149 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"encoding/base32"
+	"errors"
+	"hash/fnv"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+)
+
+// NewShardedStore returns a new ShardedStore spreading sessions across
+// stores with hash. A nil hash defaults to FNV-1a.
+//
+// The keyPairs must be the ones of the stores, as the store decodes the
+// session ID from the cookie to route the request, see NewCookieStore.
+func NewShardedStore(stores []Store, hash func(id string) uint32, keyPairs ...[]byte) *ShardedStore {
+	if hash == nil {
+		hash = fnv32a
+	}
+	return &ShardedStore{
+		Codecs: codecsFromPairs(keyPairs...),
+		stores: stores,
+		hash:   hash,
+	}
+}
+
+// ShardedStore is a Store wrapper spreading sessions across several
+// server-side stores, e.g. one per database instance, routing each session
+// to a store by the hash of its ID. Loading, saving and deleting a session
+// always use the same store for the same ID.
+//
+// The stores must share the same configuration and keys, and store the
+// signed session ID in the cookie, as FilesystemStore does. New sessions
+// are given an ID by the ShardedStore before they are saved, so options
+// changing the ID in the stores, such as FilesystemStore.RotateEvery, must
+// not be used. Changing the number of stores reassigns most sessions to
+// another store, losing them.
+type ShardedStore struct {
+	// Codecs decode the session ID from the cookie, they must be the
+	// codecs of the stores.
+	Codecs []securecookie.Codec
+	stores []Store
+	hash   func(id string) uint32
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *ShardedStore) Get(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	return GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry,
+// loaded from the store of its ID.
+//
+// Requests without a valid session cookie are handled by the first store.
+//
+// See CookieStore.New().
+func (s *ShardedStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	if len(s.stores) == 0 {
+		return NewSession(s, name), errNoShards
+	}
+	store := s.stores[0]
+	c := readToken(ctx, tokenHeader(store), namePrefix(store)+name)
+	if len(c) > 0 {
+		var id string
+		if DecodeMulti(namePrefix(store)+name, string(c), &id, s.Codecs...) == nil {
+			store = s.Shard(id)
+		}
+	}
+	session, err := store.New(ctx, name)
+	if session != nil {
+		session.store = s
+	}
+	return session, err
+}
+
+// Save saves the session in the store of its ID, giving it an ID first if
+// it has none.
+func (s *ShardedStore) Save(ctx *fasthttp.RequestCtx, session *Session) error {
+	if len(s.stores) == 0 {
+		return errNoShards
+	}
+	if session.ID == "" {
+		if session.Options != nil && session.Options.MaxAge <= 0 {
+			return s.stores[0].Save(ctx, session)
+		}
+		key := securecookie.GenerateRandomKey(32)
+		if key == nil {
+			return errors.New("sessions: failed to generate session id")
+		}
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(key), "=")
+	}
+	return s.Shard(session.ID).Save(ctx, session)
+}
+
+// Shard returns the store of the session with the given ID.
+func (s *ShardedStore) Shard(id string) Store {
+	return s.stores[s.hash(id)%uint32(len(s.stores))]
+}
+
+// List returns the storage keys of the sessions of all the stores
+// implementing Lister.
+//
+// See Lister.
+func (s *ShardedStore) List(prefix string) ([]string, error) {
+	var keys []string
+	for _, store := range s.stores {
+		if l, ok := store.(Lister); ok {
+			k, err := l.List(prefix)
+			if err != nil {
+				return keys, err
+			}
+			keys = append(keys, k...)
+		}
+	}
+	return keys, nil
+}
+
+// Close closes the stores implementing Closer.
+func (s *ShardedStore) Close() error {
+	var errMulti MultiError
+	for _, store := range s.stores {
+		if c, ok := store.(Closer); ok {
+			if err := c.Close(); err != nil {
+				errMulti = append(errMulti, err)
+			}
+		}
+	}
+	if errMulti != nil {
+		return errMulti
+	}
+	return nil
+}
+
+var errNoShards = errors.New("sessions: ShardedStore without stores")
+
+// fnv32a returns the FNV-1a hash of id.
+func fnv32a(id string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return h.Sum32()
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"encoding/base32"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/valyala/fasthttp"
+)
+
+func TestShardedStore(t *testing.T) {
+	key := []byte("secret-key")
+	shards := make([]Store, 3)
+	for i := range shards {
+		dir, err := ioutil.TempDir("", "sessions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		shards[i] = NewFilesystemStore(dir, key)
+	}
+	store := NewShardedStore(shards, nil, key)
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	session.Values["name"] = "gopher"
+	if err := session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	shard := store.Shard(session.ID).(*FilesystemStore)
+	if _, err := os.Stat(shard.filename(session.ID)); err != nil {
+		t.Fatalf("Expected the session in its shard: %v", err)
+	}
+
+	req := requestWithCookie(ctx, "session-key")
+	session, err := store.New(req, "session-key")
+	if err != nil || session.IsNew || session.Values["name"] != "gopher" {
+		t.Fatalf("Expected name gopher; Got %v, %v", session.Values, err)
+	}
+	if session.Store() != store {
+		t.Fatal("Expected the session to be bound to the sharded store")
+	}
+
+	session.Options.MaxAge = -1
+	if err = session.Save(req); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if _, err = os.Stat(shard.filename(session.ID)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the session to be deleted from its shard; Got %v", err)
+	}
+}
+
+func TestShardedStoreDistribution(t *testing.T) {
+	shards := []Store{&CookieStore{}, &CookieStore{}, &CookieStore{}, &CookieStore{}}
+	store := NewShardedStore(shards, nil)
+	counts := make(map[Store]int)
+	for i := 0; i < 4000; i++ {
+		id := base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+		shard := store.Shard(id)
+		if store.Shard(id) != shard {
+			t.Fatalf("Expected the same shard for ID %q", id)
+		}
+		counts[shard]++
+	}
+	for i, shard := range shards {
+		if n := counts[shard]; n < 800 || n > 1200 {
+			t.Errorf("Expected about 1000 sessions in shard %d; Got %d", i, n)
+		}
+	}
+}
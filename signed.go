@@ -0,0 +1,107 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+// NewSignedCookieStore returns a new CookieStore encoding sessions with one
+// SignedCodec per key, so that the same session values always give the same
+// cookie value, e.g. for ETag-style caching. Set a GobSerializer with
+// Sorted on the store for session values that JSON can't encode. Unlike
+// with NewCookieStore the max age of the cookies is not enforced by the
+// server, see SignedCodec.
+//
+// The first key signs new cookies, the others are used to validate cookies
+// signed before a key rotation. It panics if there are no keys or a key is
+// too short, see CheckKeys.
+func NewSignedCookieStore(keys ...[]byte) *CookieStore {
+	if err := CheckKeys(keys...); err != nil {
+		panic(err)
+	}
+	codecs := make([]securecookie.Codec, len(keys))
+	for i, key := range keys {
+		codecs[i] = NewSignedCodec(key)
+	}
+	cs := &CookieStore{
+		Codecs: codecs,
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+
+	cs.MaxAge(cs.Options.MaxAge)
+	return cs
+}
+
+// NewSignedCodec returns a new SignedCodec signing values with key. It panics
+// if key is shorter than MinKeyLength.
+func NewSignedCodec(key []byte) *SignedCodec {
+	if err := checkKey(key); err != nil {
+		panic("sessions: " + err.Error())
+	}
+	return &SignedCodec{Serializer: JSONSerializer{}, key: key}
+}
+
+// SignedCodec is a securecookie.Codec signing serialized values with HMAC
+// SHA-256, without encrypting them. Unlike securecookie it embeds neither a
+// timestamp nor a random IV, so its output is deterministic: the same values
+// for the same name always give the same encoded value.
+//
+// The values can be read by anyone holding the encoded value. Without a
+// timestamp the max age is not enforced by the codec either: an encoded
+// value stays valid as long as its key, the browser only drops the cookie
+// once it expires.
+type SignedCodec struct {
+	// Serializer serializes the values. It defaults to JSONSerializer, which
+	// writes map keys in sorted order; the output is deterministic only if
+	// the serializer is, which is not the case of gob for maps.
+	Serializer securecookie.Serializer
+	key        []byte
+}
+
+// Encode serializes and signs value for the given name.
+func (c *SignedCodec) Encode(name string, value interface{}) (string, error) {
+	data, err := c.Serializer.Serialize(value)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + c.sign(name, payload), nil
+}
+
+// Decode verifies and deserializes a value for the given name into dst.
+//
+// It returns securecookie.ErrMacInvalid if the signature is not valid.
+func (c *SignedCodec) Decode(name, value string, dst interface{}) error {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return errors.New("sessions: malformed signed value")
+	}
+	payload := value[:i]
+	if !hmac.Equal([]byte(value[i+1:]), []byte(c.sign(name, payload))) {
+		return securecookie.ErrMacInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+	return c.Serializer.Deserialize(data, dst)
+}
+
+// sign returns the encoded signature of payload for the given name.
+func (c *SignedCodec) sign(name, payload string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(name + "|" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
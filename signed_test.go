@@ -0,0 +1,114 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestSignedCookieStore(t *testing.T) {
+	store := NewSignedCookieStore([]byte("secret-key-0123456"))
+	values := map[interface{}]interface{}{"a": "1", "b": 2.0, "c": []interface{}{"x"}, "d": true}
+
+	// The same values give the same cookie value.
+	first, err := EncodeSession(store, "session-key", values)
+	if err != nil {
+		t.Fatalf("Error encoding session: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		encoded, err := EncodeSession(store, "session-key", values)
+		if err != nil {
+			t.Fatalf("Error encoding session: %v", err)
+		}
+		if encoded != first {
+			t.Fatalf("Expected deterministic encoding; Got %q and %q", first, encoded)
+		}
+	}
+	if other, _ := EncodeSession(store, "other-key", values); other == first {
+		t.Fatal("Expected the signature to depend on the session name")
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("session-key", first)
+	session, err := store.New(ctx, "session-key")
+	if err != nil || session.IsNew || session.Values["b"] != 2.0 {
+		t.Fatalf("Expected the session to be decoded; Got %v, %v", session.Values, err)
+	}
+
+	// The same values signed with another key.
+	tampered, _ := EncodeSession(NewSignedCookieStore([]byte("other-key-0123456")), "session-key", values)
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("session-key", tampered)
+	if _, err = store.New(ctx, "session-key"); err != ErrSignatureInvalid {
+		t.Fatalf("Expected an invalid signature; Got %v", err)
+	}
+}
+
+func TestSignedCookieStoreSortedGob(t *testing.T) {
+	store := NewSignedCookieStore([]byte("secret-key-0123456"))
+	store.Serializer(GobSerializer{Sorted: true})
+	values := map[interface{}]interface{}{"a": "1", "b": 2, 3: []string{"x"}, "d": true}
+
+	// Gob values with non-string keys give the same cookie value too.
+	first, err := EncodeSession(store, "session-key", values)
+	if err != nil {
+		t.Fatalf("Error encoding session: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		encoded, err := EncodeSession(store, "session-key", values)
+		if err != nil {
+			t.Fatalf("Error encoding session: %v", err)
+		}
+		if encoded != first {
+			t.Fatalf("Expected deterministic encoding; Got %q and %q", first, encoded)
+		}
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("session-key", first)
+	session, err := store.New(ctx, "session-key")
+	if err != nil || session.IsNew || session.Values["b"] != 2 || session.Values[3].([]string)[0] != "x" {
+		t.Fatalf("Expected the session to be decoded; Got %v, %v", session.Values, err)
+	}
+}
+
+func TestCookieStoreSigningOnlyExpired(t *testing.T) {
+	hashKey := []byte("secret-key")
+	store := NewCookieStore(hashKey)
+	values := map[interface{}]interface{}{"a": "1"}
+
+	// Signing-only cookies still embed a timestamp, so the store rejects
+	// them once they are older than the max age.
+	data, err := GobSerializer{}.Serialize(values)
+	if err != nil {
+		t.Fatalf("Error encoding session: %v", err)
+	}
+	ts := time.Now().Add(-31 * 24 * time.Hour).Unix()
+	b := fmt.Sprintf("session-key|%d|%s", ts, base64.URLEncoding.EncodeToString(data))
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte(b))
+	expired := base64.URLEncoding.EncodeToString(append([]byte(b[len("session-key|"):]+"|"), mac.Sum(nil)...))
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("session-key", expired)
+	session, err := store.New(ctx, "session-key")
+	if err == nil || !session.IsNew || len(session.Values) != 0 {
+		t.Fatalf("Expected the expired cookie to be rejected; Got %v, %v", session.Values, err)
+	}
+
+	// The same cookie is accepted by a store without a max age.
+	store.MaxAge(0)
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("session-key", expired)
+	if session, err = store.New(ctx, "session-key"); err != nil || session.Values["a"] != "1" {
+		t.Fatalf("Expected the session to be decoded without a max age; Got %v, %v", session.Values, err)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"github.com/valyala/fasthttp"
+)
+
+// NewSplitStore returns a new SplitStore keeping the values whose key
+// satisfies inCookie in cookie, and the others in server.
+func NewSplitStore(cookie, server Store, inCookie func(key interface{}) bool) *SplitStore {
+	return &SplitStore{
+		CookieSuffix: "_c",
+		cookie:       cookie,
+		server:       server,
+		inCookie:     inCookie,
+	}
+}
+
+// SplitStore is a Store splitting the values of each session between a
+// cookie store, e.g. a CookieStore for small values read on most requests
+// without a round trip to the storage, and a server-side store, e.g. a
+// FilesystemStore for large or sensitive values kept off the wire.
+//
+// The session is presented as one: New loads both halves and merges their
+// values, and Save writes each value to the half chosen by the predicate
+// given to NewSplitStore, saving or deleting both halves. Values moved from
+// one half to the other by a change of the predicate are read from both
+// until the next Save.
+//
+// The ID, Options and IsNew of the session are the ones of the server-side
+// half, which keeps the name of the session; the cookie half is named with
+// CookieSuffix appended.
+type SplitStore struct {
+	// CookieSuffix is appended to the session name for the cookie half. It
+	// defaults to "_c".
+	CookieSuffix string
+	cookie       Store
+	server       Store
+	inCookie     func(key interface{}) bool
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *SplitStore) Get(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	return GetRegistry(ctx).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the
+// registry, merging the values of both halves. It returns the error of the
+// server-side half if any, else the one of the cookie half.
+//
+// See CookieStore.New().
+func (s *SplitStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
+	session, err := s.server.New(ctx, name)
+	if session == nil {
+		session = NewSession(s, name)
+	}
+	session.store = s
+	half, cerr := s.cookie.New(ctx, name+s.CookieSuffix)
+	if half != nil {
+		for k, v := range half.Values {
+			if s.inCookie(k) {
+				session.Values[k] = v
+			}
+		}
+	}
+	if err == nil {
+		err = cerr
+	}
+	return session, err
+}
+
+// Save saves the server-side half of the session, then its cookie half.
+func (s *SplitStore) Save(ctx *fasthttp.RequestCtx, session *Session) error {
+	values := session.Values
+	half := NewSession(s.cookie, session.Name()+s.CookieSuffix)
+	half.IsNew = session.IsNew
+	if session.Options != nil {
+		opts := *session.Options
+		half.Options = &opts
+	}
+	server := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		if s.inCookie(k) {
+			half.Values[k] = v
+		} else {
+			server[k] = v
+		}
+	}
+
+	// The server-side store saves the session itself to keep its ID and
+	// state, with the values of its half only.
+	session.Values = server
+	err := s.server.Save(ctx, session)
+	for k, v := range session.Values {
+		values[k] = v
+	}
+	session.Values = values
+	if err != nil {
+		return err
+	}
+	return s.cookie.Save(ctx, half)
+}
+
+// Close closes both stores if they implement Closer.
+func (s *SplitStore) Close() error {
+	var errMulti MultiError
+	for _, store := range []Store{s.server, s.cookie} {
+		if c, ok := store.(Closer); ok {
+			if err := c.Close(); err != nil {
+				errMulti = append(errMulti, err)
+			}
+		}
+	}
+	if errMulti != nil {
+		return errMulti
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 The Gem Authors. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestSplitStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cookie := NewCookieStore([]byte("secret-key"))
+	server := NewFilesystemStore(dir, []byte("secret-key"))
+	store := NewSplitStore(cookie, server, func(key interface{}) bool {
+		return key == "theme"
+	})
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "session-key")
+	session.Values["theme"] = "dark"
+	session.Values["cart"] = []string{"book"}
+	if err = session.Save(ctx); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if session.ID == "" || len(session.Values) != 2 {
+		t.Fatalf("Expected the session to keep its values and get an ID; Got %q, %v", session.ID, session.Values)
+	}
+
+	half, err := cookie.New(requestWithCookie(ctx, "session-key_c"), "session-key_c")
+	if err != nil {
+		t.Fatalf("Error decoding the cookie half: %v", err)
+	}
+	if _, ok := half.Values["cart"]; ok || half.Values["theme"] != "dark" {
+		t.Fatalf("Expected only theme in the cookie; Got %v", half.Values)
+	}
+	half, err = server.New(requestWithCookie(ctx, "session-key"), "session-key")
+	if err != nil {
+		t.Fatalf("Error loading the server half: %v", err)
+	}
+	if _, ok := half.Values["theme"]; ok || half.Values["cart"] == nil {
+		t.Fatalf("Expected only cart on the server; Got %v", half.Values)
+	}
+
+	req := requestWithCookie(ctx, "session-key")
+	c := requestWithCookie(ctx, "session-key_c").Request.Header.Cookie("session-key_c")
+	req.Request.Header.SetCookieBytesKV([]byte("session-key_c"), c)
+	session, err = store.New(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error loading session: %v", err)
+	}
+	if session.IsNew || session.Values["theme"] != "dark" || session.Values["cart"] == nil {
+		t.Fatalf("Expected the merged session; Got %v", session.Values)
+	}
+}
@@ -5,12 +5,27 @@
 package sessions
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/valyala/fasthttp"
@@ -27,12 +42,58 @@ type Store interface {
 	//
 	// Note that New should never return a nil session, even in the case of
 	// an error if using the Registry infrastructure to cache the session.
+	//
+	// Server-side stores should return ErrSessionNotFound along with the new
+	// session when the session referenced by the cookie does not exist.
 	New(ctx *fasthttp.RequestCtx, name string) (*Session, error)
 
 	// Save should persist session to the underlying store implementation.
 	Save(ctx *fasthttp.RequestCtx, session *Session) error
 }
 
+// Closer is an optional interface for stores holding resources, such as
+// connections, file handles or buffered writes. Applications should close
+// their stores during graceful shutdown, after the server stopped handling
+// requests, e.g. after fasthttp.Server.Shutdown returned.
+type Closer interface {
+	// Close flushes pending writes, if any, and releases the resources of
+	// the store. The store must not be used afterwards.
+	Close() error
+}
+
+// Validator is an optional interface for stores able to check their
+// configuration, e.g. at startup to fail fast instead of on the first
+// request.
+type Validator interface {
+	// Validate performs a lightweight round-trip with the underlying
+	// storage, such as writing, reading and deleting a probe, and returns
+	// the first error. It may have side effects on the storage.
+	Validate() error
+}
+
+// Pinger is an optional interface for stores able to check that their
+// backend is reachable, e.g. for readiness probes.
+type Pinger interface {
+	// Ping checks that the underlying storage is reachable, without
+	// reading or writing sessions. It is cheaper than Validate, has no
+	// side effects and is safe to call frequently.
+	Ping(ctx context.Context) error
+}
+
+// Lister is an optional interface for server-side stores able to enumerate
+// the stored sessions, e.g. for admin tools and bulk operations.
+//
+// Stores don't keep session IDs, see StorageKey, so the sessions are listed
+// by storage key and prefix matches the storage keys.
+//
+// Listing reads the whole storage, or a full index of it: it can be
+// expensive, so don't call it on the request hot path.
+type Lister interface {
+	// List returns the storage keys of the sessions starting with prefix,
+	// or of all the sessions if prefix is empty.
+	List(prefix string) ([]string, error)
+}
+
 // CookieStore
 
 // NewCookieStore returns a new CookieStore.
@@ -50,9 +111,113 @@ type Store interface {
 //
 // Use the convenience function securecookie.GenerateRandomKey() to create
 // strong keys.
+//
+// The cookie values embed a timestamp, and a random IV when encrypted, so
+// encoding the same values twice gives different cookies. Use
+// NewSignedCookieStore for deterministic cookie values.
+//
+// It panics if a key pair is malformed, see CheckKeyPairs.
 func NewCookieStore(keyPairs ...[]byte) *CookieStore {
 	cs := &CookieStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Codecs: codecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+
+	cs.MaxAge(cs.Options.MaxAge)
+	return cs
+}
+
+// CheckKeyPairs returns an error naming the first malformed pair of keyPairs,
+// as given to NewCookieStore: one with an empty authentication key, or with
+// an encryption key that is not 16, 24 or 32 bytes long. Pairs are numbered
+// from 0, like Session.CodecIndex.
+//
+// The constructors of the stores panic with this error, rather than letting
+// securecookie fail on the first Save.
+func CheckKeyPairs(keyPairs ...[]byte) error {
+	for i := 0; i < len(keyPairs); i += 2 {
+		if len(keyPairs[i]) == 0 {
+			return fmt.Errorf("sessions: key pair %d: empty authentication key", i/2)
+		}
+		if i+1 == len(keyPairs) {
+			break
+		}
+		switch n := len(keyPairs[i+1]); n {
+		case 0, 16, 24, 32:
+		default:
+			return fmt.Errorf("sessions: key pair %d: encryption key is %d bytes, want 16, 24 or 32", i/2, n)
+		}
+	}
+	return nil
+}
+
+// MinKeyLength is the minimum length of the keys checked by CheckKeys, and of
+// the master authentication keys of NewDerivedCodecs.
+const MinKeyLength = 16
+
+// CheckKeys returns an error naming the first key of keys, as given to
+// NewJWTCookieStore or NewSignedCookieStore, that is shorter than
+// MinKeyLength, or an error if there are no keys. Keys are numbered from 0.
+func CheckKeys(keys ...[]byte) error {
+	if len(keys) == 0 {
+		return errors.New("sessions: no keys")
+	}
+	for i, key := range keys {
+		if err := checkKey(key); err != nil {
+			return fmt.Errorf("sessions: key %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// checkKey returns an error if key is empty or shorter than MinKeyLength.
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return errors.New("empty key")
+	}
+	if len(key) < MinKeyLength {
+		return fmt.Errorf("key is %d bytes, want at least %d", len(key), MinKeyLength)
+	}
+	return nil
+}
+
+// NewCodecs returns the codecs for keyPairs, as given to NewCookieStore,
+// like securecookie.CodecsFromPairs but decoding with the limits of
+// GobSerializer, e.g. for the constructors of other stores. It returns an
+// error if a pair is malformed, see CheckKeyPairs.
+func NewCodecs(keyPairs ...[]byte) ([]securecookie.Codec, error) {
+	if err := CheckKeyPairs(keyPairs...); err != nil {
+		return nil, err
+	}
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.SetSerializer(GobSerializer{})
+		}
+	}
+	return codecs, nil
+}
+
+// codecsFromPairs returns NewCodecs(keyPairs...), panicking if a pair is
+// malformed.
+func codecsFromPairs(keyPairs ...[]byte) []securecookie.Codec {
+	codecs, err := NewCodecs(keyPairs...)
+	if err != nil {
+		panic(err)
+	}
+	return codecs
+}
+
+// NewRotatingCookieStore returns a new CookieStore whose authentication and
+// encryption keys rotate independently, see CodecsFromKeys.
+//
+// It panics if a key is malformed, see CheckKeyPairs.
+func NewRotatingCookieStore(hashKeys, blockKeys [][]byte) *CookieStore {
+	cs := &CookieStore{
+		Codecs: CodecsFromKeys(hashKeys, blockKeys),
 		Options: &Options{
 			Path:   "/",
 			MaxAge: 86400 * 30,
@@ -63,10 +228,158 @@ func NewCookieStore(keyPairs ...[]byte) *CookieStore {
 	return cs
 }
 
+// CodecsFromKeys returns the codecs for independent, ordered lists of
+// authentication and encryption keys, newest first, so that each list can
+// be rotated on its own schedule, e.g. the encryption key more often than
+// the authentication key.
+//
+// The first codec encodes with the first key of each list. Decoding tries
+// every combination, all the encryption keys for each authentication key in
+// order; a wrong authentication key is rejected by the MAC check before any
+// decryption, so the cost grows mostly with the number of encryption keys.
+// Sessions decoded with other keys than the first ones are encoded with the
+// current keys when saved.
+//
+// With no encryption keys the values are only authenticated. It panics if
+// there are no authentication keys or if a key is malformed, see
+// CheckKeyPairs.
+func CodecsFromKeys(hashKeys, blockKeys [][]byte) []securecookie.Codec {
+	if len(hashKeys) == 0 {
+		panic("sessions: no authentication key")
+	}
+	if len(blockKeys) == 0 {
+		blockKeys = [][]byte{nil}
+	}
+	keyPairs := make([][]byte, 0, 2*len(hashKeys)*len(blockKeys))
+	for _, hashKey := range hashKeys {
+		for _, blockKey := range blockKeys {
+			keyPairs = append(keyPairs, hashKey, blockKey)
+		}
+	}
+	return codecsFromPairs(keyPairs...)
+}
+
 // CookieStore stores sessions using secure cookies.
 type CookieStore struct {
 	Codecs  []securecookie.Codec
 	Options *Options // default configuration
+	// WarnSize is a soft limit for the length of encoded sessions. When a
+	// saved session exceeds it, OnWarnSize is called but the session is
+	// saved anyway. It is independent of the hard limit of the codecs and
+	// 0, the default, disables it.
+	WarnSize int
+	// OnWarnSize is called with the session name and the encoded length of
+	// sessions larger than WarnSize. If nil a warning is logged.
+	OnWarnSize func(name string, size int)
+	// MaxBytes, if > 0, is a hard limit for the length of encoded sessions,
+	// as a policy to keep handlers from bloating sessions: Save returns an
+	// error wrapping ErrSessionTooLarge for larger sessions, without saving
+	// them. It is checked after WarnSize.
+	MaxBytes int
+	// TokenHeader, if set, is the name of the header carrying the signed
+	// session instead of a cookie, e.g. "X-Session" for API clients: New
+	// reads it from the request and Save writes it to the response.
+	TokenHeader string
+	// OnInvalidCookie, if set, is called by New with the session name and
+	// the decoding error when the request carries a session that could not
+	// be decoded, before falling back to a new session. It is not called
+	// when there is no session in the request.
+	OnInvalidCookie func(name string, err error)
+	// SkipUnchanged, if set, makes Save skip sending the cookie when the
+	// session values and options are the same as when the session was
+	// decoded from the request, to save bandwidth with frequent requests.
+	//
+	// Values are compared decoded with reflect.DeepEqual: encoded values
+	// can't be compared because the gob encoding of maps and the encryption
+	// are not deterministic. Each session is decoded twice to keep a copy.
+	// As the cookie is not sent again, its expiration is not extended:
+	// it expires Options.MaxAge after the last change. This suits single
+	// page applications making many requests with a session set by the
+	// initial page, but it conflicts with rolling sessions, whose
+	// expiration is extended by each response: don't rely on activity to
+	// keep such sessions alive, or change them when they must be extended.
+	SkipUnchanged bool
+	// SkipSaveOnSafeMethods, if set, makes Save do nothing for GET, HEAD
+	// and OPTIONS requests unless the session was modified: its values or
+	// options changed since it was loaded, or it is a new session with
+	// values. This enforces that safe methods don't change state, and
+	// avoids extending the expiration of sessions on reads.
+	//
+	// Values are compared as with SkipUnchanged. TrackLastAccess modifies
+	// the values of every session got from the registry, so don't combine
+	// them.
+	SkipSaveOnSafeMethods bool
+	// ValueCodecs, if set, are the codecs used by Session.SetSecure and
+	// Session.GetSecure to encrypt individual values, e.g.
+	// securecookie.CodecsFromPairs(hashKey, blockKey) while Codecs only
+	// sign the cookie.
+	//
+	// Encrypting only the sensitive values saves the encryption of the
+	// whole cookie on every request, but each secure value carries its own
+	// signature, timestamp and padding, so the cookie grows faster than
+	// with a single encrypted payload when many values are secure.
+	ValueCodecs []securecookie.Codec
+	// MaxAgeLimit, if > 0, is the maximum Options.MaxAge of saved sessions:
+	// Save clamps longer ones to it, whatever the handlers requested.
+	MaxAgeLimit int
+	// OnMaxAgeLimit, if set, is called by Save with the session name and
+	// the requested MaxAge of sessions clamped to MaxAgeLimit.
+	OnMaxAgeLimit func(name string, maxAge int)
+	// FallbackNames maps session names to previous cookie names, to rename
+	// a session cookie without logging users out. When the request has no
+	// cookie for a session, New tries the cookies of the previous names in
+	// turn, and saves the first one that decodes right away under the new
+	// name, expiring the previous cookie.
+	//
+	// It is ignored when TokenHeader is set.
+	FallbackNames map[string][]string
+	// OptionsFunc, if set, returns the options of the sessions of a request,
+	// used by New instead of Options, e.g. to relax the cookie attributes
+	// when embedded in a cross-site iframe. Handlers may still change the
+	// options of a session before saving it. Returning nil falls back to
+	// Options.
+	OptionsFunc func(ctx *fasthttp.RequestCtx) *Options
+	// BindTo, if set, binds sessions to a fingerprint of the client taken
+	// when they are first saved: New returns a new session along with
+	// ErrBindingMismatch for sessions sent by another client, e.g. with a
+	// stolen cookie. The fingerprint is a hash stored in the session.
+	//
+	// The client IP is the remote address of the connection, so it is the
+	// address of the proxy behind a reverse proxy.
+	BindTo Binding
+	// BindIPPrefix, if > 0, is the number of leading bits of IPv4 addresses
+	// bound with BindIP, e.g. 24 to allow clients to roam in a /24 network.
+	// IPv6 addresses are then bound by their /64 network. The default, 0,
+	// binds the exact address.
+	BindIPPrefix int
+	// NamePrefix, if set, is prepended to the session names to get the
+	// cookie names, e.g. to keep apart the sessions of several applications
+	// on the same domain without changing their handlers. It must be a
+	// valid cookie name. The signature of the cookie covers the prefixed
+	// name, while FallbackNames are cookie names and are not prefixed.
+	NamePrefix string
+	// AdditionalData, if set, is bound to the signature of the cookies and
+	// tokens along with their name, e.g. a constant per deployment so that
+	// cookies minted by a staging environment sharing the keys of
+	// production are rejected by it. Only a hash of it is given to the
+	// codecs. Setting or changing it invalidates all the existing cookies
+	// and tokens, as changing the keys does.
+	AdditionalData []byte
+	// ChunkSize, if > 0, splits encoded sessions longer than ChunkSize
+	// bytes across numbered cookies, name.0, name.1 and so on, reassembled
+	// by New, for sessions too large for a single cookie. Save returns an
+	// error for sessions needing more than MaxChunks cookies, 4 if
+	// MaxChunks <= 0. Missing or partial chunks fail to decode like an
+	// invalid cookie.
+	//
+	// Browsers limit the size of each cookie, about 4096 bytes including
+	// the name and attributes, and the number of cookies per domain, and
+	// the Cookie header must fit in the read buffer of the server, see
+	// fasthttp.Server.ReadBufferSize. The codecs also limit the length of
+	// encoded values, see securecookie.SecureCookie.MaxLength. It is
+	// ignored when TokenHeader is set.
+	ChunkSize int
+	MaxChunks int
 }
 
 // Get returns a session for the given name after adding it to the registry.
@@ -85,43 +398,373 @@ func (s *CookieStore) Get(ctx *fasthttp.RequestCtx, name string) (*Session, erro
 // The difference between New() and Get() is that calling New() twice will
 // decode the session data twice, while Get() registers and reuses the same
 // decoded session after the first call.
+//
+// When the session could only be decoded with an old key pair, it is marked
+// to be signed with the first one by the next Save, even if it is unchanged
+// and SkipUnchanged or SkipSaveOnSafeMethods is set, see Session.CodecIndex.
 func (s *CookieStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
 	session := NewSession(s, name)
-	opts := *s.Options
+	opts := requestOptions(ctx, s.Options, s.OptionsFunc)
 	session.Options = &opts
 	session.IsNew = true
-	var err error
-	if c := ctx.Request.Header.Cookie(name); len(c) > 0 {
-		err = securecookie.DecodeMulti(name, string(c), &session.Values,
-			s.Codecs...)
+	cookieName, err := prefixName(s.NamePrefix, name)
+	if err != nil {
+		return session, err
+	}
+	c := readToken(ctx, s.TokenHeader, cookieName)
+	if len(c) == 0 && s.TokenHeader == "" && s.ChunkSize > 0 {
+		c = s.readChunks(ctx, cookieName)
+	}
+	if len(c) > 0 {
+		var i int
+		i, err = s.decode(name, string(c), session)
 		if err == nil {
-			session.IsNew = false
+			err = checkBinding(ctx, session, s.BindTo, s.BindIPPrefix)
+			if err == nil {
+				session.IsNew = false
+				session.codec = i
+			}
+			// Sessions decoded with an old key pair are left without a
+			// loaded copy, so that Save signs them with the current one.
+			if err == nil && i == 0 && (s.SkipUnchanged || s.SkipSaveOnSafeMethods && isSafeMethod(ctx)) {
+				loaded := &loadedSession{options: opts}
+				if s.Codecs[i].Decode(s.codecName(cookieName), string(c), &loaded.values) == nil {
+					session.loaded = loaded
+				}
+			}
+		} else if s.OnInvalidCookie != nil {
+			s.OnInvalidCookie(name, err)
 		}
+	} else if s.TokenHeader == "" {
+		readFallback(ctx, session, s.FallbackNames[name], func(old, value string) error {
+			return DecodeMulti(s.codecName(old), value, &session.Values, s.Codecs...)
+		})
 	}
 	return session, err
 }
 
 // Save adds a single session to the response.
+//
+// See CookieStore.SkipUnchanged to skip unchanged sessions.
 func (s *CookieStore) Save(ctx *fasthttp.RequestCtx, session *Session) error {
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
-		s.Codecs...)
+	saveOptions(ctx, session, s.Options, s.OptionsFunc)
+	if s.SkipSaveOnSafeMethods && isSafeMethod(ctx) && !modified(session) {
+		return nil
+	}
+	if s.SkipUnchanged && session.loaded != nil && session.Options.MaxAge > 0 &&
+		*session.Options == session.loaded.options &&
+		reflect.DeepEqual(session.Values, session.loaded.values) {
+		return nil
+	}
+	session.loaded = nil
+	limitMaxAge(s.MaxAgeLimit, s.OnMaxAgeLimit, session)
+	bindSession(ctx, session, s.BindTo, s.BindIPPrefix)
+	encoded, err := s.Encode(session.Name(), session)
+	if err != nil {
+		return err
+	}
+	warnSize(s.WarnSize, s.OnWarnSize, session.Name(), len(encoded))
+	if err = checkSize(s.MaxBytes, session.Name(), len(encoded)); err != nil {
+		return err
+	}
+	if s.TokenHeader == "" && s.ChunkSize > 0 {
+		return s.writeChunks(ctx, s.NamePrefix+session.Name(), encoded, session.Options)
+	}
+	writeToken(ctx, s.TokenHeader, s.NamePrefix+session.Name(), encoded, session.Options)
+	return nil
+}
+
+// maxChunks returns the maximum number of cookies of a session, see
+// ChunkSize.
+func (s *CookieStore) maxChunks() int {
+	if s.MaxChunks <= 0 {
+		return 4
+	}
+	return s.MaxChunks
+}
+
+// readChunks returns the encoded session split across the cookies of the
+// request for the given name, see ChunkSize.
+func (s *CookieStore) readChunks(ctx *fasthttp.RequestCtx, name string) []byte {
+	var c []byte
+	for i := 0; i < s.maxChunks(); i++ {
+		chunk := ctx.Request.Header.Cookie(chunkName(name, i))
+		if len(chunk) == 0 {
+			break
+		}
+		c = append(c, chunk...)
+	}
+	return c
+}
+
+// writeChunks sends the encoded session in a single cookie for the given
+// name, or split across several if longer than ChunkSize, and expires the
+// cookies of the request not used anymore.
+func (s *CookieStore) writeChunks(ctx *fasthttp.RequestCtx, name, encoded string, options *Options) error {
+	n := 0
+	if options.MaxAge > 0 && len(encoded) > s.ChunkSize {
+		n = (len(encoded) + s.ChunkSize - 1) / s.ChunkSize
+		if n > s.maxChunks() {
+			return fmt.Errorf("sessions: session %q needs %d cookies, more than the limit of %d",
+				name, n, s.maxChunks())
+		}
+	}
+	expired := *options
+	expired.MaxAge = -1
+	if n == 0 {
+		SetCookie(ctx, name, encoded, options)
+	} else {
+		for i := 0; i < n; i++ {
+			end := (i + 1) * s.ChunkSize
+			if end > len(encoded) {
+				end = len(encoded)
+			}
+			chunk := encoded[i*s.ChunkSize : end]
+			SetCookie(ctx, chunkName(name, i), chunk, options)
+		}
+		if len(ctx.Request.Header.Cookie(name)) > 0 {
+			SetCookie(ctx, name, "", &expired)
+		}
+	}
+	for i := n; i < s.maxChunks(); i++ {
+		if len(ctx.Request.Header.Cookie(chunkName(name, i))) > 0 {
+			SetCookie(ctx, chunkName(name, i), "", &expired)
+		}
+	}
+	return nil
+}
+
+// chunkName returns the name of the cookie of chunk i of a session.
+func chunkName(name string, i int) string {
+	return name + "." + strconv.Itoa(i)
+}
+
+// Encode encodes the values of session for the given name with the first
+// codec, as Save does for the cookie value, without a request, e.g. to mint
+// session tokens out of band. The name is prefixed with NamePrefix.
+func (s *CookieStore) Encode(name string, session *Session) (string, error) {
+	name, err := prefixName(s.NamePrefix, name)
+	if err != nil {
+		return "", err
+	}
+	return securecookie.EncodeMulti(s.codecName(name), session.Values, s.Codecs...)
+}
+
+// Decode decodes value, as encoded by Encode, into the values of session,
+// trying each codec in turn as New does.
+//
+// It returns ErrSignatureInvalid if the value was not signed with any of the
+// keys.
+func (s *CookieStore) Decode(name, value string, session *Session) error {
+	_, err := s.decode(name, value, session)
+	return err
+}
+
+// EncodeToken encodes values with the codecs into a token valid for ttl,
+// independent of the session cookies, e.g. for a magic login link. Tokens
+// use the URL-safe base64 alphabet; they are signed, and encrypted if the
+// codecs are, then decoded by DecodeToken.
+//
+// The tokens are signed for a reserved name, so they can't be used as
+// session cookies, and their expiration is stored in the values. The max
+// age of the codecs still applies.
+func (s *CookieStore) EncodeToken(values map[interface{}]interface{}, ttl time.Duration) (string, error) {
+	token := make(map[interface{}]interface{}, len(values)+1)
+	for k, v := range values {
+		token[k] = v
+	}
+	token[tokenExpiresKey] = time.Now().Add(ttl).Unix()
+	return securecookie.EncodeMulti(s.codecName(tokenName), token, s.Codecs...)
+}
+
+// DecodeToken decodes a token returned by EncodeToken into its values.
+//
+// It returns ErrSignatureInvalid if the token was not signed with any of the
+// keys, and ErrTokenExpired once it expired.
+func (s *CookieStore) DecodeToken(token string) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{})
+	if err := DecodeMulti(s.codecName(tokenName), token, &values, s.Codecs...); err != nil {
+		return nil, err
+	}
+	expires, ok := values[tokenExpiresKey]
+	if !ok || time.Now().Unix() > valueInt64(expires) {
+		return nil, ErrTokenExpired
+	}
+	delete(values, tokenExpiresKey)
+	return values, nil
+}
+
+// Name the tokens returned by CookieStore.EncodeToken are signed for, and
+// key of their expiration time.
+const (
+	tokenName       = "_token"
+	tokenExpiresKey = "_token_expires"
+)
+
+// EncodeSession returns the cookie value of a session with the given name
+// and values for store, without a request, e.g. for tools minting sessions
+// with the keys of a server or tests seeding a logged-in state. The cookie
+// is accepted by store.New as if saved by store.Save.
+func EncodeSession(store *CookieStore, name string, values map[interface{}]interface{}) (string, error) {
+	session := NewSession(store, name)
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	return store.Encode(name, session)
+}
+
+// decode is Decode returning the index of the codec that decoded value.
+func (s *CookieStore) decode(name, value string, session *Session) (int, error) {
+	name, err := prefixName(s.NamePrefix, name)
+	if err != nil {
+		return -1, err
+	}
+	return decodeIndex(s.codecName(name), value, &session.Values, s.Codecs...)
+}
+
+// codecName returns the name values of the given name are encoded for by
+// the codecs, bound to AdditionalData if set.
+func (s *CookieStore) codecName(name string) string {
+	if len(s.AdditionalData) == 0 {
+		return name
+	}
+	sum := sha256.Sum256(s.AdditionalData)
+	return name + "|" + hex.EncodeToString(sum[:])
+}
+
+// namePrefix returns the prefix of the cookie names of store, if any.
+func namePrefix(store Store) string {
+	switch s := store.(type) {
+	case *CookieStore:
+		return s.NamePrefix
+	case *FilesystemStore:
+		return s.NamePrefix
+	}
+	return ""
+}
+
+// storeBinding returns the BindTo and BindIPPrefix settings of store, if any.
+func storeBinding(store Store) (Binding, int) {
+	switch s := store.(type) {
+	case *CookieStore:
+		return s.BindTo, s.BindIPPrefix
+	case *FilesystemStore:
+		return s.BindTo, s.BindIPPrefix
+	}
+	return 0, 0
+}
+
+// prefixName returns name with the given prefix, checking that the prefix is
+// a valid cookie name.
+func prefixName(prefix, name string) (string, error) {
+	if prefix != "" && !isCookieNameValid(prefix) {
+		return "", fmt.Errorf("sessions: invalid character in name prefix: %s", prefix)
+	}
+	return prefix + name, nil
+}
+
+// tokenHeader returns the header carrying the sessions of store, if any.
+func tokenHeader(store Store) string {
+	switch s := store.(type) {
+	case *CookieStore:
+		return s.TokenHeader
+	case *FilesystemStore:
+		return s.TokenHeader
+	}
+	return ""
+}
+
+// secureCodecs returns the value codecs of store, if any.
+func secureCodecs(store Store) []securecookie.Codec {
+	if cs, ok := store.(*CookieStore); ok {
+		return cs.ValueCodecs
+	}
+	return nil
+}
+
+// Serializer sets the serializer used to encode session values. The default
+// is GobSerializer, see MsgpackSerializer for an alternative and
+// VersionedSerializer to migrate the values as their types change.
+//
+// Setting it on a SignedCodec keeps its output deterministic only if sz is,
+// see SignedCodec.Serializer.
+func (s *CookieStore) Serializer(sz securecookie.Serializer) {
+	for _, codec := range s.Codecs {
+		switch c := codec.(type) {
+		case *securecookie.SecureCookie:
+			c.SetSerializer(sz)
+		case *SignedCodec:
+			c.Serializer = sz
+		}
+	}
+}
+
+// Validate encodes and decodes a probe session with the codecs, to detect
+// invalid keys.
+//
+// See Validator.
+func (s *CookieStore) Validate() error {
+	values := map[interface{}]interface{}{"probe": true}
+	encoded, err := s.Encode("probe", &Session{Values: values})
 	if err != nil {
 		return err
 	}
-	ctx.Response.Header.SetCookie(NewCookie(session.Name(), encoded, session.Options))
+	return s.Decode("probe", encoded, NewSession(s, "probe"))
+}
+
+// Ping does nothing and returns nil: the sessions live in the clients'
+// cookies, there is no backend to reach.
+//
+// See Pinger.
+func (s *CookieStore) Ping(ctx context.Context) error {
 	return nil
 }
 
+// DeleteByUser is not supported by CookieStore: the sessions live in the
+// clients' cookies, so they cannot be removed server-side. It always returns
+// an error.
+func (s *CookieStore) DeleteByUser(userID string) (int, error) {
+	return 0, errors.New("sessions: CookieStore cannot delete sessions by user")
+}
+
+// DeleteWhere is not supported by CookieStore: the sessions live in the
+// clients' cookies, so they cannot be removed server-side. It always returns
+// an error.
+func (s *CookieStore) DeleteWhere(name string, pred func(*Session) bool) (int, error) {
+	return 0, errors.New("sessions: CookieStore cannot delete sessions server-side")
+}
+
+// CountByUser is not supported by CookieStore: the sessions live in the
+// clients' cookies, so they cannot be counted server-side. It always returns
+// an error.
+func (s *CookieStore) CountByUser(userID string) (int, error) {
+	return 0, errors.New("sessions: CookieStore cannot count sessions by user")
+}
+
+// Reencrypt is not supported by CookieStore: the sessions live in the
+// clients' cookies, they are encoded with the new keys when saved again. It
+// always returns an error.
+func (s *CookieStore) Reencrypt(name string, newKeyPairs ...[]byte) (int, error) {
+	return 0, errors.New("sessions: CookieStore cannot re-encrypt sessions")
+}
+
 // MaxAge sets the maximum age for the store and the underlying cookie
 // implementation. Individual sessions can be deleted by setting Options.MaxAge
 // = -1 for that session.
 func (s *CookieStore) MaxAge(age int) {
 	s.Options.MaxAge = age
 
-	// Set the maxAge for each securecookie instance.
+	// Set the maxAge for each securecookie, JWT, Ed25519 or derived instance.
 	for _, codec := range s.Codecs {
-		if sc, ok := codec.(*securecookie.SecureCookie); ok {
-			sc.MaxAge(age)
+		switch c := codec.(type) {
+		case *securecookie.SecureCookie:
+			c.MaxAge(age)
+		case *JWTCodec:
+			c.MaxAge(age)
+		case *Ed25519Codec:
+			c.MaxAge(age)
+		case *DerivedCodec:
+			c.MaxAge(age)
 		}
 	}
 }
@@ -141,11 +784,12 @@ func NewFilesystemStore(path string, keyPairs ...[]byte) *FilesystemStore {
 		path = os.TempDir()
 	}
 	fs := &FilesystemStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Codecs: codecsFromPairs(keyPairs...),
 		Options: &Options{
 			Path:   "/",
 			MaxAge: 86400 * 30,
 		},
+		Rand: rand.Reader,
 		path: path,
 	}
 
@@ -155,26 +799,184 @@ func NewFilesystemStore(path string, keyPairs ...[]byte) *FilesystemStore {
 
 // FilesystemStore stores sessions in the filesystem.
 //
+// Each session is saved in a file named after the storage key of its ID, see
+// StorageKey, not after the ID itself. Files saved by previous versions under
+// the raw ID are still loaded, and replaced by a file named after the storage
+// key on the next Save.
+//
+// Session files are encoded with the same codecs as the cookie, so when an
+// encryption key is provided the on-disk payload is encrypted as well as
+// signed, and a leaked copy of the session directory does not expose the
+// raw session values.
+//
 // It also serves as a reference for custom stores.
 //
 // This store is still experimental and not well tested. Feedback is welcome.
 type FilesystemStore struct {
 	Codecs  []securecookie.Codec
 	Options *Options // default configuration
-	path    string
+	// Rand is the source of randomness used to generate session IDs. It
+	// defaults to crypto/rand.Reader.
+	//
+	// It is meant for tests that need deterministic session IDs ONLY: never
+	// replace it in production, as predictable IDs allow session hijacking.
+	// It only affects the session IDs: CSRF tokens, the data keys and nonces
+	// of EnvelopeStore, the values of Session.SetSecure and the nonces of the
+	// securecookie codecs are always read from crypto/rand.
+	Rand io.Reader
+	// WarnSize is a soft limit for the length of encoded session files.
+	//
+	// See CookieStore.WarnSize.
+	WarnSize int
+	// OnWarnSize is called for session files larger than WarnSize.
+	//
+	// See CookieStore.OnWarnSize.
+	OnWarnSize func(name string, size int)
+	// MaxBytes, if > 0, is a hard limit for the length of encoded session
+	// files.
+	//
+	// See CookieStore.MaxBytes.
+	MaxBytes int
+	// TokenHeader, if set, is the name of the header carrying the signed
+	// session ID instead of a cookie.
+	//
+	// See CookieStore.TokenHeader.
+	TokenHeader string
+	// OnInvalidCookie, if set, is called by New when the session ID in the
+	// request could not be decoded.
+	//
+	// See CookieStore.OnInvalidCookie.
+	OnInvalidCookie func(name string, err error)
+	// MaxAgeLimit, if > 0, is the maximum Options.MaxAge of saved sessions.
+	//
+	// See CookieStore.MaxAgeLimit.
+	MaxAgeLimit int
+	// OnMaxAgeLimit is called for sessions clamped to MaxAgeLimit.
+	//
+	// See CookieStore.OnMaxAgeLimit.
+	OnMaxAgeLimit func(name string, maxAge int)
+	// FallbackNames maps session names to previous cookie names.
+	//
+	// See CookieStore.FallbackNames.
+	FallbackNames map[string][]string
+	// OptionsFunc, if set, returns the options of the sessions of a request.
+	//
+	// See CookieStore.OptionsFunc.
+	OptionsFunc func(ctx *fasthttp.RequestCtx) *Options
+	// BindTo, if set, binds sessions to a fingerprint of the client.
+	//
+	// See CookieStore.BindTo.
+	BindTo Binding
+	// BindIPPrefix is the number of leading bits of IPv4 addresses bound
+	// with BindIP.
+	//
+	// See CookieStore.BindIPPrefix.
+	BindIPPrefix int
+	// NamePrefix, if set, is prepended to the session names to get the
+	// cookie names.
+	//
+	// See CookieStore.NamePrefix.
+	NamePrefix string
+	// FileSerializer, if set, is used to write the session files in clear,
+	// instead of the codecs, e.g. JSONSerializer to inspect them during
+	// development. The cookie is still encoded with the codecs.
+	//
+	// The files are neither signed nor encrypted then, so don't use it in
+	// production, and Reencrypt skips them.
+	//
+	// If it implements StreamSerializer, e.g. GobSerializer, the files are
+	// streamed instead of being encoded in memory first, to save memory
+	// with large sessions. They are written to a temporary file renamed
+	// over the session file, so concurrent saves never interleave, with or
+	// without LockFiles.
+	FileSerializer securecookie.Serializer
+	// LockFiles, if set, makes the store hold an advisory lock on session
+	// files while reading and writing them, flock on Unix and nothing on
+	// other systems, so concurrent saves of the same session by several
+	// processes sharing the directory are serialized. Saves within a
+	// process are always serialized.
+	//
+	// Locking only protects the content of the files from interleaved
+	// writes: the last request saving a session still replaces the values
+	// saved by concurrent requests since it was loaded. It adds a system
+	// call to every load and save, so it is disabled by default.
+	LockFiles bool
+	// Compress, if set, makes the store gzip the session files. Files are
+	// decompressed on load if they start with the gzip magic bytes, so
+	// compressed and uncompressed files can be mixed in the directory,
+	// e.g. when enabling it on a running store.
+	//
+	// Encrypted values hardly compress beyond the overhead of their base64
+	// encoding: it mostly pays off with FileSerializer or codecs without
+	// an encryption key.
+	Compress bool
+	// RotateEvery, if > 0, makes Save give the session a new ID every
+	// RotateEvery saves, and RotateAfter, if > 0, when its ID is older than
+	// RotateAfter, to limit the window of a stolen cookie. The values are
+	// preserved and the session saved under the previous ID is removed.
+	//
+	// The number of saves and the time of the last rotation are tracked in
+	// the session values, so requests that don't save the session are not
+	// counted.
+	RotateEvery int
+	RotateAfter time.Duration
+	// CheckVersion, if set, enables optimistic concurrency: sessions carry
+	// a version in their values, incremented by each Save, and Save returns
+	// ErrConflict without saving when the stored session was saved by
+	// another request since it was loaded. Handlers can then load the
+	// session again and retry.
+	//
+	// The check is atomic within a process only. Sessions deleted or
+	// rotated in the meantime are saved without conflict.
+	CheckVersion bool
+	// SkipUnchanged, if set, makes Save skip sending the cookie when the
+	// request already carries a valid cookie with the same session ID and
+	// the options are the same as when the session was loaded. The session
+	// file is still written, so changes to the values are saved.
+	//
+	// See CookieStore.SkipUnchanged for the interaction with the
+	// expiration of the cookie.
+	SkipUnchanged bool
+	// SkipSaveOnSafeMethods, if set, makes Save do nothing for GET, HEAD
+	// and OPTIONS requests unless the session was modified. Each session
+	// file is read twice to keep a copy of the values.
+	//
+	// See CookieStore.SkipSaveOnSafeMethods.
+	SkipSaveOnSafeMethods bool
+	path                  string
+	codecsMu              sync.RWMutex // guards Codecs during Reencrypt
+}
+
+// codecs returns the current codecs, which Reencrypt may replace while the
+// store is serving.
+func (s *FilesystemStore) codecs() []securecookie.Codec {
+	s.codecsMu.RLock()
+	defer s.codecsMu.RUnlock()
+	return s.Codecs
 }
 
 // MaxLength restricts the maximum length of new sessions to l.
 // If l is 0 there is no limit to the size of a session, use with caution.
 // The default for a new FilesystemStore is 4096.
 func (s *FilesystemStore) MaxLength(l int) {
-	for _, c := range s.Codecs {
+	for _, c := range s.codecs() {
 		if codec, ok := c.(*securecookie.SecureCookie); ok {
 			codec.MaxLength(l)
 		}
 	}
 }
 
+// Serializer sets the serializer used to encode session values.
+//
+// See CookieStore.Serializer().
+func (s *FilesystemStore) Serializer(sz securecookie.Serializer) {
+	for _, codec := range s.codecs() {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.SetSerializer(sz)
+		}
+	}
+}
+
 // Get returns a session for the given name after adding it to the registry.
 //
 // See CookieStore.Get().
@@ -187,18 +989,48 @@ func (s *FilesystemStore) Get(ctx *fasthttp.RequestCtx, name string) (*Session,
 // See CookieStore.New().
 func (s *FilesystemStore) New(ctx *fasthttp.RequestCtx, name string) (*Session, error) {
 	session := NewSession(s, name)
-	opts := *s.Options
+	opts := requestOptions(ctx, s.Options, s.OptionsFunc)
 	session.Options = &opts
 	session.IsNew = true
-	var err error
-	if c := ctx.Request.Header.Cookie(name); len(c) > 0 {
-		err = securecookie.DecodeMulti(name, string(c), &session.ID, s.Codecs...)
+	cookieName, err := prefixName(s.NamePrefix, name)
+	if err != nil {
+		return session, err
+	}
+	if c := readToken(ctx, s.TokenHeader, cookieName); len(c) > 0 {
+		var i int
+		i, err = decodeIndex(cookieName, string(c), &session.ID, s.codecs()...)
 		if err == nil {
-			err = s.load(session)
+			err = s.load(name, session)
+			if err == nil {
+				err = checkBinding(ctx, session, s.BindTo, s.BindIPPrefix)
+			}
 			if err == nil {
 				session.IsNew = false
+				session.codec = i
+				// Sessions decoded with an old key pair are left
+				// without a loaded copy, so that Save signs them with
+				// the current one.
+				if i == 0 && (s.SkipUnchanged || s.SkipSaveOnSafeMethods && isSafeMethod(ctx)) {
+					session.loaded = &loadedSession{options: opts, id: session.ID}
+					if s.SkipSaveOnSafeMethods {
+						loaded := NewSession(s, name)
+						loaded.ID = session.ID
+						if s.load(name, loaded) == nil {
+							session.loaded.values = loaded.Values
+						}
+					}
+				}
 			}
+		} else if s.OnInvalidCookie != nil {
+			s.OnInvalidCookie(name, err)
 		}
+	} else if s.TokenHeader == "" {
+		readFallback(ctx, session, s.FallbackNames[name], func(old, value string) error {
+			if _, err := decodeIndex(old, value, &session.ID, s.codecs()...); err != nil {
+				return err
+			}
+			return s.load(old, session)
+		})
 	}
 	return session, err
 }
@@ -210,34 +1042,71 @@ func (s *FilesystemStore) New(ctx *fasthttp.RequestCtx, name string) (*Session,
 // session cookie handling so no need to trust in the cookie management in the
 // web browser.
 func (s *FilesystemStore) Save(ctx *fasthttp.RequestCtx, session *Session) error {
+	cookieName, err := prefixName(s.NamePrefix, session.Name())
+	if err != nil {
+		return err
+	}
+	saveOptions(ctx, session, s.Options, s.OptionsFunc)
+	if s.SkipSaveOnSafeMethods && isSafeMethod(ctx) && !modified(session) {
+		return nil
+	}
+	unchanged := s.SkipUnchanged && session.loaded != nil &&
+		*session.Options == session.loaded.options
+	limitMaxAge(s.MaxAgeLimit, s.OnMaxAgeLimit, session)
 	// Delete if max-age is <= 0
 	if session.Options.MaxAge <= 0 {
 		if err := s.erase(session); err != nil {
 			return err
 		}
-		ctx.Response.Header.SetCookie(NewCookie(session.Name(), "", session.Options))
+		writeToken(ctx, s.TokenHeader, cookieName, "", session.Options)
 		return nil
 	}
 
+	bindSession(ctx, session, s.BindTo, s.BindIPPrefix)
+	if session.ID != "" && s.rotationDue(session) {
+		if err := s.rotate(session); err != nil {
+			return err
+		}
+	}
 	if session.ID == "" {
-		// Because the ID is used in the filename, encode it to
-		// use alphanumeric characters only.
-		session.ID = strings.TrimRight(
-			base32.StdEncoding.EncodeToString(
-				securecookie.GenerateRandomKey(32)), "=")
+		id, err := s.generateID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+	if s.RotateEvery > 0 || s.RotateAfter > 0 {
+		session.Values[rotateCountKey] = valueInt64(session.Values[rotateCountKey]) + 1
+		if _, ok := session.Values[rotatedAtKey]; !ok {
+			session.Values[rotatedAtKey] = time.Now().Unix()
+		}
 	}
 	if err := s.save(session); err != nil {
 		return err
 	}
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		s.Codecs...)
+	if unchanged && session.ID == session.loaded.id {
+		return nil
+	}
+	session.loaded = nil
+	encoded, err := securecookie.EncodeMulti(cookieName, session.ID,
+		s.codecs()...)
 	if err != nil {
 		return err
 	}
-	ctx.Response.Header.SetCookie(NewCookie(session.Name(), encoded, session.Options))
+	writeToken(ctx, s.TokenHeader, cookieName, encoded, session.Options)
 	return nil
 }
 
+// Regenerate gives session a new ID and saves it, preserving its values, and
+// removes the session saved under the previous ID, e.g. after a login to
+// prevent session fixation.
+func (s *FilesystemStore) Regenerate(ctx *fasthttp.RequestCtx, session *Session) error {
+	if err := s.rotate(session); err != nil {
+		return err
+	}
+	return s.Save(ctx, session)
+}
+
 // MaxAge sets the maximum age for the store and the underlying cookie
 // implementation. Individual sessions can be deleted by setting Options.MaxAge
 // = -1 for that session.
@@ -245,49 +1114,890 @@ func (s *FilesystemStore) MaxAge(age int) {
 	s.Options.MaxAge = age
 
 	// Set the maxAge for each securecookie instance.
-	for _, codec := range s.Codecs {
+	for _, codec := range s.codecs() {
 		if sc, ok := codec.(*securecookie.SecureCookie); ok {
 			sc.MaxAge(age)
 		}
 	}
 }
 
-// save writes encoded session.Values to a file.
-func (s *FilesystemStore) save(session *Session) error {
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
-		s.Codecs...)
-	if err != nil {
-		return err
-	}
-	filename := filepath.Join(s.path, "session_"+session.ID)
+// DeleteByUser removes all the sessions tagged with the given user ID, see
+// Session.SetUser, and returns the number of sessions removed.
+func (s *FilesystemStore) DeleteByUser(userID string) (int, error) {
+	pattern := filepath.Join(s.path, "user_"+encodeUserID(userID)+"_*")
 	fileMutex.Lock()
 	defer fileMutex.Unlock()
-	return ioutil.WriteFile(filename, []byte(encoded), 0600)
-}
-
-// load reads a file and decodes its content into session.Values.
-func (s *FilesystemStore) load(session *Session) error {
-	filename := filepath.Join(s.path, "session_"+session.ID)
-	fileMutex.RLock()
-	defer fileMutex.RUnlock()
-	fdata, err := ioutil.ReadFile(filename)
+	indexes, err := filepath.Glob(pattern)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if err = securecookie.DecodeMulti(session.Name(), string(fdata),
-		&session.Values, s.Codecs...); err != nil {
-		return err
+	n := 0
+	for _, index := range indexes {
+		key := index[strings.LastIndex(index, "_")+1:]
+		err = os.Remove(filepath.Join(s.path, "session_"+key))
+		if err == nil {
+			n++
+		} else if !os.IsNotExist(err) {
+			return n, &StorageError{Op: "delete", Err: err}
+		}
+		if err = os.Remove(index); err != nil && !os.IsNotExist(err) {
+			return n, &StorageError{Op: "delete", Err: err}
+		}
 	}
-	return nil
+	return n, nil
 }
 
-// delete session file
-func (s *FilesystemStore) erase(session *Session) error {
-	filename := filepath.Join(s.path, "session_"+session.ID)
-
-	fileMutex.RLock()
-	defer fileMutex.RUnlock()
-
-	err := os.Remove(filename)
-	return err
+// DeleteWhere removes the stored sessions saved with the given session name
+// for which pred returns true, e.g. all the sessions of a user for a data
+// subject erasure request, and returns the number of sessions removed. The
+// name is needed to decode the files encoded with the codecs.
+//
+// pred is given the session with its values; its ID is empty, as the store
+// only keeps a hash of it. Sessions that could not be decoded, e.g. because
+// they were saved with another name, are left untouched.
+//
+// It reads and decodes every session file while blocking the other
+// operations of the stores on the files: it is meant for admin tasks, not
+// for the request hot path. Use DeleteByUser for sessions tagged with
+// Session.SetUser, which only reads an index.
+func (s *FilesystemStore) DeleteWhere(name string, pred func(*Session) bool) (int, error) {
+	keys, err := s.List("")
+	if err != nil {
+		return 0, err
+	}
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	n := 0
+	for _, key := range keys {
+		session := NewSession(s, name)
+		session.IsNew = false
+		filename := filepath.Join(s.path, "session_"+key)
+		if err = s.read(name, filename, &session.Values); err != nil {
+			if _, ok := err.(*StorageError); ok {
+				return n, err
+			}
+			continue
+		}
+		if !pred(session) {
+			continue
+		}
+		if err = os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return n, &StorageError{Op: "delete", Err: err}
+		}
+		n++
+		if userID := session.User(); userID != "" {
+			index := filepath.Join(s.path, "user_"+encodeUserID(userID)+"_"+key)
+			if err = os.Remove(index); err != nil && !os.IsNotExist(err) {
+				return n, &StorageError{Op: "delete", Err: err}
+			}
+		}
+	}
+	return n, nil
+}
+
+// Reencrypt rewrites the stored sessions saved with the given session name,
+// decoding them with the current codecs and encoding them with codecs
+// created from newKeyPairs by NewCodecs, which are used by the store
+// afterwards. It returns the number of sessions rewritten. It is safe to call
+// while the store is serving: the codecs are replaced once all the files are
+// rewritten.
+//
+// Session cookies hold the session ID encoded with the current keys, so keep
+// the current key pairs after the new ones in newKeyPairs to accept them.
+// Sessions that could not be decoded, e.g. because they were saved with
+// another name or have expired, are left untouched, and so are all the files
+// when FileSerializer is set, as they are not encoded with the codecs. The
+// files are read and written honouring LockFiles and Compress. The new
+// codecs use the default settings besides the store MaxAge, so call
+// MaxLength or Serializer again if needed.
+func (s *FilesystemStore) Reencrypt(name string, newKeyPairs ...[]byte) (int, error) {
+	codecs, err := NewCodecs(newKeyPairs...)
+	if err != nil {
+		return 0, err
+	}
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(s.Options.MaxAge)
+		}
+	}
+
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	n := 0
+	if s.FileSerializer == nil {
+		files, err := filepath.Glob(filepath.Join(s.path, "session_*"))
+		if err != nil {
+			return 0, err
+		}
+		for _, filename := range files {
+			values := make(map[interface{}]interface{})
+			if err = s.read(name, filename, &values); err != nil {
+				if _, ok := err.(*StorageError); ok {
+					return n, err
+				}
+				continue
+			}
+			encoded, err := securecookie.EncodeMulti(name, values, codecs...)
+			if err != nil {
+				return n, err
+			}
+			if err = s.writeFile(filename, []byte(encoded)); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	s.codecsMu.Lock()
+	s.Codecs = codecs
+	s.codecsMu.Unlock()
+	return n, nil
+}
+
+// Ping checks that the store path is a directory.
+//
+// See Pinger.
+func (s *FilesystemStore) Ping(ctx context.Context) error {
+	fi, err := os.Stat(s.path)
+	if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("%s is not a directory", s.path)
+	}
+	if err != nil {
+		return &StorageError{Op: "ping", Err: err}
+	}
+	return nil
+}
+
+// Validate writes, reads and deletes a probe file in the store path, to
+// detect a missing or unwritable directory, after checking the codecs with
+// a probe session.
+//
+// See Validator.
+func (s *FilesystemStore) Validate() error {
+	values := map[interface{}]interface{}{"probe": true}
+	encoded, err := securecookie.EncodeMulti("probe", values, s.codecs()...)
+	if err != nil {
+		return err
+	}
+	if err = DecodeMulti("probe", encoded, &values, s.codecs()...); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.path, "probe_")
+	if err != nil {
+		return &StorageError{Op: "validate", Err: err}
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte(encoded))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		_, err = ioutil.ReadFile(f.Name())
+	}
+	if err == nil {
+		err = os.Remove(f.Name())
+	}
+	if err != nil {
+		return &StorageError{Op: "validate", Err: err}
+	}
+	return nil
+}
+
+// List returns the storage keys of the sessions stored in the store path
+// starting with prefix, reading the whole directory.
+//
+// See Lister.
+func (s *FilesystemStore) List(prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, &StorageError{Op: "list", Err: err}
+	}
+	var keys []string
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasPrefix(file.Name(), "session_"+prefix) {
+			keys = append(keys, strings.TrimPrefix(file.Name(), "session_"))
+		}
+	}
+	return keys, nil
+}
+
+// Stats returns the number of sessions stored in the store path and their
+// total size in bytes.
+//
+// Sessions saved or deleted while the directory is read may or may not be
+// counted, so the result is a best-effort snapshot.
+func (s *FilesystemStore) Stats() (count int, totalBytes int64, err error) {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasPrefix(file.Name(), "session_") {
+			count++
+			totalBytes += file.Size()
+		}
+	}
+	return count, totalBytes, nil
+}
+
+// CountByUser returns the number of sessions tagged with the given user ID,
+// see Session.SetUser, e.g. to limit the number of concurrent sessions of a
+// user at login. Expired sessions are counted until their file is removed.
+func (s *FilesystemStore) CountByUser(userID string) (int, error) {
+	pattern := filepath.Join(s.path, "user_"+encodeUserID(userID)+"_*")
+	fileMutex.RLock()
+	defer fileMutex.RUnlock()
+	indexes, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, index := range indexes {
+		key := index[strings.LastIndex(index, "_")+1:]
+		_, err = os.Stat(filepath.Join(s.path, "session_"+key))
+		if err == nil {
+			n++
+		} else if !os.IsNotExist(err) {
+			return n, &StorageError{Op: "load", Err: err}
+		}
+	}
+	return n, nil
+}
+
+// rotationDue reports whether the ID of session must be rotated, see
+// RotateEvery.
+func (s *FilesystemStore) rotationDue(session *Session) bool {
+	if s.RotateEvery > 0 && valueInt64(session.Values[rotateCountKey]) >= int64(s.RotateEvery) {
+		return true
+	}
+	at := valueInt64(session.Values[rotatedAtKey])
+	return s.RotateAfter > 0 && at > 0 &&
+		time.Since(time.Unix(at, 0)) >= s.RotateAfter
+}
+
+// rotate removes the session saved under the current ID of session and
+// clears it, so that the session is saved under a new ID.
+func (s *FilesystemStore) rotate(session *Session) error {
+	if session.ID != "" {
+		if err := s.erase(session); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	delete(session.Values, rotateCountKey)
+	delete(session.Values, rotatedAtKey)
+	return nil
+}
+
+// generateID returns a new random session ID read from s.Rand.
+func (s *FilesystemStore) generateID() (string, error) {
+	r := s.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	// Because the ID is used in the filename, encode it to
+	// use alphanumeric characters only.
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(b), "="), nil
+}
+
+// save writes encoded session.Values to a file, checking its version first
+// if CheckVersion is set. If the stored session was tagged with another
+// user, its entry in the index of that user is removed.
+func (s *FilesystemStore) save(session *Session) error {
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	stored := make(map[interface{}]interface{})
+	err := s.read(session.Name(), s.filename(session.ID), &stored)
+	if err != nil {
+		stored = nil
+	}
+	version := valueInt64(session.Values[versionKey])
+	if s.CheckVersion {
+		if stored != nil && valueInt64(stored[versionKey]) != version {
+			return ErrConflict
+		}
+		session.Values[versionKey] = version + 1
+	}
+	if err = s.write(session); err != nil {
+		if s.CheckVersion {
+			session.Values[versionKey] = version
+		}
+		return err
+	}
+	if stored == nil {
+		if err = s.removeLegacy(session.ID); err != nil {
+			return err
+		}
+	}
+	if previous, _ := stored[userKey].(string); previous != "" && previous != session.User() {
+		index := s.userIndexFile(previous, session.ID)
+		if err = os.Remove(index); err != nil && !os.IsNotExist(err) {
+			return &StorageError{Op: "save", Err: err}
+		}
+	}
+	return nil
+}
+
+// write writes encoded session.Values to a file. The caller must hold
+// fileMutex.
+func (s *FilesystemStore) write(session *Session) error {
+	filename := s.filename(session.ID)
+	if ss, ok := s.FileSerializer.(StreamSerializer); ok {
+		if err := s.writeStream(filename, ss, session); err != nil {
+			return err
+		}
+	} else {
+		encoded, err := s.encode(session)
+		if err != nil {
+			return err
+		}
+		warnSize(s.WarnSize, s.OnWarnSize, session.Name(), len(encoded))
+		if err = checkSize(s.MaxBytes, session.Name(), len(encoded)); err != nil {
+			return err
+		}
+		if err = s.writeFile(filename, []byte(encoded)); err != nil {
+			return err
+		}
+	}
+	if userID := session.User(); userID != "" {
+		err := ioutil.WriteFile(s.userIndexFile(userID, session.ID), nil, 0600)
+		if err != nil {
+			return &StorageError{Op: "save", Err: err}
+		}
+	}
+	return nil
+}
+
+// writeFile writes data to filename, compressed if Compress is set. The
+// caller must hold fileMutex.
+func (s *FilesystemStore) writeFile(filename string, data []byte) error {
+	var err error
+	if s.Compress {
+		if data, err = compress(data); err != nil {
+			return err
+		}
+	}
+	if s.LockFiles {
+		err = writeFileLocked(filename, data)
+	} else {
+		err = ioutil.WriteFile(filename, data, 0600)
+	}
+	if err != nil {
+		return &StorageError{Op: "save", Err: err}
+	}
+	return nil
+}
+
+// writeStream streams session.Values encoded with ss to a temporary file,
+// compressed if Compress is set, and renames it to filename. The size
+// checked against WarnSize and MaxBytes is the size of the encoding before
+// compression, as for files encoded in memory.
+func (s *FilesystemStore) writeStream(filename string, ss StreamSerializer, session *Session) error {
+	f, err := ioutil.TempFile(s.path, "tmp_")
+	if err != nil {
+		return &StorageError{Op: "save", Err: err}
+	}
+	// Removes the temporary file on failure, it is gone once renamed.
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	buf := bufio.NewWriter(f)
+	var w io.Writer = buf
+	var gz *gzip.Writer
+	if s.Compress {
+		gz = gzip.NewWriter(buf)
+		w = gz
+	}
+	cw := &sizeWriter{w: w, limit: s.MaxBytes, name: session.Name()}
+	if err = ss.SerializeTo(cw, session.Values); err != nil {
+		if cw.err != nil {
+			return cw.err
+		}
+		return err
+	}
+	warnSize(s.WarnSize, s.OnWarnSize, session.Name(), cw.n)
+	if gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		return &StorageError{Op: "save", Err: err}
+	}
+	return nil
+}
+
+// sizeWriter counts the bytes written to w, and fails with the error of
+// checkSize once they exceed limit.
+type sizeWriter struct {
+	w     io.Writer
+	n     int
+	limit int
+	name  string
+	err   error
+}
+
+// Write writes p to the underlying writer, unless it exceeds the limit.
+func (w *sizeWriter) Write(p []byte) (int, error) {
+	if w.err = checkSize(w.limit, w.name, w.n+len(p)); w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += n
+	if err != nil {
+		w.err = &StorageError{Op: "save", Err: err}
+	}
+	return n, w.err
+}
+
+// encode encodes session.Values to be written to a file, with FileSerializer
+// if set or else with the codecs.
+func (s *FilesystemStore) encode(session *Session) (string, error) {
+	if s.FileSerializer != nil {
+		b, err := s.FileSerializer.Serialize(session.Values)
+		return string(b), err
+	}
+	return securecookie.EncodeMulti(session.Name(), session.Values, s.codecs()...)
+}
+
+// load reads a file and decodes its content into session.Values, as saved
+// for the session name.
+func (s *FilesystemStore) load(name string, session *Session) error {
+	fileMutex.RLock()
+	defer fileMutex.RUnlock()
+	err := s.read(name, s.filename(session.ID), &session.Values)
+	if err == ErrSessionNotFound {
+		if legacy := s.legacyFilename(session.ID); legacy != "" {
+			err = s.read(name, legacy, &session.Values)
+		}
+	}
+	return err
+}
+
+// read decodes the file filename, as saved for the session name, into
+// values. The caller must hold fileMutex.
+func (s *FilesystemStore) read(name, filename string, values *map[interface{}]interface{}) error {
+	if ss, ok := s.FileSerializer.(StreamSerializer); ok {
+		return s.readStream(filename, ss, values)
+	}
+	var fdata []byte
+	var err error
+	if s.LockFiles {
+		fdata, err = readFileLocked(filename)
+	} else {
+		fdata, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrSessionNotFound
+		}
+		return &StorageError{Op: "load", Err: err}
+	}
+	if fdata, err = decompress(fdata); err != nil {
+		return &StorageError{Op: "load", Err: err}
+	}
+	if s.FileSerializer != nil {
+		return s.FileSerializer.Deserialize(fdata, values)
+	}
+	if err = DecodeMulti(name, string(fdata), values, s.codecs()...); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readStream decodes the file filename into values with ss, streaming it
+// from the disk.
+func (s *FilesystemStore) readStream(filename string, ss StreamSerializer, values *map[interface{}]interface{}) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrSessionNotFound
+		}
+		return &StorageError{Op: "load", Err: err}
+	}
+	defer f.Close()
+	if s.LockFiles {
+		if err = lockFile(f, false); err != nil {
+			return &StorageError{Op: "load", Err: err}
+		}
+	}
+	buf := bufio.NewReader(f)
+	var r io.Reader = buf
+	if magic, _ := buf.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return &StorageError{Op: "load", Err: err}
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return ss.DeserializeFrom(r, values)
+}
+
+// erase deletes the file of session, if any.
+func (s *FilesystemStore) erase(session *Session) error {
+	filename := s.filename(session.ID)
+
+	fileMutex.RLock()
+	defer fileMutex.RUnlock()
+
+	if userID := session.User(); userID != "" {
+		index := s.userIndexFile(userID, session.ID)
+		if err := os.Remove(index); err != nil && !os.IsNotExist(err) {
+			return &StorageError{Op: "delete", Err: err}
+		}
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return &StorageError{Op: "delete", Err: err}
+	}
+	return s.removeLegacy(session.ID)
+}
+
+// filename returns the name of the file of a session, named after the
+// storage key of its ID.
+func (s *FilesystemStore) filename(sessionID string) string {
+	return filepath.Join(s.path, "session_"+StorageKey(sessionID))
+}
+
+// legacyFilename returns the name of the file of a session saved by the
+// versions naming the files after the session ID, or an empty string if the
+// ID can't be a file name.
+func (s *FilesystemStore) legacyFilename(sessionID string) string {
+	if sessionID == "" || strings.ContainsAny(sessionID, `/\.`) {
+		return ""
+	}
+	return filepath.Join(s.path, "session_"+sessionID)
+}
+
+// removeLegacy removes the file of a session named after its ID, if any.
+func (s *FilesystemStore) removeLegacy(sessionID string) error {
+	legacy := s.legacyFilename(sessionID)
+	if legacy == "" {
+		return nil
+	}
+	if err := os.Remove(legacy); err != nil && !os.IsNotExist(err) {
+		return &StorageError{Op: "delete", Err: err}
+	}
+	return nil
+}
+
+// userIndexFile returns the name of the file indexing a session by user.
+func (s *FilesystemStore) userIndexFile(userID, sessionID string) string {
+	return filepath.Join(s.path, "user_"+encodeUserID(userID)+"_"+StorageKey(sessionID))
+}
+
+// writeFileLocked writes data to filename holding an exclusive lock on it.
+func writeFileLocked(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = lockFile(f, true); err != nil {
+		return err
+	}
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// readFileLocked reads filename holding a shared lock on it.
+func readFileLocked(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = lockFile(f, false); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+// gzipMagic are the first bytes of gzip data, see FilesystemStore.Compress.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// compress returns data compressed with gzip.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns data decompressed if it starts with the gzip magic
+// bytes, or else data unchanged.
+func decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// encodeUserID encodes a user ID to be used in a filename.
+func encodeUserID(userID string) string {
+	return strings.TrimRight(
+		base32.StdEncoding.EncodeToString([]byte(userID)), "=")
+}
+
+// warnSize calls fn, or logs a warning if fn is nil, when size exceeds
+// limit.
+func warnSize(limit int, fn func(name string, size int), name string, size int) {
+	if limit <= 0 || size <= limit {
+		return
+	}
+	if fn == nil {
+		log.Printf("sessions: session %q is %d bytes, larger than the %d bytes soft limit",
+			name, size, limit)
+		return
+	}
+	fn(name, size)
+}
+
+// checkSize returns an error wrapping ErrSessionTooLarge when size exceeds
+// limit.
+func checkSize(limit int, name string, size int) error {
+	if limit <= 0 || size <= limit {
+		return nil
+	}
+	return fmt.Errorf("sessions: session %q is %d bytes, larger than the %d bytes limit: %w",
+		name, size, limit, ErrSessionTooLarge)
+}
+
+// valueInt64 returns the integer session value v, or 0. Serializers decode
+// integers with various types: int64 for gob, float64 for JSON and the JWT
+// claims, and the smallest fitting integer type for MessagePack.
+func valueInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case uint:
+		return int64(n)
+	case uint8:
+		return int64(n)
+	case uint16:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case uint64:
+		return int64(n)
+	case float32:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+// limitMaxAge clamps the MaxAge of session to limit, if > 0, calling fn if
+// set when it was longer.
+func limitMaxAge(limit int, fn func(name string, maxAge int), session *Session) {
+	if limit <= 0 || session.Options.MaxAge <= limit {
+		return
+	}
+	if fn != nil {
+		fn(session.Name(), session.Options.MaxAge)
+	}
+	session.Options.MaxAge = limit
+}
+
+// readToken returns the encoded session from the header if it is set, else
+// from the cookie for the given name.
+func readToken(ctx *fasthttp.RequestCtx, header, name string) []byte {
+	if header != "" {
+		return ctx.Request.Header.Peek(header)
+	}
+	return ctx.Request.Header.Cookie(name)
+}
+
+// Binding is a set of client attributes sessions are bound to, see
+// CookieStore.BindTo.
+type Binding int
+
+const (
+	// BindIP binds sessions to the client IP address.
+	BindIP Binding = 1 << iota
+	// BindUserAgent binds sessions to the client User-Agent header.
+	BindUserAgent
+)
+
+// fingerprint returns the fingerprint of the client of the request for the
+// bound attributes.
+func fingerprint(ctx *fasthttp.RequestCtx, bind Binding, prefix int) string {
+	h := sha256.New()
+	if bind&BindIP != 0 {
+		ip := ctx.RemoteIP()
+		if prefix > 0 {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4.Mask(net.CIDRMask(prefix, 32))
+			} else {
+				ip = ip.Mask(net.CIDRMask(64, 128))
+			}
+		}
+		h.Write([]byte(ip.String()))
+	}
+	h.Write([]byte{0})
+	if bind&BindUserAgent != 0 {
+		h.Write(ctx.Request.Header.UserAgent())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// bindSession stores the fingerprint of the client in session if bind is set
+// and it is not bound yet.
+func bindSession(ctx *fasthttp.RequestCtx, session *Session, bind Binding, prefix int) {
+	if bind == 0 || session.Options.MaxAge <= 0 {
+		return
+	}
+	if _, ok := session.Values[bindKey]; !ok {
+		session.Values[bindKey] = fingerprint(ctx, bind, prefix)
+	}
+}
+
+// checkBinding returns ErrBindingMismatch and resets session to a new
+// session if it is bound to another client.
+func checkBinding(ctx *fasthttp.RequestCtx, session *Session, bind Binding, prefix int) error {
+	if bind == 0 {
+		return nil
+	}
+	bound, ok := session.Values[bindKey].(string)
+	if !ok || SecureCompare(bound, fingerprint(ctx, bind, prefix)) {
+		return nil
+	}
+	session.ID = ""
+	session.Values = make(map[interface{}]interface{})
+	return ErrBindingMismatch
+}
+
+// requestOptions returns a copy of the options returned by fn for the
+// request if set and not nil, else of defaults.
+func requestOptions(ctx *fasthttp.RequestCtx, defaults *Options,
+	fn func(ctx *fasthttp.RequestCtx) *Options) Options {
+	if fn != nil {
+		if opts := fn(ctx); opts != nil {
+			return *opts
+		}
+	}
+	return *defaults
+}
+
+// isSafeMethod reports whether the method of the request is GET, HEAD or
+// OPTIONS, see CookieStore.SkipSaveOnSafeMethods.
+func isSafeMethod(ctx *fasthttp.RequestCtx) bool {
+	return ctx.IsGet() || ctx.IsHead() || ctx.IsOptions()
+}
+
+// modified reports whether session has been modified since it was loaded,
+// see CookieStore.SkipSaveOnSafeMethods. New sessions are modified once they
+// have values, and sessions loaded without a copy of their values are
+// assumed to be.
+func modified(session *Session) bool {
+	if session.IsNew {
+		return len(session.Values) > 0
+	}
+	return session.loaded == nil || session.loaded.values == nil ||
+		*session.Options != session.loaded.options ||
+		!reflect.DeepEqual(session.Values, session.loaded.values)
+}
+
+// saveOptions sets the options of session to the current defaults of the
+// store if they are nil, see Session.Options.
+func saveOptions(ctx *fasthttp.RequestCtx, session *Session, defaults *Options,
+	fn func(ctx *fasthttp.RequestCtx) *Options) {
+	if session.Options == nil {
+		opts := requestOptions(ctx, defaults, fn)
+		session.Options = &opts
+	}
+}
+
+// readFallback decodes session from the first cookie of the fallback names
+// that decodes with decode, then saves it under its name and expires the
+// fallback cookie. The session is valid anyway if saving fails.
+func readFallback(ctx *fasthttp.RequestCtx, session *Session, names []string,
+	decode func(name, value string) error) {
+	for _, old := range names {
+		c := ctx.Request.Header.Cookie(old)
+		if len(c) == 0 || decode(old, string(c)) != nil {
+			continue
+		}
+		session.IsNew = false
+		if session.store.Save(ctx, session) == nil {
+			opts := *session.Options
+			opts.MaxAge = -1
+			SetCookie(ctx, old, "", &opts)
+		}
+		return
+	}
+}
+
+// writeToken sends the encoded session in the header if it is set, else in
+// a cookie with the given name and options.
+func writeToken(ctx *fasthttp.RequestCtx, header, name, value string, options *Options) {
+	if header != "" {
+		ctx.Response.Header.Set(header, value)
+		return
+	}
+	SetCookie(ctx, name, value, options)
+}
+
+// decodeMulti decodes a value using the given codecs like
+// securecookie.DecodeMulti, but it returns ErrSignatureInvalid if all the
+// codecs failed to verify the signature.
+func DecodeMulti(name, value string, dst interface{}, codecs ...securecookie.Codec) error {
+	_, err := decodeIndex(name, value, dst, codecs...)
+	return err
+}
+
+// decodeIndex is like DecodeMulti, and it also returns the index of the
+// codec that decoded the value.
+func decodeIndex(name, value string, dst interface{}, codecs ...securecookie.Codec) (int, error) {
+	if len(codecs) == 0 {
+		return -1, securecookie.DecodeMulti(name, value, dst)
+	}
+	var errs securecookie.MultiError
+	signature := true
+	for i, codec := range codecs {
+		err := codec.Decode(name, value, dst)
+		if err == nil {
+			return i, nil
+		}
+		if err != securecookie.ErrMacInvalid {
+			signature = false
+		}
+		errs = append(errs, err)
+	}
+	if signature {
+		return -1, ErrSignatureInvalid
+	}
+	return -1, errs
 }
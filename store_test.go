@@ -5,9 +5,20 @@
 package sessions
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/securecookie"
 	"github.com/valyala/fasthttp"
 )
 
@@ -110,3 +121,2097 @@ func TestGH8FilesystemStoreDelete2(t *testing.T) {
 		t.Fatal("failed to delete session", err)
 	}
 }
+
+// Test that session files are encrypted when an encryption key is provided.
+func TestFilesystemStoreEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hashKey := []byte("some hash key")
+	blockKey := []byte("0123456789abcdef")
+	store := NewFilesystemStore(dir, hashKey, blockKey)
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["secret"] = "plain-text-value"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	fdata, err := ioutil.ReadFile(filepath.Join(dir, "session_"+StorageKey(session.ID)))
+	if err != nil {
+		t.Fatal("failed to read session file", err)
+	}
+	// The file holds base64("date|base64(value)|mac").
+	raw, err := base64.URLEncoding.DecodeString(string(fdata))
+	if err != nil {
+		t.Fatal("failed to decode session file", err)
+	}
+	parts := bytes.SplitN(raw, []byte("|"), 3)
+	if len(parts) != 3 {
+		t.Fatalf("bad session file format: %q", raw)
+	}
+	value, err := base64.URLEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		t.Fatal("failed to decode session file value", err)
+	}
+	if bytes.Contains(value, []byte("plain-text-value")) {
+		t.Fatal("session file contains the raw session value")
+	}
+
+	// Same authentication key, no encryption key.
+	signOnly := NewFilesystemStore(dir, hashKey)
+	loaded := NewSession(signOnly, "hello")
+	loaded.ID = session.ID
+	if err = signOnly.load("hello", loaded); err == nil {
+		t.Fatal("expected an error decoding without the encryption key, got nil")
+	}
+
+	loaded = NewSession(store, "hello")
+	loaded.ID = session.ID
+	if err = store.load("hello", loaded); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.Values["secret"] != "plain-text-value" {
+		t.Fatalf("bad session value: got %v, want %q", loaded.Values["secret"], "plain-text-value")
+	}
+}
+
+// Test that a missing session file is reported as ErrSessionNotFound.
+func TestFilesystemStoreSessionNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	ctx := &fasthttp.RequestCtx{}
+
+	// No cookie: a new session without error.
+	if _, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to create session", err)
+	}
+
+	encoded, err := securecookie.EncodeMulti("hello", "MISSING", store.Codecs...)
+	if err != nil {
+		t.Fatal("failed to encode session id", err)
+	}
+	ctx.Request.Header.SetCookie("hello", encoded)
+	session, err := store.New(ctx, "hello")
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("bad error: got %v, want %v", err, ErrSessionNotFound)
+	}
+	if session == nil || !session.IsNew {
+		t.Fatal("expected a new session")
+	}
+}
+
+// Test removing all the sessions of a user.
+func TestFilesystemStoreSetUserChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.SetUser("gopher")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// The session moves to another user: it leaves the index of the first.
+	ctx = requestWithCookie(ctx, "hello")
+	if session, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	session.SetUser("someone else")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if n, err := store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count of the previous user: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err := store.CountByUser("someone else"); err != nil || n != 1 {
+		t.Fatalf("bad count: got (%d, %v), want (1, nil)", n, err)
+	}
+	if n, err := store.DeleteByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad delete of the previous user: got (%d, %v), want (0, nil)", n, err)
+	}
+	if _, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to load the session of the new user", err)
+	}
+}
+
+func TestFilesystemStoreDeleteByUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	users := []string{"gopher", "gopher", "someone else"}
+	sessions := make([]*Session, len(users))
+	for i, userID := range users {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.SetUser(userID)
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		sessions[i] = session
+	}
+
+	if n, err := store.CountByUser("gopher"); err != nil || n != 2 {
+		t.Fatalf("bad count: got (%d, %v), want (2, nil)", n, err)
+	}
+	n, err := store.DeleteByUser("gopher")
+	if err != nil {
+		t.Fatal("failed to delete sessions", err)
+	}
+	if n != 2 {
+		t.Fatalf("bad deleted count: got %d, want %d", n, 2)
+	}
+	for i, session := range sessions {
+		loaded := NewSession(store, "hello")
+		loaded.ID = session.ID
+		err = store.load("hello", loaded)
+		if users[i] == "gopher" && err != ErrSessionNotFound {
+			t.Errorf("bad error loading deleted session: got %v, want %v", err, ErrSessionNotFound)
+		} else if users[i] != "gopher" && err != nil {
+			t.Errorf("failed to load session: %v", err)
+		}
+	}
+
+	if n, err = store.DeleteByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad second delete: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count after delete: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.CountByUser("someone else"); err != nil || n != 1 {
+		t.Fatalf("bad count: got (%d, %v), want (1, nil)", n, err)
+	}
+	if _, err = NewCookieStore().DeleteByUser("gopher"); err == nil {
+		t.Fatal("expected an error from CookieStore, got nil")
+	}
+	if _, err = NewCookieStore().CountByUser("gopher"); err == nil {
+		t.Fatal("expected an error from CookieStore, got nil")
+	}
+}
+
+func TestFilesystemStoreDeleteWhere(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	users := []string{"gopher", "gopher", "someone else"}
+	sessions := make([]*Session, len(users))
+	for i, userID := range users {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["userID"] = userID
+		if i == 0 {
+			session.SetUser(userID)
+		}
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		sessions[i] = session
+	}
+
+	n, err := store.DeleteWhere("hello", func(session *Session) bool {
+		return session.Values["userID"] == "gopher"
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("bad deleted count: got (%d, %v), want (2, nil)", n, err)
+	}
+	for i, session := range sessions {
+		loaded := NewSession(store, "hello")
+		loaded.ID = session.ID
+		err = store.load("hello", loaded)
+		if users[i] == "gopher" && err != ErrSessionNotFound {
+			t.Errorf("bad error loading deleted session: got %v, want %v", err, ErrSessionNotFound)
+		} else if users[i] != "gopher" && err != nil {
+			t.Errorf("failed to load session: %v", err)
+		}
+	}
+	if n, err = store.CountByUser("gopher"); err != nil || n != 0 {
+		t.Fatalf("bad count after delete: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err = store.DeleteWhere("other", func(*Session) bool { return true }); err != nil || n != 0 {
+		t.Fatalf("bad delete of another name: got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestFilesystemStoreDeleteMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "hello")
+	session.Options.MaxAge = -1
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to delete a session without file", err)
+	}
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey("hello")
+	if !ctx.Response.Header.Cookie(cookie) || !cookie.Expire().Before(time.Now()) {
+		t.Fatalf("expected an expired cookie, got %s", cookie.String())
+	}
+}
+
+// Test generating deterministic session IDs from a fixed random source.
+
+func TestFilesystemStoreRand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	store.Rand = bytes.NewReader(make([]byte, 32))
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	want := strings.Repeat("A", 52)
+	if session.ID != want {
+		t.Fatalf("bad session id: got %q, want %q", session.ID, want)
+	}
+
+	// The source is exhausted.
+	session, _ = store.New(ctx, "hello")
+	if err = session.Save(ctx); err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+}
+
+// Test counting the sessions stored in the filesystem.
+func TestFilesystemStoreStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	if count, size, err := store.Stats(); err != nil || count != 0 || size != 0 {
+		t.Fatalf("bad stats: got (%d, %d, %v), want (0, 0, nil)", count, size, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.SetUser("gopher")
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+	}
+
+	count, size, err := store.Stats()
+	if err != nil {
+		t.Fatal("failed to get stats", err)
+	}
+	if count != 3 {
+		t.Fatalf("bad count: got %d, want %d", count, 3)
+	}
+	if size <= 0 {
+		t.Fatalf("bad total size: got %d", size)
+	}
+}
+
+// Test the soft limit of the session size.
+func TestCookieStoreWarnSize(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	var warned []int
+	store.OnWarnSize = func(name string, size int) {
+		if name != "hello" {
+			t.Errorf("bad session name: got %q, want %q", name, "hello")
+		}
+		warned = append(warned, size)
+	}
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["big"] = strings.Repeat("x", 1024)
+
+	// Disabled by default.
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if len(warned) != 0 {
+		t.Fatalf("unexpected warning: %v", warned)
+	}
+
+	store.WarnSize = 512
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if len(warned) != 1 || warned[0] <= 512 {
+		t.Fatalf("bad warnings: got %v, want one larger than 512", warned)
+	}
+
+	store.WarnSize = 4096
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if len(warned) != 1 {
+		t.Fatalf("unexpected warning: %v", warned)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cookieStore := NewCookieStore([]byte("some key"))
+	cookieStore.MaxBytes = 512
+	fsStore := NewFilesystemStore(dir, []byte("some key"))
+	fsStore.MaxBytes = 512
+
+	for _, store := range []Store{cookieStore, fsStore} {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatalf("%T: failed to create session: %v", store, err)
+		}
+		session.Values["small"] = "x"
+		if err = session.Save(ctx); err != nil {
+			t.Fatalf("%T: failed to save session: %v", store, err)
+		}
+
+		ctx = &fasthttp.RequestCtx{}
+		session.Values["big"] = strings.Repeat("x", 1024)
+		err = session.Save(ctx)
+		if !errors.Is(err, ErrSessionTooLarge) || !strings.Contains(err.Error(), `"hello"`) {
+			t.Fatalf("%T: bad error: got %v, want %v naming the session", store, err, ErrSessionTooLarge)
+		}
+		if c := ctx.Response.Header.PeekCookie("hello"); len(c) > 0 {
+			t.Fatalf("%T: unexpected cookie for a session over the limit", store)
+		}
+	}
+}
+
+// Test reading and writing the session from a header.
+func TestCookieStoreTokenHeader(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	store.TokenHeader = "X-Session"
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := ctx.Response.Header.PeekCookie("hello"); len(c) > 0 {
+		t.Fatalf("unexpected cookie: %s", c)
+	}
+	token := ctx.Response.Header.Peek("X-Session")
+	if len(token) == 0 {
+		t.Fatal("the session header has not been sent to client")
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetBytesV("X-Session", token)
+	if session, err = store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to decode session", err)
+	}
+	if session.IsNew || session.Values["name"] != "gopher" {
+		t.Fatalf("bad session: got %v, want name %q", session.Values, "gopher")
+	}
+}
+
+func TestTokenHeaderSessionName(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	ctx := &fasthttp.RequestCtx{}
+	defer Clear(ctx)
+
+	if _, err := store.Get(ctx, "app/session"); err == nil {
+		t.Fatal("expected an error for an invalid cookie name")
+	}
+	store.TokenHeader = "X-Session"
+	session, err := store.Get(ctx, "app/session")
+	if err != nil {
+		t.Fatal("failed to get session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if _, err = store.Get(ctx, ""); err == nil {
+		t.Fatal("expected an error for an empty name")
+	}
+}
+
+// Test that a tampered cookie is reported as ErrSignatureInvalid.
+func TestCookieStoreSignatureInvalid(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey("hello")
+	if !ctx.Response.Header.Cookie(cookie) {
+		t.Fatal("the cookie has not been sent to client")
+	}
+	value := append([]byte(nil), cookie.Value()...)
+
+	// Flip a byte in the middle of the value.
+	i := len(value) / 2
+	if value[i] == 'A' {
+		value[i] = 'B'
+	} else {
+		value[i] = 'A'
+	}
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("hello", string(value))
+	if _, err = store.New(ctx, "hello"); err != ErrSignatureInvalid {
+		t.Fatalf("bad error: got %v, want %v", err, ErrSignatureInvalid)
+	}
+
+	// A malformed value is not a signature error.
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("hello", "%%%")
+	if _, err = store.New(ctx, "hello"); err == nil || err == ErrSignatureInvalid {
+		t.Fatalf("bad error: got %v, want a decode error", err)
+	}
+}
+
+// Test the callback for cookies that could not be decoded.
+func TestCookieStoreOnInvalidCookie(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	var invalid []error
+	store.OnInvalidCookie = func(name string, err error) {
+		if name != "hello" {
+			t.Errorf("bad session name: got %q, want %q", name, "hello")
+		}
+		invalid = append(invalid, err)
+	}
+
+	// No cookie.
+	ctx := &fasthttp.RequestCtx{}
+	if _, err := store.New(ctx, "hello"); err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if len(invalid) != 0 {
+		t.Fatalf("unexpected call for an absent cookie: %v", invalid)
+	}
+
+	ctx.Request.Header.SetCookie("hello", "invalid")
+	_, err := store.New(ctx, "hello")
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	if len(invalid) != 1 || invalid[0].Error() != err.Error() {
+		t.Fatalf("bad calls: got %v, want [%v]", invalid, err)
+	}
+}
+
+// Test that the cookie deleting a session matches the cookie path and domain.
+func TestDeleteCookiePathDomain(t *testing.T) {
+	options := &Options{
+		Path:   "/user",
+		Domain: "golang.org",
+		MaxAge: -1,
+	}
+	stores := []Store{
+		NewCookieStore([]byte("some key")),
+		NewFilesystemStore("", []byte("some key")),
+	}
+	for _, store := range stores {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		session.Options = options
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to delete session", err)
+		}
+
+		header := string(ctx.Response.Header.PeekCookie("hello"))
+		cookie := &fasthttp.Cookie{}
+		if err = cookie.Parse(header); err != nil {
+			t.Fatal("failed to parse cookie", err)
+		}
+		if err = checkCookieOptions(cookie, options); err != nil {
+			t.Errorf("%T: %v in %s", store, err, header)
+		}
+		if !cookie.Expire().Before(time.Now()) {
+			t.Errorf("%T: expected an expired cookie in %s", store, header)
+		}
+	}
+}
+
+// Test re-encrypting the session files with new keys.
+func TestFilesystemStoreReencrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKeys := [][]byte{[]byte("old hash key"), []byte("0123456789abcdef")}
+	newKeys := [][]byte{[]byte("new hash key"), []byte("fedcba9876543210")}
+	store := NewFilesystemStore(dir, oldKeys...)
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	other, _ := store.New(ctx, "other")
+	if err = other.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	n, err := store.Reencrypt("hello", append(newKeys, oldKeys...)...)
+	if err != nil {
+		t.Fatal("failed to re-encrypt sessions", err)
+	}
+	if n != 1 {
+		t.Fatalf("bad re-encrypted count: got %d, want %d", n, 1)
+	}
+
+	// The files can only be decoded with the new keys.
+	loaded := NewSession(nil, "hello")
+	loaded.ID = session.ID
+	if err = NewFilesystemStore(dir, oldKeys...).load("hello", loaded); err == nil {
+		t.Fatal("expected an error decoding with the old keys, got nil")
+	}
+	loaded = NewSession(nil, "hello")
+	loaded.ID = session.ID
+	if err = NewFilesystemStore(dir, newKeys...).load("hello", loaded); err != nil {
+		t.Fatal("failed to load session with the new keys", err)
+	}
+	if loaded.Values["name"] != "gopher" {
+		t.Fatalf("bad session value: got %v, want %q", loaded.Values["name"], "gopher")
+	}
+
+	// Existing cookies are still accepted.
+	if loaded, err = store.New(requestWithCookie(ctx, "hello"), "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.Values["name"] != "gopher" {
+		t.Fatalf("bad session value: got %v, want %q", loaded.Values["name"], "gopher")
+	}
+
+	if _, err = NewCookieStore().Reencrypt("hello", newKeys...); err == nil {
+		t.Fatal("expected an error from CookieStore, got nil")
+	}
+}
+
+// Test that re-encrypting honours the file options of the store.
+func TestFilesystemStoreReencryptOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKeys := [][]byte{[]byte("old hash key"), nil}
+	newKeys := [][]byte{[]byte("new hash key"), nil}
+	store := NewFilesystemStore(dir, oldKeys...)
+	store.LockFiles = true
+	store.Compress = true
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "hello")
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	if n, err := store.Reencrypt("hello", append(newKeys, oldKeys...)...); err != nil || n != 1 {
+		t.Fatalf("bad re-encryption: got %d, %v, want 1, nil", n, err)
+	}
+	loaded := NewSession(nil, "hello")
+	loaded.ID = session.ID
+	if err = store.load("hello", loaded); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.Values["name"] != "gopher" {
+		t.Fatalf("bad session value: got %v, want %q", loaded.Values["name"], "gopher")
+	}
+	for _, codec := range store.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxLength(0)
+			encoded, err := sc.Encode("hello", make([]byte, DefaultMaxDecodeSize))
+			if err != nil {
+				t.Fatal("failed to encode value", err)
+			}
+			var value []byte
+			if err = sc.Decode("hello", encoded, &value); err == nil {
+				t.Fatal("expected the new codecs to use GobSerializer, got no limit")
+			}
+		}
+	}
+
+	// Files written with a FileSerializer are not encoded with the codecs.
+	store.FileSerializer = JSONSerializer{}
+	session, _ = store.New(ctx, "json")
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if n, err := store.Reencrypt("json", oldKeys...); err != nil || n != 0 {
+		t.Fatalf("bad re-encryption: got %d, %v, want 0, nil", n, err)
+	}
+	loaded = NewSession(nil, "json")
+	loaded.ID = session.ID
+	if err = store.load("json", loaded); err != nil || loaded.Values["name"] != "gopher" {
+		t.Fatalf("bad session value: got %v, %v, want %q", loaded.Values["name"], err, "gopher")
+	}
+}
+
+// Test that storage failures are reported as ErrStorageUnavailable.
+func TestFilesystemStoreStorageUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The store path is a file, so writes fail.
+	path := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal("failed to create file", err)
+	}
+	store := NewFilesystemStore(path, []byte("some key"))
+	ctx := &fasthttp.RequestCtx{}
+	defer Clear(ctx)
+
+	session, err := store.Get(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	err = session.Save(ctx)
+	if !errors.Is(err, ErrStorageUnavailable) {
+		t.Fatalf("bad error: got %v, want %v", err, ErrStorageUnavailable)
+	}
+	if _, ok := errors.Unwrap(err).(*os.PathError); !ok {
+		t.Fatalf("bad cause: got %T, want *os.PathError", errors.Unwrap(err))
+	}
+
+	// The cause is kept through the registry.
+	err = Save(ctx)
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != 1 || !errors.Is(errs[0], ErrStorageUnavailable) {
+		t.Fatalf("bad error: got %v, want %v", err, ErrStorageUnavailable)
+	}
+}
+
+// Test that sessions decoded with an old key pair are signed again.
+func TestKeyRotationResign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey, newKey := []byte("old key"), []byte("new key")
+	tests := []struct {
+		old, rotated, fresh Store
+	}{
+		{
+			NewCookieStore(oldKey),
+			NewCookieStore(newKey, nil, oldKey),
+			NewCookieStore(newKey),
+		},
+		{
+			NewFilesystemStore(dir, oldKey),
+			NewFilesystemStore(dir, newKey, nil, oldKey),
+			NewFilesystemStore(dir, newKey),
+		},
+	}
+	for _, test := range tests {
+		// Unchanged sessions are signed again too.
+		switch rotated := test.rotated.(type) {
+		case *CookieStore:
+			rotated.SkipUnchanged = true
+		case *FilesystemStore:
+			rotated.SkipUnchanged = true
+		}
+		ctx := &fasthttp.RequestCtx{}
+		session, err := test.old.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		if session.CodecIndex() != -1 {
+			t.Fatalf("%T: bad codec index of a new session: got %d, want -1", test.old, session.CodecIndex())
+		}
+		session.Values["name"] = "gopher"
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+
+		ctx = requestWithCookie(ctx, "hello")
+		if session, err = test.rotated.New(ctx, "hello"); err != nil {
+			t.Fatalf("%T: failed to load session: %v", test.rotated, err)
+		}
+		if session.CodecIndex() != 1 {
+			t.Fatalf("%T: bad codec index: got %d, want 1", test.rotated, session.CodecIndex())
+		}
+		if c := ctx.Response.Header.PeekCookie("hello"); len(c) > 0 {
+			t.Fatalf("%T: unexpected cookie before Save: %s", test.rotated, c)
+		}
+		if err = session.Save(ctx); err != nil {
+			t.Fatalf("%T: failed to save session: %v", test.rotated, err)
+		}
+		// Signed again with the new key only.
+		ctx = requestWithCookie(ctx, "hello")
+		session, err = test.fresh.New(ctx, "hello")
+		if err != nil {
+			t.Fatalf("%T: expected the session to be signed with the new key: %v", test.fresh, err)
+		}
+		if session.Values["name"] != "gopher" {
+			t.Fatalf("%T: bad session value: got %v, want %q", test.fresh, session.Values["name"], "gopher")
+		}
+
+		// Sessions decoded with the first key pair are not saved again.
+		if session, err = test.rotated.New(ctx, "hello"); err != nil {
+			t.Fatalf("%T: failed to load session: %v", test.rotated, err)
+		}
+		if session.CodecIndex() != 0 {
+			t.Fatalf("%T: bad codec index: got %d, want 0", test.rotated, session.CodecIndex())
+		}
+		if c := ctx.Response.Header.PeekCookie("hello"); len(c) > 0 {
+			t.Fatalf("%T: unexpected cookie: %s", test.rotated, c)
+		}
+	}
+}
+
+// Test skipping the cookie of unchanged sessions.
+func TestCookieStoreSkipUnchanged(t *testing.T) {
+	store := NewCookieStore([]byte("some key"), []byte("0123456789abcdef"))
+	store.SkipUnchanged = true
+	ctx := &fasthttp.RequestCtx{}
+
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	session.Values[42] = []interface{}{"foo", "bar"}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := ctx.Response.Header.PeekCookie("hello"); len(c) == 0 {
+		t.Fatal("the cookie of a new session has not been sent to client")
+	}
+
+	// Unchanged.
+	req := requestWithCookie(ctx, "hello")
+	if session, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if err = session.Save(req); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := req.Response.Header.PeekCookie("hello"); len(c) > 0 {
+		t.Fatalf("unexpected cookie for an unchanged session: %s", c)
+	}
+
+	// Changed values.
+	req = requestWithCookie(ctx, "hello")
+	session, _ = store.New(req, "hello")
+	session.Values["name"] = "someone else"
+	if err = session.Save(req); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := req.Response.Header.PeekCookie("hello"); len(c) == 0 {
+		t.Fatal("the cookie of a changed session has not been sent to client")
+	}
+
+	// Changed options.
+	req = requestWithCookie(ctx, "hello")
+	session, _ = store.New(req, "hello")
+	session.Options.Secure = true
+	if err = session.Save(req); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := req.Response.Header.PeekCookie("hello"); len(c) == 0 {
+		t.Fatal("the cookie of a session with new options has not been sent to client")
+	}
+}
+
+func TestFilesystemStoreSkipUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	store.SkipUnchanged = true
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := ctx.Response.Header.PeekCookie("hello"); len(c) == 0 {
+		t.Fatal("the cookie of a new session has not been sent to client")
+	}
+
+	// Changed values are saved without sending the cookie again.
+	req := requestWithCookie(ctx, "hello")
+	if session, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(req); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := req.Response.Header.PeekCookie("hello"); len(c) > 0 {
+		t.Fatalf("unexpected cookie for a session with the same ID: %s", c)
+	}
+	req = requestWithCookie(ctx, "hello")
+	if session, err = store.New(req, "hello"); err != nil || session.Values["name"] != "gopher" {
+		t.Fatalf("failed to load saved values: %v, %v", session.Values, err)
+	}
+
+	// Changed options.
+	session.Options.Secure = true
+	if err = session.Save(req); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := req.Response.Header.PeekCookie("hello"); len(c) == 0 {
+		t.Fatal("the cookie of a session with new options has not been sent to client")
+	}
+
+	// New ID.
+	req = requestWithCookie(ctx, "hello")
+	session, _ = store.New(req, "hello")
+	if err = store.Regenerate(req, session); err != nil {
+		t.Fatal("failed to regenerate session", err)
+	}
+	if c := req.Response.Header.PeekCookie("hello"); len(c) == 0 {
+		t.Fatal("the cookie of a session with a new ID has not been sent to client")
+	}
+}
+
+func TestFilesystemStoreHashedID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.SetUser("gopher")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal("failed to read dir", err)
+	}
+	for _, file := range files {
+		if strings.Contains(file.Name(), session.ID) {
+			t.Fatalf("file %q is named after the raw session ID", file.Name())
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "session_"+StorageKey(session.ID))); err != nil {
+		t.Fatal("missing session file", err)
+	}
+
+	ctx = requestWithCookie(ctx, "hello")
+	if session, err = store.New(ctx, "hello"); err != nil || session.IsNew {
+		t.Fatal("failed to load session", err)
+	}
+
+	// A file saved under the raw ID by a previous version is still loaded,
+	// and replaced on Save.
+	hashed := filepath.Join(dir, "session_"+StorageKey(session.ID))
+	legacy := filepath.Join(dir, "session_"+session.ID)
+	if err = os.Rename(hashed, legacy); err != nil {
+		t.Fatal("failed to rename session file", err)
+	}
+	if session, err = store.New(ctx, "hello"); err != nil || session.IsNew || session.User() != "gopher" {
+		t.Fatalf("bad legacy session: got %v, %v", session.Values, err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if _, err = os.Stat(hashed); err != nil {
+		t.Fatal("missing session file", err)
+	}
+	if _, err = os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatal("the legacy session file was not removed", err)
+	}
+}
+
+func TestCookieStoreEncodeDecode(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	session := NewSession(store, "hello")
+	session.Values["name"] = "gopher"
+
+	encoded, err := store.Encode("hello", session)
+	if err != nil {
+		t.Fatal("failed to encode session", err)
+	}
+
+	// The encoded value is accepted as a cookie by New.
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("hello", encoded)
+	if session, err = store.New(ctx, "hello"); err != nil || session.IsNew {
+		t.Fatal("failed to load session", err)
+	}
+	if session.Values["name"] != "gopher" {
+		t.Fatalf("bad session: got %v, want name %q", session.Values, "gopher")
+	}
+
+	decoded := NewSession(store, "hello")
+	if err = store.Decode("hello", encoded, decoded); err != nil {
+		t.Fatal("failed to decode session", err)
+	}
+	if decoded.Values["name"] != "gopher" {
+		t.Fatalf("bad session: got %v, want name %q", decoded.Values, "gopher")
+	}
+	if err = store.Decode("other", encoded, decoded); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("bad error: got %v, want %v", err, ErrSignatureInvalid)
+	}
+}
+
+func BenchmarkCookieStoreEncodeDecode(b *testing.B) {
+	store := NewCookieStore([]byte("some key"), []byte("0123456789abcdef"))
+	session := NewSession(store, "hello")
+	session.Values["name"] = "gopher"
+	decoded := NewSession(store, "hello")
+	for i := 0; i < b.N; i++ {
+		encoded, err := store.Encode("hello", session)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = store.Decode("hello", encoded, decoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFilesystemStoreLockFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	store.LockFiles = true
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	reqs := make([]*fasthttp.RequestCtx, 8)
+	for i := range reqs {
+		reqs[i] = requestWithCookie(ctx, "hello")
+	}
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		go func(i int, req *fasthttp.RequestCtx) {
+			defer wg.Done()
+			session, err := store.New(req, "hello")
+			if err != nil {
+				t.Error("failed to load session", err)
+				return
+			}
+			session.Values["request"] = i
+			if err = session.Save(req); err != nil {
+				t.Error("failed to save session", err)
+			}
+		}(i, req)
+	}
+	wg.Wait()
+
+	// One of the saves won, the file is not corrupted.
+	if session, err = store.New(requestWithCookie(ctx, "hello"), "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if _, ok := session.Values["request"].(int); !ok {
+		t.Fatalf("bad session: got %v", session.Values)
+	}
+}
+
+func TestEncodeSession(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	encoded, err := EncodeSession(store, "hello", map[interface{}]interface{}{
+		userKey: "gopher",
+	})
+	if err != nil {
+		t.Fatal("failed to encode session", err)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("hello", encoded)
+	session, err := store.New(ctx, "hello")
+	if err != nil || session.IsNew {
+		t.Fatal("failed to load session", err)
+	}
+	if session.User() != "gopher" {
+		t.Fatalf("bad user: got %q, want %q", session.User(), "gopher")
+	}
+}
+
+func TestMaxAgeLimit(t *testing.T) {
+	const day = 86400
+	store := NewCookieStore([]byte("some key"))
+	store.MaxAgeLimit = day
+	var clamped []int
+	store.OnMaxAgeLimit = func(name string, maxAge int) {
+		clamped = append(clamped, maxAge)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Options.MaxAge = 365 * day
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if session.Options.MaxAge != day {
+		t.Fatalf("bad max age: got %d, want %d", session.Options.MaxAge, day)
+	}
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey("hello")
+	if !ctx.Response.Header.Cookie(cookie) || cookie.Expire().After(time.Now().Add(day*time.Second)) {
+		t.Fatalf("bad cookie expiration: got %v, want at most in a day", cookie.Expire())
+	}
+	if len(clamped) != 1 || clamped[0] != 365*day {
+		t.Fatalf("bad clamped max ages: got %v, want [%d]", clamped, 365*day)
+	}
+
+	// Shorter sessions are kept as is.
+	session.Options.MaxAge = 3600
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if session.Options.MaxAge != 3600 || len(clamped) != 1 {
+		t.Fatalf("bad max age: got %d, want %d", session.Options.MaxAge, 3600)
+	}
+}
+
+func TestFilesystemStoreList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	var _ Lister = store
+	keys := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.SetUser("gopher")
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		keys[StorageKey(session.ID)] = true
+	}
+
+	listed, err := store.List("")
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(listed) != len(keys) {
+		t.Fatalf("bad listed sessions: got %v, want %d", listed, len(keys))
+	}
+	for _, key := range listed {
+		if !keys[key] {
+			t.Fatalf("unexpected listed session %q", key)
+		}
+	}
+	if listed, err = store.List(listed[0]); err != nil || len(listed) != 1 {
+		t.Fatalf("bad listed sessions for prefix: got (%v, %v)", listed, err)
+	}
+}
+
+func TestFilesystemStoreRotateEvery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	store.RotateEvery = 2
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		ids = append(ids, session.ID)
+		ctx = requestWithCookie(ctx, "hello")
+		if session, err = store.New(ctx, "hello"); err != nil {
+			t.Fatal("failed to load session", err)
+		}
+	}
+	if ids[0] != ids[1] {
+		t.Fatalf("session ID rotated before the threshold: %v", ids)
+	}
+	if ids[2] == ids[1] {
+		t.Fatalf("session ID not rotated after the threshold: %v", ids)
+	}
+	if session.ID != ids[2] || session.Values["name"] != "gopher" {
+		t.Fatalf("bad rotated session: got %q %v", session.ID, session.Values)
+	}
+	if _, err = os.Stat(store.filename(ids[1])); !os.IsNotExist(err) {
+		t.Fatal("the session saved under the previous ID was not removed", err)
+	}
+
+	// Rotation after a duration.
+	store.RotateEvery = 0
+	store.RotateAfter = time.Hour
+	session.Values[rotatedAtKey] = time.Now().Add(-2 * time.Hour).Unix()
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if session.ID == ids[2] {
+		t.Fatal("session ID not rotated after RotateAfter")
+	}
+}
+
+func TestFallbackNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fallbacks := map[string][]string{"__Host-session": {"BROKEN", "GOSESSION"}}
+	cs := NewCookieStore([]byte("some key"))
+	cs.FallbackNames = fallbacks
+	fs := NewFilesystemStore(dir, []byte("some key"))
+	fs.FallbackNames = fallbacks
+
+	for _, store := range []Store{cs, fs} {
+
+		// A session saved under the old name.
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "GOSESSION")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["name"] = "gopher"
+		if err = session.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+
+		req := requestWithCookie(ctx, "GOSESSION")
+		req.Request.Header.SetCookie("BROKEN", "garbage")
+		if session, err = store.New(req, "__Host-session"); err != nil {
+			t.Fatal("failed to load session", err)
+		}
+		if session.IsNew || session.Values["name"] != "gopher" {
+			t.Fatalf("bad session: got %v, want name %q", session.Values, "gopher")
+		}
+
+		// Re-emitted under the new name, the old cookie is expired.
+		if c := req.Response.Header.PeekCookie("__Host-session"); len(c) == 0 {
+			t.Fatal("the session was not re-emitted under the new name")
+		}
+		cookie := fasthttp.AcquireCookie()
+		cookie.SetKey("GOSESSION")
+		if !req.Response.Header.Cookie(cookie) || cookie.Expire().After(time.Now()) {
+			t.Fatal("the cookie under the old name was not expired")
+		}
+		fasthttp.ReleaseCookie(cookie)
+
+		if session, err = store.New(requestWithCookie(req, "__Host-session"), "__Host-session"); err != nil || session.Values["name"] != "gopher" {
+			t.Fatalf("failed to load session under the new name: %v %v", session.Values, err)
+		}
+	}
+}
+
+func TestOptionsFunc(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	store.OptionsFunc = func(ctx *fasthttp.RequestCtx) *Options {
+		if string(ctx.Request.Header.Peek("Sec-Fetch-Dest")) != "iframe" {
+			return nil
+		}
+		return &Options{
+			Path:     "/",
+			MaxAge:   3600,
+			Secure:   true,
+			SameSite: fasthttp.CookieSameSiteNoneMode,
+		}
+	}
+
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey("hello")
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("Sec-Fetch-Dest", "iframe")
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if !ctx.Response.Header.Cookie(cookie) || cookie.SameSite() != fasthttp.CookieSameSiteNoneMode || !cookie.Secure() {
+		t.Fatalf("bad cookie for an embedded request: %s", cookie)
+	}
+
+	// Top-level requests use the static options.
+	ctx = &fasthttp.RequestCtx{}
+	session, _ = store.New(ctx, "hello")
+	if *session.Options != *store.Options {
+		t.Fatalf("bad options: got %+v, want %+v", session.Options, store.Options)
+	}
+}
+
+func TestFilesystemStoreFileSerializer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	store.FileSerializer = JSONSerializer{}
+	ctx := &fasthttp.RequestCtx{}
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	fdata, err := ioutil.ReadFile(store.filename(session.ID))
+	if err != nil {
+		t.Fatal("failed to read session file", err)
+	}
+	if string(fdata) != `{"name":"gopher"}` {
+		t.Fatalf("bad session file: got %s", fdata)
+	}
+
+	if session, err = store.New(requestWithCookie(ctx, "hello"), "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.Values["name"] != "gopher" {
+		t.Fatalf("bad session: got %v, want name %q", session.Values, "gopher")
+	}
+
+	session.Values[42] = "not a string key"
+	if err = session.Save(ctx); err == nil {
+		t.Fatal("expected an error for a non-string key")
+	}
+}
+
+func TestBindTo(t *testing.T) {
+	client := func(res *fasthttp.RequestCtx, ip, ua string) *fasthttp.RequestCtx {
+		ctx := requestWithCookie(res, "hello")
+		ctx.SetRemoteAddr(&net.TCPAddr{IP: net.ParseIP(ip)})
+		ctx.Request.Header.SetUserAgent(ua)
+		return ctx
+	}
+
+	store := NewCookieStore([]byte("some key"))
+	store.BindTo = BindIP | BindUserAgent
+	ctx := client(&fasthttp.RequestCtx{}, "192.0.2.1", "gopher-agent")
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["name"] = "gopher"
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// Same client.
+	if session, err = store.New(client(ctx, "192.0.2.1", "gopher-agent"), "hello"); err != nil || session.IsNew {
+		t.Fatal("failed to load session for the same client", err)
+	}
+
+	// Another IP or User-Agent.
+	for _, c := range [][2]string{{"192.0.2.2", "gopher-agent"}, {"192.0.2.1", "other-agent"}} {
+		session, err = store.New(client(ctx, c[0], c[1]), "hello")
+		if err != ErrBindingMismatch {
+			t.Fatalf("%v: bad error: got %v, want %v", c, err, ErrBindingMismatch)
+		}
+		if !session.IsNew || len(session.Values) != 0 {
+			t.Fatalf("%v: expected a new session, got %v", c, session.Values)
+		}
+	}
+
+	// Clients roaming in a /24 network.
+	store.BindIPPrefix = 24
+	ctx = client(&fasthttp.RequestCtx{}, "192.0.2.1", "gopher-agent")
+	session, _ = store.New(ctx, "hello")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if _, err = store.New(client(ctx, "192.0.2.200", "gopher-agent"), "hello"); err != nil {
+		t.Fatal("failed to load session in the same network", err)
+	}
+	if _, err = store.New(client(ctx, "198.51.100.1", "gopher-agent"), "hello"); err != ErrBindingMismatch {
+		t.Fatalf("bad error: got %v, want %v", err, ErrBindingMismatch)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var _ Validator = &CookieStore{}
+	var _ Validator = &FilesystemStore{}
+
+	if err := NewCookieStore([]byte("some key")).Validate(); err != nil {
+		t.Fatal("failed to validate cookie store", err)
+	}
+	// NewCookieStore panics with such keys, see CheckKeyPairs.
+	badStore := &CookieStore{Codecs: securecookie.CodecsFromPairs([]byte("some key"), []byte("bad block key"))}
+	if err := badStore.Validate(); err == nil {
+		t.Fatal("expected an error for an invalid block key")
+	}
+
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFilesystemStore(dir, []byte("some key"))
+	if err = store.Validate(); err != nil {
+		t.Fatal("failed to validate filesystem store", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected the probe file to be removed, got %d files", len(files))
+	}
+	store = NewFilesystemStore(filepath.Join(dir, "missing"), []byte("some key"))
+	if err = store.Validate(); err == nil {
+		t.Fatal("expected an error for a missing directory")
+	}
+}
+
+func TestPing(t *testing.T) {
+	var _ Pinger = &CookieStore{}
+	var _ Pinger = &FilesystemStore{}
+
+	ctx := context.Background()
+	if err := NewCookieStore([]byte("some key")).Ping(ctx); err != nil {
+		t.Fatal("failed to ping cookie store", err)
+	}
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = NewFilesystemStore(dir, []byte("some key")).Ping(ctx); err != nil {
+		t.Fatal("failed to ping filesystem store", err)
+	}
+	err = NewFilesystemStore(filepath.Join(dir, "missing"), []byte("some key")).Ping(ctx)
+	if !errors.Is(err, ErrStorageUnavailable) {
+		t.Fatalf("bad error for a missing directory: got %v, want %v", err, ErrStorageUnavailable)
+	}
+}
+
+func TestNamePrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cookieStore := NewCookieStore([]byte("some key"))
+	cookieStore.NamePrefix = "a_"
+	fsStore := NewFilesystemStore(dir, []byte("some key"))
+	fsStore.NamePrefix = "a_"
+
+	for _, store := range []Store{cookieStore, fsStore} {
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "session")
+		if err != nil {
+			t.Fatalf("%T: failed to create session: %v", store, err)
+		}
+		session.Values["name"] = "gopher"
+		if err = session.Save(ctx); err != nil {
+			t.Fatalf("%T: failed to save session: %v", store, err)
+		}
+		cookie := &fasthttp.Cookie{}
+		cookie.SetKey("a_session")
+		if !ctx.Response.Header.Cookie(cookie) {
+			t.Fatalf("%T: expected the cookie a_session", store)
+		}
+
+		session, err = store.New(requestWithCookie(ctx, "a_session"), "session")
+		if err != nil || session.IsNew || session.Values["name"] != "gopher" {
+			t.Fatalf("%T: failed to load session: %v, %v", store, session.Values, err)
+		}
+		if session.Name() != "session" {
+			t.Fatalf("%T: bad session name: got %q, want %q", store, session.Name(), "session")
+		}
+	}
+
+	cookieStore.NamePrefix = "a;"
+	if _, err = cookieStore.New(&fasthttp.RequestCtx{}, "session"); err == nil {
+		t.Fatal("expected an error for an invalid name prefix")
+	}
+}
+
+func TestFilesystemStoreCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFilesystemStore(dir, []byte("some key"))
+	store.FileSerializer = JSONSerializer{}
+
+	// An uncompressed file, saved before enabling compression.
+	ctx := &fasthttp.RequestCtx{}
+	plain, _ := store.New(ctx, "hello")
+	plain.Values["name"] = strings.Repeat("gopher", 100)
+	if err = plain.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	plainCtx := requestWithCookie(ctx, "hello")
+
+	store.Compress = true
+	ctx = &fasthttp.RequestCtx{}
+	compressed, _ := store.New(ctx, "hello")
+	compressed.Values["name"] = strings.Repeat("gopher", 100)
+	if err = compressed.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	compressedCtx := requestWithCookie(ctx, "hello")
+
+	data, err := ioutil.ReadFile(store.filename(compressed.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, gzipMagic) || len(data) >= 600 {
+		t.Fatalf("expected a gzipped file, got %d bytes", len(data))
+	}
+	if data, _ = ioutil.ReadFile(store.filename(plain.ID)); bytes.HasPrefix(data, gzipMagic) {
+		t.Fatal("expected the previous file to be left uncompressed")
+	}
+
+	for _, req := range []*fasthttp.RequestCtx{plainCtx, compressedCtx} {
+		session, err := store.New(req, "hello")
+		if err != nil || session.IsNew || session.Values["name"] != strings.Repeat("gopher", 100) {
+			t.Fatalf("failed to load session: %v", err)
+		}
+	}
+}
+
+func TestCookieStoreChunkSize(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	store.ChunkSize = 1000
+	store.MaxChunks = 3
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "hello")
+	session.Values["big"] = strings.Repeat("x", 1200)
+	if err := session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := ctx.Response.Header.PeekCookie("hello"); len(c) > 0 {
+		t.Fatal("expected no cookie for the whole session")
+	}
+
+	req := &fasthttp.RequestCtx{}
+	for i := 0; i < 3; i++ {
+		cookie := &fasthttp.Cookie{}
+		cookie.SetKey(chunkName("hello", i))
+		if ctx.Response.Header.Cookie(cookie) {
+			req.Request.Header.SetCookieBytesKV(cookie.Key(), cookie.Value())
+		}
+	}
+	if c := req.Request.Header.Cookie("hello.1"); len(c) == 0 {
+		t.Fatal("expected the session to be split")
+	}
+	session, err := store.New(req, "hello")
+	if err != nil || session.IsNew || session.Values["big"] != strings.Repeat("x", 1200) {
+		t.Fatalf("failed to reassemble session: %v", err)
+	}
+
+	// A smaller session expires the chunks no longer used.
+	delete(session.Values, "big")
+	if err = session.Save(req); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := req.Response.Header.PeekCookie("hello"); len(c) == 0 {
+		t.Fatal("expected a single cookie")
+	}
+	cookie := &fasthttp.Cookie{}
+	cookie.SetKey("hello.1")
+	if !req.Response.Header.Cookie(cookie) || !cookie.Expire().Before(time.Now()) {
+		t.Fatal("expected the chunk to be expired")
+	}
+
+	// Partial chunks.
+	req.Request.Header.DelCookie("hello.1")
+	if session, err = store.New(req, "hello"); err == nil || !session.IsNew {
+		t.Fatal("expected an error for partial chunks")
+	}
+
+	// Too many chunks.
+	session.Values["big"] = strings.Repeat("x", 4000)
+	if err = session.Save(&fasthttp.RequestCtx{}); err == nil {
+		t.Fatal("expected an error for too many chunks")
+	}
+}
+
+func TestFilesystemStoreCheckVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFilesystemStore(dir, []byte("some key"))
+	store.CheckVersion = true
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "hello")
+	session.Values["count"] = 0
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// Two concurrent requests load the same session.
+	req1, req2 := requestWithCookie(ctx, "hello"), requestWithCookie(ctx, "hello")
+	first, err := store.New(req1, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	second, err := store.New(req2, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	first.Values["count"] = 1
+	if err = first.Save(req1); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	second.Values["count"] = 2
+	if err = second.Save(req2); err != ErrConflict {
+		t.Fatalf("bad error: got %v, want %v", err, ErrConflict)
+	}
+
+	// Retry with the current session.
+	req2 = requestWithCookie(ctx, "hello")
+	second, _ = store.New(req2, "hello")
+	if second.Values["count"] != 1 {
+		t.Fatalf("bad count: got %v, want 1", second.Values["count"])
+	}
+	second.Values["count"] = 2
+	if err = second.Save(req2); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	second, _ = store.New(requestWithCookie(ctx, "hello"), "hello")
+	if second.Values["count"] != 2 {
+		t.Fatalf("bad count: got %v, want 2", second.Values["count"])
+	}
+}
+
+// The counters kept in the values are decoded as float64 by JSON.
+func TestFilesystemStoreCountersJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFilesystemStore(dir, []byte("some key"))
+	store.FileSerializer = JSONSerializer{}
+	store.CheckVersion = true
+
+	ctx := &fasthttp.RequestCtx{}
+	session, _ := store.New(ctx, "hello")
+	if err = session.Save(ctx); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	req1, req2 := requestWithCookie(ctx, "hello"), requestWithCookie(ctx, "hello")
+	first, _ := store.New(req1, "hello")
+	second, _ := store.New(req2, "hello")
+	if err = first.Save(req1); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if err = second.Save(req2); err != ErrConflict {
+		t.Fatalf("bad error: got %v, want %v", err, ErrConflict)
+	}
+
+	store.CheckVersion = false
+	store.RotateEvery = 2
+	id := first.ID
+	for i := 0; i < 3; i++ {
+		ctx = requestWithCookie(req1, "hello")
+		if first, err = store.New(ctx, "hello"); err != nil {
+			t.Fatal("failed to load session", err)
+		}
+		if err = first.Save(ctx); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		req1 = ctx
+	}
+	if first.ID == id {
+		t.Fatal("session ID not rotated after the threshold")
+	}
+
+	defer func(track bool) {
+		TrackLastAccess = track
+	}(TrackLastAccess)
+	TrackLastAccess = true
+	ctx = requestWithCookie(req1, "hello")
+	defer Clear(ctx)
+	session, _ = store.Get(ctx, "session-key")
+	session.Save(ctx)
+	req := requestWithCookie(ctx, "session-key")
+	defer Clear(req)
+	if session, _ = store.Get(req, "session-key"); session.LastAccessedAt().IsZero() {
+		t.Fatal("expected the last access time to be read back")
+	}
+}
+
+func TestCookieStoreToken(t *testing.T) {
+	store := NewCookieStore([]byte("some key"), []byte("0123456789abcdef"))
+	token, err := store.EncodeToken(map[interface{}]interface{}{"email": "gopher@example.com"}, time.Minute)
+	if err != nil {
+		t.Fatal("failed to encode token", err)
+	}
+	if strings.ContainsAny(token, "+/") {
+		t.Fatalf("expected a URL-safe token, got %q", token)
+	}
+	values, err := store.DecodeToken(token)
+	if err != nil {
+		t.Fatal("failed to decode token", err)
+	}
+	if len(values) != 1 || values["email"] != "gopher@example.com" {
+		t.Fatalf("bad token values: got %v", values)
+	}
+
+	// Expired tokens.
+	expired, _ := store.EncodeToken(map[interface{}]interface{}{"email": "gopher@example.com"}, -time.Minute)
+	if _, err = store.DecodeToken(expired); err != ErrTokenExpired {
+		t.Fatalf("bad error: got %v, want %v", err, ErrTokenExpired)
+	}
+
+	// Tampered tokens and tokens of other keys.
+	other, _ := NewCookieStore([]byte("other key"), []byte("0123456789abcdef")).EncodeToken(values, time.Minute)
+	for _, token := range []string{other, token[:len(token)-4] + "AAAA"} {
+		if _, err = store.DecodeToken(token); err == nil {
+			t.Fatalf("expected an error for token %q", token)
+		}
+	}
+
+	// Tokens are not session cookies.
+	session := NewSession(store, "hello")
+	if err = store.Decode("hello", token, session); err == nil {
+		t.Fatal("expected tokens to be rejected as cookies")
+	}
+}
+
+func TestJWTCookieStoreToken(t *testing.T) {
+	for name, store := range map[string]*CookieStore{
+		"JWT":    NewJWTCookieStore([]byte("some key 0123456789")),
+		"Public": NewPublicCookieStore([]byte("some key 0123456789")),
+	} {
+		token, err := store.EncodeToken(map[interface{}]interface{}{"email": "gopher@example.com"}, time.Hour)
+		if err != nil {
+			t.Fatalf("%s: failed to encode token: %v", name, err)
+		}
+		values, err := store.DecodeToken(token)
+		if err != nil {
+			t.Fatalf("%s: failed to decode token: %v", name, err)
+		}
+		if len(values) != 1 || values["email"] != "gopher@example.com" {
+			t.Fatalf("%s: bad token values: got %v", name, values)
+		}
+		expired, _ := store.EncodeToken(values, -time.Minute)
+		if _, err = store.DecodeToken(expired); err != ErrTokenExpired {
+			t.Fatalf("%s: bad error: got %v, want %v", name, err, ErrTokenExpired)
+		}
+	}
+}
+
+func TestNilOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cookieStore := NewCookieStore([]byte("some key"))
+	fsStore := NewFilesystemStore(dir, []byte("some key"))
+
+	for _, tc := range []struct {
+		store   Store
+		options *Options
+	}{
+		{cookieStore, cookieStore.Options},
+		{fsStore, fsStore.Options},
+	} {
+		tc.options.MaxAge = 100
+		ctx := &fasthttp.RequestCtx{}
+		session, err := tc.store.New(ctx, "session")
+		if err != nil {
+			t.Fatalf("%T: failed to create session: %v", tc.store, err)
+		}
+		// Sessions keep the defaults of the store at the time of New.
+		tc.options.MaxAge = 200
+		if session.Options.MaxAge != 100 {
+			t.Fatalf("%T: bad MaxAge: got %d, want %d", tc.store, session.Options.MaxAge, 100)
+		}
+		session.Options = nil
+		if err = session.Save(ctx); err != nil {
+			t.Fatalf("%T: failed to save session: %v", tc.store, err)
+		}
+		if session.Options == nil || session.Options.MaxAge != 200 {
+			t.Fatalf("%T: expected the defaults at the time of Save, got %v", tc.store, session.Options)
+		}
+		cookie := &fasthttp.Cookie{}
+		cookie.SetKey("session")
+		if !ctx.Response.Header.Cookie(cookie) || time.Until(cookie.Expire()) < 150*time.Second {
+			t.Fatalf("%T: bad cookie expiry: %v", tc.store, cookie.Expire())
+		}
+	}
+}
+
+func TestCheckKeyPairs(t *testing.T) {
+	hashKey := []byte("some key")
+	for _, n := range []int{16, 24, 32} {
+		if err := CheckKeyPairs(hashKey, make([]byte, n)); err != nil {
+			t.Errorf("unexpected error for a %d bytes encryption key: %v", n, err)
+		}
+	}
+	if err := CheckKeyPairs(hashKey, nil, hashKey); err != nil {
+		t.Errorf("unexpected error for pairs without encryption keys: %v", err)
+	}
+
+	err := CheckKeyPairs(hashKey, make([]byte, 16), hashKey, make([]byte, 10))
+	if err == nil || !strings.Contains(err.Error(), "key pair 1") {
+		t.Fatalf("expected an error naming the second pair, got %v", err)
+	}
+	if err = CheckKeyPairs(nil, make([]byte, 16)); err == nil {
+		t.Fatal("expected an error for an empty authentication key")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected NewCookieStore to panic with a malformed key pair")
+		}
+	}()
+	NewCookieStore(hashKey, make([]byte, 10))
+}
+
+func TestCheckKeys(t *testing.T) {
+	if err := CheckKeys([]byte("a key of 16 byte"), make([]byte, 32)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err := CheckKeys([]byte("a key of 16 byte"), []byte("short"))
+	if err == nil || !strings.Contains(err.Error(), "key 1") {
+		t.Fatalf("expected an error naming the second key, got %v", err)
+	}
+	if err = CheckKeys(); err == nil {
+		t.Fatal("expected an error without keys")
+	}
+
+	for name, create := range map[string]func(){
+		"NewJWTCookieStore":     func() { NewJWTCookieStore([]byte("short")) },
+		"NewSignedCookieStore":  func() { NewSignedCookieStore() },
+		"NewDerivedCookieStore": func() { NewDerivedCookieStore([]byte("short"), nil) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("expected %s to panic with missing or short keys", name)
+				}
+			}()
+			create()
+		}()
+	}
+}
+
+func TestRotatingCookieStore(t *testing.T) {
+	hashKey := []byte("some key")
+	oldBlockKey, newBlockKey := []byte("0123456789abcdef"), []byte("fedcba9876543210")
+	old := NewRotatingCookieStore([][]byte{hashKey}, [][]byte{oldBlockKey})
+	encoded, err := EncodeSession(old, "hello", map[interface{}]interface{}{"name": "gopher"})
+	if err != nil {
+		t.Fatal("failed to encode session", err)
+	}
+
+	// The encryption key rotated, the authentication key did not.
+	store := NewRotatingCookieStore(
+		[][]byte{hashKey, []byte("old key")},
+		[][]byte{newBlockKey, oldBlockKey},
+	)
+	if len(store.Codecs) != 4 {
+		t.Fatalf("bad number of codecs: got %d, want 4", len(store.Codecs))
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie("hello", encoded)
+	session, err := store.New(ctx, "hello")
+	if err != nil {
+		t.Fatal("failed to decode session with the old encryption key", err)
+	}
+	if session.Values["name"] != "gopher" || session.CodecIndex() != 1 {
+		t.Fatalf("bad session: got %v with codec %d, want name %q with codec 1", session.Values, session.CodecIndex(), "gopher")
+	}
+
+	// New sessions use the current keys only.
+	if encoded, err = EncodeSession(store, "hello", session.Values); err != nil {
+		t.Fatal("failed to encode session", err)
+	}
+	if err = securecookie.New(hashKey, newBlockKey).Decode("hello", encoded, &session.Values); err != nil {
+		t.Fatal("failed to decode session with the current keys", err)
+	}
+	if err = securecookie.New(hashKey, oldBlockKey).Decode("hello", encoded, &session.Values); err == nil {
+		t.Fatal("expected the old encryption key to fail decoding a new session")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected NewRotatingCookieStore to panic without authentication keys")
+		}
+	}()
+	NewRotatingCookieStore(nil, [][]byte{newBlockKey})
+}
+
+func TestCookieStoreAdditionalData(t *testing.T) {
+	newStore := func(ad string) *CookieStore {
+		store := NewCookieStore([]byte("some key"))
+		if ad != "" {
+			store.AdditionalData = []byte(ad)
+		}
+		return store
+	}
+	encoded, err := EncodeSession(newStore("staging"), "hello", map[interface{}]interface{}{"name": "gopher"})
+	if err != nil {
+		t.Fatal("failed to encode session", err)
+	}
+	if err = newStore("staging").Decode("hello", encoded, NewSession(nil, "hello")); err != nil {
+		t.Fatal("failed to decode session with the same additional data", err)
+	}
+	for _, ad := range []string{"production", ""} {
+		if err = newStore(ad).Decode("hello", encoded, NewSession(nil, "hello")); err != ErrSignatureInvalid {
+			t.Errorf("bad error decoding with additional data %q: got %v, want %v", ad, err, ErrSignatureInvalid)
+		}
+	}
+
+	token, err := newStore("staging").EncodeToken(map[interface{}]interface{}{"name": "gopher"}, time.Minute)
+	if err != nil {
+		t.Fatal("failed to encode token", err)
+	}
+	if _, err = newStore("production").DecodeToken(token); err != ErrSignatureInvalid {
+		t.Fatalf("bad error decoding token: got %v, want %v", err, ErrSignatureInvalid)
+	}
+}
+
+func TestFilesystemStoreStreamSerializer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, compress := range []bool{false, true} {
+		store := NewFilesystemStore(dir, []byte("some key"))
+		store.FileSerializer = GobSerializer{}
+		store.Compress = compress
+		ctx := &fasthttp.RequestCtx{}
+		session, err := store.New(ctx, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["name"] = "gopher"
+		if err = session.Save(ctx); err != nil {
+			t.Fatalf("compress=%v: failed to save session: %v", compress, err)
+		}
+		if session, err = store.New(requestWithCookie(ctx, "hello"), "hello"); err != nil {
+			t.Fatalf("compress=%v: failed to load session: %v", compress, err)
+		}
+		if session.Values["name"] != "gopher" {
+			t.Fatalf("compress=%v: bad session: got %v, want name %q", compress, session.Values, "gopher")
+		}
+
+		store.MaxBytes = 16
+		session.Values["blob"] = strings.Repeat("x", 100)
+		if err = session.Save(ctx); !errors.Is(err, ErrSessionTooLarge) {
+			t.Fatalf("compress=%v: bad error: got %v, want %v", compress, err, ErrSessionTooLarge)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "tmp_*")); len(files) != 0 {
+		t.Fatalf("temporary files left: %v", files)
+	}
+}
+
+// BenchmarkFilesystemStoreLargeSession contrasts the memory allocated to save
+// and load a large session, reported as B/op, when the session file is
+// encoded in memory or streamed.
+func BenchmarkFilesystemStoreLargeSession(b *testing.B) {
+	blob := bytes.Repeat([]byte("x"), 4<<20)
+	for _, bc := range []struct {
+		name       string
+		serializer securecookie.Serializer
+	}{
+		{"Bytes", securecookie.GobEncoder{}},
+		{"Stream", GobSerializer{}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "sessions")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			store := NewFilesystemStore(dir, []byte("some key"))
+			store.FileSerializer = bc.serializer
+			session := NewSession(store, "hello")
+			session.ID = "large"
+			session.Values["blob"] = blob
+			loaded := NewSession(store, "hello")
+			loaded.ID = "large"
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err = store.save(session); err != nil {
+					b.Fatal(err)
+				}
+				if err = store.load("hello", loaded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipSaveOnSafeMethods(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	cookieStore := NewCookieStore([]byte("some key"))
+	cookieStore.SkipSaveOnSafeMethods = true
+	fsStore := NewFilesystemStore(dir, []byte("some key"))
+	fsStore.SkipSaveOnSafeMethods = true
+
+	for _, store := range []Store{cookieStore, fsStore} {
+		// A new session without values is not saved on GET.
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(fasthttp.MethodGet)
+		session, _ := store.New(ctx, "hello")
+		if err = session.Save(ctx); err != nil {
+			t.Fatalf("%T: failed to save session: %v", store, err)
+		}
+		if c := ctx.Response.Header.PeekCookie("hello"); len(c) > 0 {
+			t.Fatalf("%T: unexpected cookie for an empty session on GET: %s", store, c)
+		}
+
+		// Saved on POST.
+		ctx = &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		session, _ = store.New(ctx, "hello")
+		session.Values["name"] = "gopher"
+		if err = session.Save(ctx); err != nil {
+			t.Fatalf("%T: failed to save session: %v", store, err)
+		}
+		if c := ctx.Response.Header.PeekCookie("hello"); len(c) == 0 {
+			t.Fatalf("%T: the cookie has not been sent on POST", store)
+		}
+
+		// An unmodified session is not saved on GET.
+		req := requestWithCookie(ctx, "hello")
+		req.Request.Header.SetMethod(fasthttp.MethodGet)
+		if session, err = store.New(req, "hello"); err != nil || session.IsNew {
+			t.Fatalf("%T: failed to load session: %v", store, err)
+		}
+		if err = session.Save(req); err != nil {
+			t.Fatalf("%T: failed to save session: %v", store, err)
+		}
+		if c := req.Response.Header.PeekCookie("hello"); len(c) > 0 {
+			t.Fatalf("%T: unexpected cookie for an unmodified session on GET: %s", store, c)
+		}
+
+		// A modified session is saved on GET.
+		session.Values["name"] = "someone else"
+		if err = session.Save(req); err != nil {
+			t.Fatalf("%T: failed to save session: %v", store, err)
+		}
+		if c := req.Response.Header.PeekCookie("hello"); len(c) == 0 {
+			t.Fatalf("%T: the cookie of a modified session has not been sent on GET", store)
+		}
+	}
+}